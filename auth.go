@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// AuthConfig describes the user identity presented when activating a session.
+type AuthConfig struct {
+	Mode         string `yaml:"mode,omitempty"`         // Anonymous, UserName or Certificate. Empty means Anonymous.
+	Username     string `yaml:"username,omitempty"`     // User name for UserName mode
+	Password     string `yaml:"password,omitempty"`     // Password for UserName mode, usually given as ${VAR} or file:<path>
+	PasswordFile string `yaml:"passwordFile,omitempty"` // Otherwise read the password from this file in UserName mode
+	PasswordEnv  string `yaml:"passwordEnv,omitempty"`  // Otherwise read the password from this environment variable
+	CertFile     string `yaml:"cert,omitempty"`         // PEM-encoded user certificate for Certificate mode. Must be the client certificate, which it defaults to.
+}
+
+// TokenType maps the auth mode to an OPC UA user token type
+func (a AuthConfig) TokenType() (ua.UserTokenType, error) {
+	switch strings.ToLower(a.Mode) {
+	case "", "anonymous":
+		return ua.UserTokenTypeAnonymous, nil
+	case "username":
+		return ua.UserTokenTypeUserName, nil
+	case "certificate":
+		return ua.UserTokenTypeCertificate, nil
+	default:
+		return 0, fmt.Errorf("Unsupported auth mode %q (expected Anonymous, UserName or Certificate)", a.Mode)
+	}
+}
+
+// IsAnonymous is true when no user identity is configured
+func (a AuthConfig) IsAnonymous() bool {
+	tokenType, err := a.TokenType()
+	return err == nil && tokenType == ua.UserTokenTypeAnonymous
+}
+
+// Validate checks the identity settings before we try to connect
+func (a AuthConfig) Validate() error {
+	tokenType, err := a.TokenType()
+	if err != nil {
+		return err
+	}
+	switch tokenType {
+	case ua.UserTokenTypeUserName:
+		if a.Username == "" {
+			return fmt.Errorf("Auth mode UserName requires a username")
+		}
+		if a.Password == "" && a.PasswordFile == "" && a.PasswordEnv == "" {
+			return fmt.Errorf("Auth mode UserName requires a password, password file or environment variable")
+		}
+	}
+	return nil
+}
+
+// Check that the user certificate for Certificate mode is the client certificate. The user token
+// is signed with the client private key, so the server rejects any other certificate.
+func (a AuthConfig) checkUserCertificate(security SecurityConfig) error {
+	if tokenType, _ := a.TokenType(); tokenType != ua.UserTokenTypeCertificate || a.CertFile == "" {
+		return nil
+	}
+	clientCertFile := security.CertFile
+	if clientCertFile == "" && security.PKIDir != "" {
+		clientCertFile = NewPKI(security.PKIDir).CertFile()
+	}
+	if clientCertFile == "" {
+		return fmt.Errorf("Auth mode Certificate signs the user token with the client private key, so a client certificate and key are required")
+	}
+	userCert, err := loadCertificateDER(a.CertFile)
+	if err != nil {
+		return err
+	}
+	clientCert, err := loadCertificateDER(clientCertFile)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(userCert, clientCert) {
+		return fmt.Errorf("The user certificate %s must be the client certificate %s, as the user token is signed with the client private key", a.CertFile, clientCertFile)
+	}
+	return nil
+}
+
+// ReadPassword returns the configured password, or reads it from the configured file, falling back to the environment variable.
+func (a AuthConfig) ReadPassword() (string, error) {
+	if a.Password != "" {
+		return a.Password, nil
+	}
+	if a.PasswordFile != "" {
+		content, err := ioutil.ReadFile(a.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("Error reading password file: %v", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	password, ok := os.LookupEnv(a.PasswordEnv)
+	if !ok {
+		return "", fmt.Errorf("Password environment variable %s is not set", a.PasswordEnv)
+	}
+	return password, nil
+}
+
+// Build the client options for the configured identity token. A certificate token presents the
+// client certificate, given in DER form. These must come before opcua.SecurityFromEndpoint() so
+// that it fills in the policy ID.
+func (a AuthConfig) clientOptions(clientCert []byte) ([]opcua.Option, error) {
+	tokenType, err := a.TokenType()
+	if err != nil {
+		return nil, err
+	}
+	switch tokenType {
+	case ua.UserTokenTypeUserName:
+		password, err := a.ReadPassword()
+		if err != nil {
+			return nil, err
+		}
+		return []opcua.Option{opcua.AuthUsername(a.Username, password)}, nil
+	case ua.UserTokenTypeCertificate:
+		return []opcua.Option{opcua.AuthCertificate(clientCert)}, nil
+	default:
+		return []opcua.Option{opcua.AuthAnonymous()}, nil
+	}
+}
+
+// Check that the endpoint accepts the requested kind of user identity token.
+func checkUserTokenPolicy(ep *ua.EndpointDescription, tokenType ua.UserTokenType) error {
+	var offered []string
+	for _, t := range ep.UserIdentityTokens {
+		if t.TokenType == tokenType {
+			return nil
+		}
+		offered = append(offered, t.TokenType.String())
+	}
+	return fmt.Errorf("Server endpoint %s/%s does not accept %s user tokens (offered: %s)",
+		strings.TrimPrefix(ep.SecurityPolicyURI, ua.SecurityPolicyURIPrefix), ep.SecurityMode, tokenType, strings.Join(offered, ", "))
+}
+
+func loadCertificateDER(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading certificate: %v", err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("No PEM certificate found in %s", path)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, fmt.Errorf("Error parsing certificate %s: %v", path, err)
+	}
+	return block.Bytes, nil
+}
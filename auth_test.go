@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthConfigValidate(t *testing.T) {
+	validConfigs := []AuthConfig{
+		{},
+		{Mode: "Anonymous"},
+		{Mode: "UserName", Username: "operator", PasswordEnv: "OPCUA_PASSWORD"},
+		{Mode: "username", Username: "operator", PasswordFile: "/run/secrets/opcua"},
+		{Mode: "Certificate", CertFile: "user.pem"},
+		{Mode: "Certificate"}, // the client certificate
+	}
+	for _, c := range validConfigs {
+		assert.NoError(t, c.Validate(), "%+v", c)
+	}
+
+	invalidConfigs := []AuthConfig{
+		{Mode: "Kerberos"},
+		{Mode: "UserName", PasswordEnv: "OPCUA_PASSWORD"},
+		{Mode: "UserName", Username: "operator"},
+	}
+	for _, c := range invalidConfigs {
+		assert.Error(t, c.Validate(), "%+v", c)
+	}
+}
+
+func TestAuthPassword(t *testing.T) {
+	f, err := ioutil.TempFile("", "opcua_password")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("s3cret\n")
+	f.Close()
+
+	password, err := AuthConfig{PasswordFile: f.Name(), PasswordEnv: "OPCUA_TEST_PASSWORD"}.ReadPassword()
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", password)
+
+	os.Setenv("OPCUA_TEST_PASSWORD", "fromenv")
+	defer os.Unsetenv("OPCUA_TEST_PASSWORD")
+	password, err = AuthConfig{PasswordEnv: "OPCUA_TEST_PASSWORD"}.ReadPassword()
+	assert.NoError(t, err)
+	assert.Equal(t, "fromenv", password)
+
+	_, err = AuthConfig{PasswordEnv: "OPCUA_TEST_PASSWORD_UNSET"}.ReadPassword()
+	assert.Error(t, err)
+
+	password, err = AuthConfig{Password: "inline", PasswordFile: f.Name()}.ReadPassword()
+	assert.NoError(t, err)
+	assert.Equal(t, "inline", password)
+}
+
+func TestAuthCheckUserCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opcua_pki")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pki := NewPKI(filepath.Join(dir, "client"))
+	assert.NoError(t, pki.Init("urn:test:opcua_exporter"))
+	other := NewPKI(filepath.Join(dir, "other"))
+	assert.NoError(t, other.Init("urn:test:user"))
+
+	security := SecurityConfig{PKIDir: pki.Dir}
+	assert.NoError(t, AuthConfig{Mode: "Certificate"}.checkUserCertificate(security))
+	assert.NoError(t, AuthConfig{Mode: "Certificate", CertFile: pki.CertFile()}.checkUserCertificate(security))
+	assert.NoError(t, AuthConfig{Mode: "Certificate", CertFile: pki.CertFile()}.checkUserCertificate(SecurityConfig{CertFile: pki.CertFile()}))
+	assert.Error(t, AuthConfig{Mode: "Certificate", CertFile: other.CertFile()}.checkUserCertificate(security))
+	assert.Error(t, AuthConfig{Mode: "Certificate", CertFile: other.CertFile()}.checkUserCertificate(SecurityConfig{}))
+	assert.NoError(t, AuthConfig{Mode: "Anonymous", CertFile: other.CertFile()}.checkUserCertificate(security))
+}
+
+func TestCheckUserTokenPolicy(t *testing.T) {
+	ep := &ua.EndpointDescription{
+		SecurityPolicyURI: ua.SecurityPolicyURIBasic256Sha256,
+		SecurityMode:      ua.MessageSecurityModeSignAndEncrypt,
+		UserIdentityTokens: []*ua.UserTokenPolicy{
+			{PolicyID: "anon", TokenType: ua.UserTokenTypeAnonymous},
+			{PolicyID: "user", TokenType: ua.UserTokenTypeUserName},
+		},
+	}
+	assert.NoError(t, checkUserTokenPolicy(ep, ua.UserTokenTypeAnonymous))
+	assert.NoError(t, checkUserTokenPolicy(ep, ua.UserTokenTypeUserName))
+	assert.Error(t, checkUserTokenPolicy(ep, ua.UserTokenTypeCertificate))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponentially increasing delays between reconnect attempts.
+// Each call to Next() multiplies the previous delay by Factor, up to Max,
+// and randomizes the result by +/- Jitter (a fraction between 0 and 1)
+// so that many exporters don't hammer a recovering server in lockstep.
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	Factor  float64
+	Jitter  float64
+	attempt int
+}
+
+// NewBackoff creates a Backoff with a doubling factor and 20% jitter
+func NewBackoff(min time.Duration, max time.Duration) *Backoff {
+	return &Backoff{
+		Min:    min,
+		Max:    max,
+		Factor: 2.0,
+		Jitter: 0.2,
+	}
+}
+
+// Next returns the delay to wait before the next attempt
+func (b *Backoff) Next() time.Duration {
+	delay := float64(b.Min) * math.Pow(b.Factor, float64(b.attempt))
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	} else {
+		b.attempt++
+	}
+
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// Reset starts the delay sequence over from Min
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(time.Second, 10*time.Second)
+	b.Jitter = 0
+
+	assert.Equal(t, 1*time.Second, b.Next())
+	assert.Equal(t, 2*time.Second, b.Next())
+	assert.Equal(t, 4*time.Second, b.Next())
+	assert.Equal(t, 8*time.Second, b.Next())
+	assert.Equal(t, 10*time.Second, b.Next())
+	assert.Equal(t, 10*time.Second, b.Next())
+
+	b.Reset()
+	assert.Equal(t, 1*time.Second, b.Next())
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := NewBackoff(time.Second, 10*time.Second)
+	for i := 0; i < 20; i++ {
+		delay := b.Next()
+		assert.True(t, delay >= 800*time.Millisecond, "delay %v too short", delay)
+		assert.True(t, delay <= 12*time.Second, "delay %v too long", delay)
+	}
+}
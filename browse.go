@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// BrowsedNode describes a node found by the browse subcommand
+type BrowsedNode struct {
+	NodeID      string      `json:"nodeId"`
+	BrowseName  string      `json:"browseName"`
+	Path        []string    `json:"path"` // browse names from the root
+	NodeClass   string      `json:"nodeClass"`
+	DataType    string      `json:"dataType,omitempty"`
+	AccessLevel string      `json:"accessLevel,omitempty"`
+	Value       interface{} `json:"value,omitempty"`
+}
+
+var accessLevelNames = []struct {
+	flag ua.AccessLevelType
+	name string
+}{
+	{ua.AccessLevelTypeCurrentRead, "CurrentRead"},
+	{ua.AccessLevelTypeCurrentWrite, "CurrentWrite"},
+	{ua.AccessLevelTypeHistoryRead, "HistoryRead"},
+	{ua.AccessLevelTypeHistoryWrite, "HistoryWrite"},
+	{ua.AccessLevelTypeSemanticChange, "SemanticChange"},
+	{ua.AccessLevelTypeStatusWrite, "StatusWrite"},
+	{ua.AccessLevelTypeTimestampWrite, "TimestampWrite"},
+}
+
+var browseOutputFormats = map[string]func(w io.Writer, nodes []BrowsedNode) error{
+	"tree": writeBrowseTree,
+	"json": writeBrowseJSON,
+	"csv":  writeBrowseCSV,
+}
+
+func runBrowse(args []string) error {
+	flags := newSubcommandFlagSet("browse", "Print the address space of an OPC UA server, to help with writing the config.")
+	root := flags.String("root", "ns=0;i=85", "Node ID, or browse path from the Root folder such as /Objects/Line1/Press, to start browsing from")
+	depth := flags.Int("depth", 3, "How many levels to browse below the root (0 for no limit)")
+	format := flags.String("format", "tree", "Output format: tree, json or csv")
+	flags.Parse(args)
+
+	writeNodes, ok := browseOutputFormats[*format]
+	if !ok {
+		return fmt.Errorf("Unknown output format %q (expected tree, json or csv)", *format)
+	}
+
+	client, err := connectFromFlags(context.Background())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	rootID, err := resolveDiscoveryRoot(client, *root)
+	if err != nil {
+		return err
+	}
+	nodes, err := browseTree(client, rootID, *depth)
+	if err != nil {
+		return err
+	}
+	return writeNodes(os.Stdout, nodes)
+}
+
+// Walk the hierarchy below the root, depth first, reading the attributes of every node
+func browseTree(client *opcua.Client, root *ua.NodeID, maxDepth int) ([]BrowsedNode, error) {
+	var nodes []BrowsedNode
+	visited := make(map[string]bool)
+	var browse func(nodeID *ua.NodeID, browsePath []string) error
+	browse = func(nodeID *ua.NodeID, browsePath []string) error {
+		visited[nodeID.String()] = true
+		node, err := readBrowsedNode(client, nodeID, browsePath)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, node)
+		if maxDepth > 0 && len(browsePath) >= maxDepth {
+			return nil
+		}
+
+		refs, err := client.Node(nodeID).References(id.HierarchicalReferences, ua.BrowseDirectionForward, ua.NodeClassAll, true)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if ref.NodeID == nil || ref.NodeID.NodeID == nil || ref.BrowseName == nil || visited[ref.NodeID.NodeID.String()] {
+				continue
+			}
+			childPath := append(append([]string{}, browsePath...), ref.BrowseName.Name)
+			if err := browse(ref.NodeID.NodeID, childPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := browse(root, nil); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// Read the attributes of one node. Attributes the node doesn't have are left empty.
+func readBrowsedNode(client *opcua.Client, nodeID *ua.NodeID, browsePath []string) (BrowsedNode, error) {
+	results, err := client.Node(nodeID).Attributes(
+		ua.AttributeIDBrowseName, ua.AttributeIDNodeClass, ua.AttributeIDDataType, ua.AttributeIDAccessLevel, ua.AttributeIDValue)
+	if err != nil {
+		return BrowsedNode{}, err
+	}
+	if len(results) != 5 {
+		return BrowsedNode{}, fmt.Errorf("Read response has %d results for 5 attributes of %s", len(results), nodeID)
+	}
+	attribute := func(i int) interface{} {
+		if results[i].Status != ua.StatusOK || results[i].Value == nil {
+			return nil
+		}
+		return results[i].Value.Value()
+	}
+
+	node := BrowsedNode{NodeID: nodeID.String(), Path: browsePath}
+	if browseName, ok := attribute(0).(*ua.QualifiedName); ok {
+		node.BrowseName = browseName.Name
+	}
+	if nodeClass, ok := attribute(1).(int32); ok {
+		node.NodeClass = strings.TrimPrefix(ua.NodeClass(nodeClass).String(), "NodeClass")
+	}
+	if dataType, ok := attribute(2).(*ua.NodeID); ok {
+		node.DataType = dataTypeName(dataType)
+	}
+	if accessLevel, ok := attribute(3).(uint8); ok {
+		node.AccessLevel = formatAccessLevel(ua.AccessLevelType(accessLevel))
+	}
+	if value := attribute(4); value != nil {
+		node.Value = browseValue(value)
+	}
+	return node, nil
+}
+
+// Format the access level flags, e.g. CurrentRead|CurrentWrite
+func formatAccessLevel(accessLevel ua.AccessLevelType) string {
+	var names []string
+	for _, level := range accessLevelNames {
+		if accessLevel&level.flag != 0 {
+			names = append(names, level.name)
+		}
+	}
+	if len(names) == 0 {
+		return "None"
+	}
+	return strings.Join(names, "|")
+}
+
+// Keep numbers, booleans and strings as they are for JSON output, and format anything else
+func browseValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case nil, bool, string, int8, uint8, int16, uint16, int32, uint32, int64, uint64, float32, float64:
+		return v
+	case *ua.LocalizedText:
+		return value.Text
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeBrowseTree(w io.Writer, nodes []BrowsedNode) error {
+	for _, node := range nodes {
+		line := fmt.Sprintf("%s%s (%s) %s", strings.Repeat("  ", len(node.Path)), node.BrowseName, node.NodeID, node.NodeClass)
+		if node.DataType != "" {
+			line += " " + node.DataType
+		}
+		if node.AccessLevel != "" {
+			line += " " + node.AccessLevel
+		}
+		if node.Value != nil {
+			line += fmt.Sprintf(" = %v", node.Value)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeBrowseJSON(w io.Writer, nodes []BrowsedNode) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(nodes)
+}
+
+func writeBrowseCSV(w io.Writer, nodes []BrowsedNode) error {
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write([]string{"NodeId", "BrowsePath", "BrowseName", "NodeClass", "DataType", "AccessLevel", "Value"})
+	for _, node := range nodes {
+		value := ""
+		if node.Value != nil {
+			value = fmt.Sprint(node.Value)
+		}
+		csvWriter.Write([]string{node.NodeID, "/" + strings.Join(node.Path, "/"), node.BrowseName, node.NodeClass, node.DataType, node.AccessLevel, value})
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+)
+
+var browsedNodes = []BrowsedNode{
+	{NodeID: "ns=2;s=Line1", BrowseName: "Line1", NodeClass: "Object"},
+	{
+		NodeID:      "ns=2;s=Line1.Temperature",
+		BrowseName:  "Temperature",
+		Path:        []string{"Temperature"},
+		NodeClass:   "Variable",
+		DataType:    "Double",
+		AccessLevel: "CurrentRead",
+		Value:       23.5,
+	},
+}
+
+func TestWriteBrowseTree(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, writeBrowseTree(&out, browsedNodes))
+	assert.Equal(t, `Line1 (ns=2;s=Line1) Object
+  Temperature (ns=2;s=Line1.Temperature) Variable Double CurrentRead = 23.5
+`, out.String())
+}
+
+func TestWriteBrowseCSV(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, writeBrowseCSV(&out, browsedNodes))
+	assert.Equal(t, `NodeId,BrowsePath,BrowseName,NodeClass,DataType,AccessLevel,Value
+ns=2;s=Line1,/,Line1,Object,,,
+ns=2;s=Line1.Temperature,/Temperature,Temperature,Variable,Double,CurrentRead,23.5
+`, out.String())
+}
+
+func TestWriteBrowseJSON(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, writeBrowseJSON(&out, browsedNodes[1:]))
+	assert.JSONEq(t, `[{
+		"nodeId": "ns=2;s=Line1.Temperature",
+		"browseName": "Temperature",
+		"path": ["Temperature"],
+		"nodeClass": "Variable",
+		"dataType": "Double",
+		"accessLevel": "CurrentRead",
+		"value": 23.5
+	}]`, out.String())
+}
+
+func TestFormatAccessLevel(t *testing.T) {
+	assert.Equal(t, "None", formatAccessLevel(ua.AccessLevelTypeNone))
+	assert.Equal(t, "CurrentRead|CurrentWrite", formatAccessLevel(ua.AccessLevelTypeCurrentRead|ua.AccessLevelTypeCurrentWrite))
+}
+
+func TestBrowseValue(t *testing.T) {
+	assert.Equal(t, int32(7), browseValue(int32(7)))
+	assert.Equal(t, "Running", browseValue(&ua.LocalizedText{Text: "Running"}))
+	assert.Equal(t, "ns=2;i=5", browseValue(ua.NewNumericNodeID(2, 5)))
+}
+
+func TestSubcommandFlagSet(t *testing.T) {
+	defer func(e string) { *endpoint = e }(*endpoint)
+
+	flags := newSubcommandFlagSet("browse", "")
+	depth := flags.Int("depth", 3, "")
+	assert.NoError(t, flags.Parse([]string{"-endpoint", "opc.tcp://plc1:4840", "-depth", "1"}))
+	assert.Equal(t, "opc.tcp://plc1:4840", *endpoint)
+	assert.Equal(t, 1, *depth)
+	assert.Nil(t, flags.Lookup("port"))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// SecurityConfig describes how the secure channel to an OPC UA server is set up.
+type SecurityConfig struct {
+	Policy   string `yaml:"policy,omitempty"` // Security policy short name (e.g. Basic256Sha256) or URI. Empty means None.
+	Mode     string `yaml:"mode,omitempty"`   // Message security mode: None, Sign or SignAndEncrypt. Empty picks the most secure one offered.
+	CertFile string `yaml:"cert,omitempty"`   // PEM-encoded client certificate
+	KeyFile  string `yaml:"key,omitempty"`    // PEM-encoded client private key
+
+	PKIDir         string `yaml:"pkiDir,omitempty"`         // Certificate store directory. Provides the client certificate if none is given, and verifies server certificates.
+	ApplicationURI string `yaml:"applicationURI,omitempty"` // Application URI for the generated client certificate
+}
+
+var supportedSecurityPolicies = []string{
+	"None",
+	"Basic256Sha256",
+	"Aes128Sha256RsaOaep",
+	"Aes256Sha256RsaPss",
+}
+
+// PolicyURI returns the canonical security policy URI
+func (s SecurityConfig) PolicyURI() string {
+	if s.Policy == "" {
+		return ua.SecurityPolicyURINone
+	}
+	return ua.FormatSecurityPolicyURI(s.Policy)
+}
+
+// MessageSecurityMode returns the requested mode, or MessageSecurityModeInvalid if any mode will do
+func (s SecurityConfig) MessageSecurityMode() ua.MessageSecurityMode {
+	return ua.MessageSecurityModeFromString(s.Mode)
+}
+
+// IsSecure is true when anything other than an unencrypted channel is requested
+func (s SecurityConfig) IsSecure() bool {
+	return s.PolicyURI() != ua.SecurityPolicyURINone
+}
+
+// Validate checks the security settings for consistency before we try to connect
+func (s SecurityConfig) Validate() error {
+	policyOK := false
+	for _, p := range supportedSecurityPolicies {
+		if s.PolicyURI() == ua.FormatSecurityPolicyURI(p) {
+			policyOK = true
+		}
+	}
+	if !policyOK {
+		return fmt.Errorf("Unsupported security policy %q (expected one of %s)", s.Policy, strings.Join(supportedSecurityPolicies, ", "))
+	}
+
+	mode := s.MessageSecurityMode()
+	if s.Mode != "" && mode == ua.MessageSecurityModeInvalid {
+		return fmt.Errorf("Unsupported security mode %q (expected None, Sign or SignAndEncrypt)", s.Mode)
+	}
+
+	if !s.IsSecure() {
+		if s.Mode != "" && mode != ua.MessageSecurityModeNone {
+			return fmt.Errorf("Security mode %s requires a security policy other than None", s.Mode)
+		}
+		return nil
+	}
+
+	if mode == ua.MessageSecurityModeNone {
+		return fmt.Errorf("Security policy %s requires security mode Sign or SignAndEncrypt", s.Policy)
+	}
+	if (s.CertFile == "" || s.KeyFile == "") && s.PKIDir == "" {
+		return fmt.Errorf("Security policy %s requires a client certificate and private key, or a PKI directory", s.Policy)
+	}
+	return nil
+}
+
+// Build an OPC UA client for the endpoint. When channel security or a user identity
+// is requested, the server's endpoints are queried and the one matching the policy and mode is used.
+// If the context has a deadline, the client's requests time out by then.
+func getClient(ctx context.Context, endpoint string, security SecurityConfig, auth AuthConfig) (*opcua.Client, error) {
+	if err := security.Validate(); err != nil {
+		return nil, err
+	}
+	if err := auth.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !security.IsSecure() && auth.IsAnonymous() {
+		return opcua.NewClient(endpoint, deadlineOptions(ctx)...), nil
+	}
+
+	var pki *PKI
+	if security.PKIDir != "" {
+		pki = NewPKI(security.PKIDir)
+		if err := pki.Init(security.ApplicationURI); err != nil {
+			return nil, fmt.Errorf("Error initializing PKI directory: %v", err)
+		}
+		if security.CertFile == "" && security.KeyFile == "" {
+			security.CertFile = pki.CertFile()
+			security.KeyFile = pki.KeyFile()
+		}
+	}
+
+	opts := deadlineOptions(ctx)
+	var clientCert []byte
+	if security.CertFile != "" && security.KeyFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(security.CertFile, security.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %v", err)
+		}
+		privateKey, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("Private key in %s is not an RSA key", security.KeyFile)
+		}
+		clientCert = keyPair.Certificate[0]
+		opts = append(opts, opcua.PrivateKey(privateKey), opcua.Certificate(clientCert))
+	}
+
+	tokenType, _ := auth.TokenType()
+	if tokenType == ua.UserTokenTypeCertificate && clientCert == nil {
+		return nil, fmt.Errorf("Auth mode Certificate signs the user token with the client private key, so a client certificate and key are required")
+	}
+	if err := auth.checkUserCertificate(security); err != nil {
+		return nil, err
+	}
+	authOpts, err := auth.clientOptions(clientCert)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, authOpts...)
+
+	endpoints, err := getEndpoints(ctx, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting endpoints from %s: %v", endpoint, err)
+	}
+	ep, err := selectEndpoint(endpoints, security.PolicyURI(), security.MessageSecurityMode())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUserTokenPolicy(ep, tokenType); err != nil {
+		return nil, err
+	}
+	if pki != nil && security.IsSecure() {
+		if err := pki.VerifyServerCertificate(ep.ServerCertificate); err != nil {
+			return nil, err
+		}
+	}
+
+	opts = append(opts, opcua.SecurityFromEndpoint(ep, tokenType))
+	return opcua.NewClient(endpoint, opts...), nil
+}
+
+// Client options to time out each request by the context's deadline, if it has one
+func deadlineOptions(ctx context.Context) []opcua.Option {
+	if deadline, ok := ctx.Deadline(); ok {
+		return []opcua.Option{opcua.RequestTimeout(time.Until(deadline))}
+	}
+	return nil
+}
+
+// Like opcua.GetEndpoints, but dialling with the context and timing out by its deadline
+func getEndpoints(ctx context.Context, endpoint string) ([]*ua.EndpointDescription, error) {
+	client := opcua.NewClient(endpoint, deadlineOptions(ctx)...)
+	if err := client.Dial(ctx); err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	res, err := client.GetEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	return res.Endpoints, nil
+}
+
+// Pick the endpoint with the highest security level that matches the policy URI
+// and security mode. MessageSecurityModeInvalid matches any mode.
+func selectEndpoint(endpoints []*ua.EndpointDescription, policyURI string, mode ua.MessageSecurityMode) (*ua.EndpointDescription, error) {
+	var selected *ua.EndpointDescription
+	var offered []string
+	for _, ep := range endpoints {
+		offered = append(offered, fmt.Sprintf("%s/%s", strings.TrimPrefix(ep.SecurityPolicyURI, ua.SecurityPolicyURIPrefix), ep.SecurityMode))
+		if ep.SecurityPolicyURI != policyURI {
+			continue
+		}
+		if mode != ua.MessageSecurityModeInvalid && ep.SecurityMode != mode {
+			continue
+		}
+		if selected == nil || ep.SecurityLevel > selected.SecurityLevel {
+			selected = ep
+		}
+	}
+
+	if selected == nil {
+		return nil, fmt.Errorf("Server has no endpoint for policy %s with mode %s (offered: %s)",
+			strings.TrimPrefix(policyURI, ua.SecurityPolicyURIPrefix), mode, strings.Join(offered, ", "))
+	}
+	return selected, nil
+}
+
+// Read the attributes in as many requests as the server's MaxNodesPerRead operation limit needs.
+// The results are in the same order as the attributes.
+func readChunked(client *opcua.Client, nodesToRead []*ua.ReadValueID, timestamps ua.TimestampsToReturn) ([]*ua.DataValue, error) {
+	limit := maxNodesPerRead(client, len(nodesToRead))
+	var results []*ua.DataValue
+	for start := 0; start < len(nodesToRead); start += limit {
+		end := start + limit
+		if end > len(nodesToRead) {
+			end = len(nodesToRead)
+		}
+		resp, err := client.Read(&ua.ReadRequest{NodesToRead: nodesToRead[start:end], TimestampsToReturn: timestamps})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Results) != end-start {
+			return nil, fmt.Errorf("Read response has %d results for %d attributes", len(resp.Results), end-start)
+		}
+		results = append(results, resp.Results...)
+	}
+	return results, nil
+}
+
+// The server's MaxNodesPerRead, or all the nodes at once if it has no limit or doesn't say
+func maxNodesPerRead(client *opcua.Client, total int) int {
+	value, err := client.Node(ua.NewNumericNodeID(0, id.Server_ServerCapabilities_OperationLimits_MaxNodesPerRead)).Value()
+	if err == nil && value != nil {
+		if limit, ok := value.Value().(uint32); ok && limit > 0 {
+			return int(limit)
+		}
+	}
+	return total
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityConfigValidate(t *testing.T) {
+	validConfigs := []SecurityConfig{
+		{},
+		{Policy: "None"},
+		{Policy: "None", Mode: "None"},
+		{Policy: "Basic256Sha256", Mode: "SignAndEncrypt", CertFile: "cert.pem", KeyFile: "key.pem"},
+		{Policy: "Aes128Sha256RsaOaep", Mode: "Sign", CertFile: "cert.pem", KeyFile: "key.pem"},
+		{Policy: "Aes256Sha256RsaPss", CertFile: "cert.pem", KeyFile: "key.pem"},
+		{Policy: ua.SecurityPolicyURIBasic256Sha256, CertFile: "cert.pem", KeyFile: "key.pem"},
+	}
+	for _, c := range validConfigs {
+		assert.NoError(t, c.Validate(), "%+v", c)
+	}
+
+	invalidConfigs := []SecurityConfig{
+		{Policy: "Basic128Rsa15", CertFile: "cert.pem", KeyFile: "key.pem"}, // deprecated
+		{Policy: "Bogus"},
+		{Policy: "None", Mode: "Sign"},
+		{Policy: "Basic256Sha256", Mode: "None", CertFile: "cert.pem", KeyFile: "key.pem"},
+		{Policy: "Basic256Sha256", Mode: "Scramble", CertFile: "cert.pem", KeyFile: "key.pem"},
+		{Policy: "Basic256Sha256", Mode: "SignAndEncrypt"}, // no certificate
+	}
+	for _, c := range invalidConfigs {
+		assert.Error(t, c.Validate(), "%+v", c)
+	}
+}
+
+func TestSelectEndpoint(t *testing.T) {
+	endpoints := []*ua.EndpointDescription{
+		{SecurityPolicyURI: ua.SecurityPolicyURINone, SecurityMode: ua.MessageSecurityModeNone, SecurityLevel: 0},
+		{SecurityPolicyURI: ua.SecurityPolicyURIBasic256Sha256, SecurityMode: ua.MessageSecurityModeSign, SecurityLevel: 3},
+		{SecurityPolicyURI: ua.SecurityPolicyURIBasic256Sha256, SecurityMode: ua.MessageSecurityModeSignAndEncrypt, SecurityLevel: 4},
+		{SecurityPolicyURI: ua.SecurityPolicyURIAes128Sha256RsaOaep, SecurityMode: ua.MessageSecurityModeSign, SecurityLevel: 5},
+	}
+
+	ep, err := selectEndpoint(endpoints, ua.SecurityPolicyURIBasic256Sha256, ua.MessageSecurityModeSign)
+	assert.NoError(t, err)
+	assert.Equal(t, endpoints[1], ep)
+
+	// Any mode picks the highest security level for the policy
+	ep, err = selectEndpoint(endpoints, ua.SecurityPolicyURIBasic256Sha256, ua.MessageSecurityModeInvalid)
+	assert.NoError(t, err)
+	assert.Equal(t, endpoints[2], ep)
+
+	_, err = selectEndpoint(endpoints, ua.SecurityPolicyURIAes256Sha256RsaPss, ua.MessageSecurityModeInvalid)
+	assert.Error(t, err)
+
+	_, err = selectEndpoint(endpoints, ua.SecurityPolicyURIAes128Sha256RsaOaep, ua.MessageSecurityModeSignAndEncrypt)
+	assert.Error(t, err)
+}
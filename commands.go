@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gopcua/opcua"
+)
+
+// Subcommands run instead of the exporter when named as the first argument, e.g. opcua_exporter browse ...
+var subcommands = map[string]func(args []string) error{
+	"browse":          runBrowse,
+	"generate-config": runGenerateConfig,
+	"import-tags":     runImportTags,
+	"migrate-config":  runMigrateConfig,
+	"validate":        runValidate,
+}
+
+// The exporter flags that subcommands share for connecting to a server
+var clientFlagNames = []string{
+	"endpoint", "security-policy", "security-mode", "cert", "key", "pki-dir", "application-uri",
+	"auth-mode", "username", "password-file", "password-env", "user-cert", "debug",
+}
+
+// Run the subcommand named by the first argument, if any. Returns false to run the exporter.
+func runSubcommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	command, ok := subcommands[args[0]]
+	if !ok {
+		return false
+	}
+	if err := command(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// Create the flag set for a subcommand that connects to a server. It includes the exporter's connection
+// flags, which set the same variables so that applyFlagDefaults() and getClient() work as usual.
+func newSubcommandFlagSet(name string, usage string) *flag.FlagSet {
+	flags := newOfflineFlagSet(name, usage)
+	addExporterFlags(flags, clientFlagNames)
+	return flags
+}
+
+// Add the named exporter flags to a subcommand's flag set, setting the same variables
+func addExporterFlags(flags *flag.FlagSet, flagNames []string) {
+	for _, flagName := range flagNames {
+		f := flag.CommandLine.Lookup(flagName)
+		flags.Var(f.Value, f.Name, f.Usage)
+	}
+}
+
+// Create the flag set for a subcommand that works on files only
+func newOfflineFlagSet(name string, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags]\n%s\n\nFlags:\n", os.Args[0], name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// Connect to the server given by the connection flags
+func connectFromFlags(ctx context.Context) (*opcua.Client, error) {
+	var server ServerConfig
+	applyFlagDefaults(&server)
+	if err := server.Security.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid security settings: %v", err)
+	}
+	if err := server.Auth.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid auth settings: %v", err)
+	}
+	client, err := getClient(ctx, server.Endpoint, server.Security, server.Auth)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Connect(ctx); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func subcommandNames() string {
+	var names []string
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the full exporter configuration: the OPC UA servers and the nodes to monitor on each,
+// plus any modules for the /probe endpoint.
+type Config struct {
+	Servers   []ServerConfig          `yaml:"servers"`
+	Modules   map[string]ModuleConfig `yaml:"modules,omitempty"`
+	Templates map[string][]NodeConfig `yaml:"templates,omitempty"` // nodes to create for each template instance
+	Include   []string                `yaml:"include,omitempty"`   // more config files, directories or globs, relative to this file
+	settings  map[string]string       // flag values from a versioned config document
+	defaults  NodeDefaults            // node defaults from a versioned config document
+	files     []string                // the files the config was read from
+}
+
+// ServerConfig describes a single OPC UA server.
+// Empty fields fall back to the corresponding command line flags.
+type ServerConfig struct {
+	Name      string             `yaml:"name"`               // Added to every metric from this server as the "server" label
+	Endpoint  string             `yaml:"endpoint,omitempty"` // OPC UA endpoint URL
+	Security  SecurityConfig     `yaml:"security,omitempty"`
+	Auth      AuthConfig         `yaml:"auth,omitempty"`
+	Nodes     []NodeConfig       `yaml:"nodes"`
+	Instances []TemplateInstance `yaml:"instances,omitempty"` // Templates to create more nodes from
+	Discover  []DiscoveryConfig  `yaml:"discover,omitempty"`  // Subtrees to browse for more nodes when first connected
+}
+
+// ModuleConfig describes a set of nodes to read from whichever server is the target of a /probe request.
+type ModuleConfig struct {
+	Security  SecurityConfig     `yaml:"security,omitempty"`
+	Auth      AuthConfig         `yaml:"auth,omitempty"`
+	Nodes     []NodeConfig       `yaml:"nodes"`
+	Instances []TemplateInstance `yaml:"instances,omitempty"` // Templates to create more nodes from
+	Discover  []DiscoveryConfig  `yaml:"discover,omitempty"`  // Subtrees to browse for more nodes on each probe
+}
+
+var serverNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.:-]+$`)
+
+// parseConfig reads a versioned config document, a config document with a list of servers,
+// or a bare list of nodes which is treated as a single unnamed server. Environment variables
+// and file: references in the values are expanded, the latter relative to the working directory.
+func parseConfig(config io.Reader) (*Config, error) {
+	content, err := ioutil.ReadAll(config)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfigContent(content, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Include) > 0 {
+		return nil, fmt.Errorf("include can only be used in a config file")
+	}
+	if err := cfg.complete(); err != nil {
+		return nil, err
+	}
+	cfg.logNodeCounts()
+	return cfg, nil
+}
+
+// Parse a config in any of the formats without expanding its templates or applying the node
+// defaults, so that it can be merged with the other files of the config first. Relative file:
+// references are read from dir, the config file's directory.
+func parseConfigContent(content []byte, dir string) (*Config, error) {
+	if problems := envProblems(content); len(problems) > 0 {
+		return nil, problemsError(problems)
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+
+	switch doc.(type) {
+	case []interface{}:
+		log.Print("Warning: a config file with just a list of nodes is deprecated; convert it with the migrate-config command")
+		nodes, err := parseConfigYAML(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		if err := expandEnv(nodes); err != nil {
+			return nil, err
+		}
+		return &Config{Servers: []ServerConfig{{Nodes: nodes}}}, nil
+	case map[interface{}]interface{}:
+		if _, ok := doc.(map[interface{}]interface{})["version"]; ok {
+			document, err := parseConfigDocument(content)
+			if err != nil {
+				return nil, err
+			}
+			if err := expandEnv(document); err != nil {
+				return nil, err
+			}
+			if err := document.resolveFileReferences(dir); err != nil {
+				return nil, err
+			}
+			return document.config()
+		}
+		var cfg Config
+		if err := yaml.Unmarshal(content, &cfg); err != nil {
+			return nil, err
+		}
+		if err := expandEnv(&cfg); err != nil {
+			return nil, err
+		}
+		if err := cfg.resolveFileReferences(dir); err != nil {
+			return nil, err
+		}
+		if err := cfg.validateServers(); err != nil {
+			return nil, err
+		}
+		return &cfg, nil
+	default:
+		return nil, fmt.Errorf("Config must be a list of nodes, or a document with a list of servers")
+	}
+}
+
+// Finish a config once all its files are read: create the nodes of the template instances,
+// apply the node defaults, and check that there is something to export
+func (c *Config) complete() error {
+	if len(c.Servers) == 0 && len(c.Modules) == 0 {
+		return fmt.Errorf("No servers or modules found in config")
+	}
+	if len(c.Servers) > 1 {
+		for i, server := range c.Servers {
+			if server.Name == "" {
+				return fmt.Errorf("Server %d has no name; with several servers, each needs one", i)
+			}
+		}
+	}
+	if err := c.expandTemplates(); err != nil {
+		return err
+	}
+	for i := range c.Servers {
+		c.Servers[i].Nodes = c.defaults.apply(c.Servers[i].Nodes)
+	}
+	for name, module := range c.Modules {
+		module.Nodes = c.defaults.apply(module.Nodes)
+		c.Modules[name] = module
+	}
+	return nil
+}
+
+func (c *Config) logNodeCounts() {
+	for _, server := range c.Servers {
+		log.Printf("Found %d nodes for server %s in config file.", len(server.Nodes), server.Name)
+	}
+}
+
+// Servers in a multi-server config need unique names to tell their metrics apart. A single
+// server doesn't need a name, but one that is given must be valid.
+func (c *Config) validateServers() error {
+	seen := make(map[string]bool)
+	for i, server := range c.Servers {
+		if server.Name == "" {
+			if len(c.Servers) > 1 {
+				return fmt.Errorf("Server %d has no name; with several servers, each needs one", i)
+			}
+			continue
+		}
+		if !serverNameRegex.MatchString(server.Name) {
+			return fmt.Errorf("Server %d has invalid name %q", i, server.Name)
+		}
+		if seen[server.Name] {
+			return fmt.Errorf("Duplicate server name %q", server.Name)
+		}
+		seen[server.Name] = true
+	}
+	return nil
+}
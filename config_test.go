@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLegacyConfig(t *testing.T) {
+	yaml := `
+- nodeName: ns=1;s=Voltmeter
+  metricName: circuit_input_volts
+- nodeName: ns=1;s=Ammeter
+  metricName: circuit_input_amps
+`
+	config, err := parseConfig(strings.NewReader(yaml))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(config.Servers))
+	assert.Equal(t, "", config.Servers[0].Name)
+	assert.Equal(t, "", config.Servers[0].Endpoint)
+	assert.Equal(t, 2, len(config.Servers[0].Nodes))
+}
+
+func TestParseServersConfig(t *testing.T) {
+	yaml := `
+servers:
+  - name: press1
+    endpoint: opc.tcp://plc1:4840
+    security:
+      policy: Basic256Sha256
+      mode: SignAndEncrypt
+      pkiDir: /var/lib/opcua_exporter/pki
+    auth:
+      mode: UserName
+      username: exporter
+      passwordFile: /run/secrets/plc1
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: press_temperature_celsius
+  - name: press2
+    endpoint: opc.tcp://plc2:4840
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: press_temperature_celsius
+      - nodeName: ns=1;s=Alarms
+        metricName: press_door_open
+        extractBit: 3
+`
+	config, err := parseConfig(strings.NewReader(yaml))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(config.Servers))
+
+	press1 := config.Servers[0]
+	assert.Equal(t, "press1", press1.Name)
+	assert.Equal(t, "opc.tcp://plc1:4840", press1.Endpoint)
+	assert.Equal(t, "Basic256Sha256", press1.Security.Policy)
+	assert.Equal(t, "/var/lib/opcua_exporter/pki", press1.Security.PKIDir)
+	assert.Equal(t, "exporter", press1.Auth.Username)
+	assert.Equal(t, 1, len(press1.Nodes))
+
+	press2 := config.Servers[1]
+	assert.Equal(t, SecurityConfig{}, press2.Security)
+	assert.Equal(t, 2, len(press2.Nodes))
+	assert.Equal(t, 3, press2.Nodes[1].ExtractBit)
+}
+
+func TestParseServersConfigErrors(t *testing.T) {
+	badConfigs := []string{
+		"just a string",
+		"servers: []",
+		"servers:\n  - endpoint: opc.tcp://plc1:4840\n  - name: press\n",             // no name with several servers
+		"servers:\n  - name: has space\n",                                            // bad name
+		"servers:\n  - name: press\n    nodes: []\n  - name: press\n    nodes: []\n", // duplicate
+	}
+	for _, c := range badConfigs {
+		_, err := parseConfig(strings.NewReader(c))
+		assert.Error(t, err, c)
+	}
+}
+
+func TestParseSingleUnnamedServer(t *testing.T) {
+	config, err := parseConfig(strings.NewReader("servers:\n  - endpoint: opc.tcp://plc1:4840\n    nodes:\n      - nodeName: ns=1;s=Temperature\n        metricName: temperature\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", config.Servers[0].Name)
+	assert.Equal(t, "opc.tcp://plc1:4840", config.Servers[0].Endpoint)
+}
+
+// Servers can export the same metric names, told apart by the server label
+func TestCreateMetricsForServers(t *testing.T) {
+	nodes := []NodeConfig{{NodeName: "ns=1;s=Speed", MetricName: "shared_pump_speed_rpm"}}
+	registry := prometheus.NewRegistry()
+	_, err := createMetrics(&nodes, prometheus.Labels{"server": "line1"}, registry)
+	assert.NoError(t, err)
+	_, err = createMetrics(&nodes, prometheus.Labels{"server": "line2"}, registry)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// DiscoveryConfig creates metrics for the Variables found by browsing the subtree below a root node,
+// so that a whole folder of tags doesn't need a NodeConfig each.
+//
+// Metric names come from the browse path below the root, e.g. Press/Temperature becomes press_temperature.
+// The first components of the path can be turned into labels instead: with pathLabels [line, machine],
+// Line1/Press/Temperature becomes temperature{line="Line1",machine="Press"}.
+type DiscoveryConfig struct {
+	Root         string            `yaml:"root"`                   // Node ID, or a browse path from the Root folder such as /Objects/Line1/Press. Defaults to the Objects folder.
+	MaxDepth     int               `yaml:"maxDepth,omitempty"`     // How many levels of Objects to browse below the root. 0 means no limit.
+	Include      []DiscoveryFilter `yaml:"include,omitempty"`      // Export only Variables matching one of these. Defaults to numeric and boolean Variables.
+	Exclude      []DiscoveryFilter `yaml:"exclude,omitempty"`      // Skip nodes matching any of these, and everything below them
+	MetricPrefix string            `yaml:"metricPrefix,omitempty"` // Prepended to every discovered metric name
+	PathLabels   []string          `yaml:"pathLabels,omitempty"`   // Label names for the first components of the browse path
+	Labels       map[string]string `yaml:"labels,omitempty"`       // Labels added to every discovered metric
+	Type         string            `yaml:"type,omitempty"`         // Metric type for every discovered metric, gauge by default
+	EUProperties bool              `yaml:"euProperties,omitempty"` // Read the engineering units of every discovered node
+}
+
+// DiscoveryFilter matches nodes by shell-style patterns, e.g. browseName: "Temp*".
+// Empty fields match anything; a node must match all the fields that are set.
+type DiscoveryFilter struct {
+	BrowseName string `yaml:"browseName,omitempty"`
+	NodeClass  string `yaml:"nodeClass,omitempty"` // Object or Variable
+	DataType   string `yaml:"dataType,omitempty"`  // Built-in type name such as Double, or the data type's node ID
+}
+
+// Names of the built-in data types, and common types derived from them
+var dataTypeNames = map[uint32]string{
+	id.Boolean:    "Boolean",
+	id.SByte:      "SByte",
+	id.Byte:       "Byte",
+	id.Int16:      "Int16",
+	id.UInt16:     "UInt16",
+	id.Int32:      "Int32",
+	id.UInt32:     "UInt32",
+	id.Int64:      "Int64",
+	id.UInt64:     "UInt64",
+	id.Float:      "Float",
+	id.Double:     "Double",
+	id.String:     "String",
+	id.DateTime:   "DateTime",
+	id.GUID:       "Guid",
+	id.ByteString: "ByteString",
+	id.Number:     "Number",
+	id.Integer:    "Integer",
+	id.UInteger:   "UInteger",
+	id.Duration:   "Duration",
+}
+
+// Without include filters, only Variables with a value we can export are discovered
+var defaultDiscoveryFilters = []DiscoveryFilter{
+	{DataType: "Boolean"}, {DataType: "SByte"}, {DataType: "Byte"}, {DataType: "Int16"}, {DataType: "UInt16"},
+	{DataType: "Int32"}, {DataType: "UInt32"}, {DataType: "Int64"}, {DataType: "UInt64"},
+	{DataType: "Float"}, {DataType: "Double"}, {DataType: "Number"}, {DataType: "Integer"},
+	{DataType: "UInteger"}, {DataType: "Duration"},
+}
+
+var camelCaseRegex = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+
+// A Variable found while browsing
+type discoveredNode struct {
+	NodeID   *ua.NodeID
+	Path     []string // browse names below the root
+	DataType string
+}
+
+// Validate checks the root, the patterns and that the path labels are usable label names
+func (d DiscoveryConfig) Validate() error {
+	if d.Root != "" {
+		if err := checkRootName(d.Root); err != nil {
+			return err
+		}
+	}
+	for _, filter := range append(append([]DiscoveryFilter{}, d.Include...), d.Exclude...) {
+		for _, pattern := range []string{filter.BrowseName, filter.NodeClass, filter.DataType} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("Invalid discovery pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	for _, name := range d.PathLabels {
+		if !labelNameRegex.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("Invalid path label name %q", name)
+		}
+		if _, ok := d.Labels[name]; ok {
+			return fmt.Errorf("Path label %q is also set in labels", name)
+		}
+	}
+	return nil
+}
+
+func (f DiscoveryFilter) matches(browseName string, nodeClass string, dataType string) bool {
+	return globMatch(f.BrowseName, browseName) && globMatch(f.NodeClass, nodeClass) && globMatch(f.DataType, dataType)
+}
+
+func globMatch(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+func matchesAny(filters []DiscoveryFilter, browseName string, nodeClass string, dataType string) bool {
+	for _, filter := range filters {
+		if filter.matches(browseName, nodeClass, dataType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Browse the server for each discovery config and return the node configs for what was found.
+// Nodes that would clash with the configured nodes, or with nodes discovered before them, are logged and left out.
+func discoverNodes(client *opcua.Client, discoveries []DiscoveryConfig, configured []NodeConfig) ([]NodeConfig, error) {
+	labelChecker := newNodeLabelChecker()
+	monitoring := make(map[string]NodeConfig)
+	for _, nodeConfig := range configured {
+		labelChecker.add(nodeConfig)
+		checkNodeMonitoring(nodeConfig, monitoring)
+	}
+
+	var nodeConfigs []NodeConfig
+	for _, discovery := range discoveries {
+		root, err := resolveDiscoveryRoot(client, discovery.Root)
+		if err != nil {
+			return nil, err
+		}
+		nodes, err := browseVariables(client, root, discovery)
+		if err != nil {
+			return nil, fmt.Errorf("Error browsing %s: %v", discovery.Root, err)
+		}
+		found := 0
+		for _, node := range nodes {
+			nodeConfig, ok := discovery.nodeConfig(node)
+			if !ok {
+				log.Printf("Skipping discovered node %s: path %s is too short for the path labels", node.NodeID, strings.Join(node.Path, "/"))
+				continue
+			}
+			if err := checkNodeMonitoring(nodeConfig, monitoring); err != nil {
+				log.Printf("Skipping discovered node %s: %v", node.NodeID, err)
+				continue
+			}
+			if err := labelChecker.add(nodeConfig); err != nil {
+				log.Printf("Skipping discovered node %s: %v", node.NodeID, err)
+				continue
+			}
+			nodeConfigs = append(nodeConfigs, nodeConfig)
+			found++
+		}
+		log.Printf("Discovered %d nodes below %s", found, root)
+	}
+	return nodeConfigs, nil
+}
+
+// Build the node config for a discovered Variable. Returns false if the path is too short
+// to fill in the path labels and still leave a metric name.
+func (d DiscoveryConfig) nodeConfig(node discoveredNode) (NodeConfig, bool) {
+	if len(node.Path) <= len(d.PathLabels) {
+		return NodeConfig{}, false
+	}
+	var labels map[string]string
+	if len(d.Labels) > 0 || len(d.PathLabels) > 0 {
+		labels = make(map[string]string)
+		for name, value := range d.Labels {
+			labels[name] = value
+		}
+		for i, name := range d.PathLabels {
+			labels[name] = node.Path[i]
+		}
+	}
+	metricName := metricNameFromPath(node.Path[len(d.PathLabels):])
+	if d.MetricPrefix != "" {
+		metricName = d.MetricPrefix + "_" + metricName
+	}
+	return NodeConfig{
+		NodeName:     node.NodeID.String(),
+		MetricName:   metricName,
+		Labels:       labels,
+		Type:         d.Type,
+		EUProperties: d.EUProperties,
+	}, true
+}
+
+// Turn browse names into a snake case metric name, e.g. [Press, MotorSpeed] becomes press_motor_speed
+func metricNameFromPath(names []string) string {
+	var parts []string
+	for _, name := range names {
+		name = camelCaseRegex.ReplaceAllString(name, "${1}_${2}")
+		name = strings.Trim(nonMetricCharsRegex.ReplaceAllString(name, "_"), "_")
+		if name != "" {
+			parts = append(parts, strings.ToLower(name))
+		}
+	}
+	metricName := strings.Join(parts, "_")
+	if metricName == "" || (metricName[0] >= '0' && metricName[0] <= '9') {
+		metricName = "_" + metricName
+	}
+	return metricName
+}
+
+// The root is a node name as for a configured node: a node ID, or a browse path from the Root folder
+// such as /Objects/Line1, resolved the same way
+func resolveDiscoveryRoot(client *opcua.Client, root string) (*ua.NodeID, error) {
+	if root == "" {
+		return ua.NewNumericNodeID(0, id.ObjectsFolder), nil
+	}
+	if err := checkRootName(root); err != nil {
+		return nil, err
+	}
+	if !isSymbolicNodeName(root) {
+		return parseNodeID(root)
+	}
+	resolved, err := resolveNodeNames(client, []string{root})
+	if err != nil {
+		return nil, err
+	}
+	nodeID, ok := resolved[root]
+	if !ok {
+		return nil, fmt.Errorf("Root %s not found", root)
+	}
+	return nodeID, nil
+}
+
+// Check that a root is a valid node name. A browse path has to start with Objects, Types or Views,
+// which catches paths written from the Objects folder, such as /Line1.
+func checkRootName(root string) error {
+	if _, err := canonicalNodeName(root); err != nil {
+		return fmt.Errorf("Invalid root %s: %v", root, err)
+	}
+	if path, err := parseBrowsePath(root); err == nil && !rootFolderNames[path.Names[0].Name] {
+		return fmt.Errorf("Invalid root %s: browse paths start from the Root folder, e.g. /Objects/%s", root, path.Names[0].Name)
+	}
+	return nil
+}
+
+// Follow the browse names down from the start node, whatever namespace they are in
+func browseByName(client *opcua.Client, start *ua.NodeID, names []string) (*ua.NodeID, error) {
+	nodeID := start
+	for _, name := range names {
+		refs, err := client.Node(nodeID).References(id.HierarchicalReferences, ua.BrowseDirectionForward, ua.NodeClassAll, true)
+		if err != nil {
+			return nil, err
+		}
+		var next *ua.NodeID
+		for _, ref := range refs {
+			if ref.BrowseName != nil && ref.BrowseName.Name == name {
+				next = ref.NodeID.NodeID
+				break
+			}
+		}
+		if next == nil {
+			return nil, fmt.Errorf("no %s below %s", name, nodeID)
+		}
+		nodeID = next
+	}
+	return nodeID, nil
+}
+
+// Walk the Objects below the root and collect the Variables that pass the filters
+func browseVariables(client *opcua.Client, root *ua.NodeID, discovery DiscoveryConfig) ([]discoveredNode, error) {
+	include := discovery.Include
+	if len(include) == 0 {
+		include = defaultDiscoveryFilters
+	}
+
+	var candidates []discoveredNode
+	visited := map[string]bool{root.String(): true}
+	var browse func(nodeID *ua.NodeID, browsePath []string) error
+	browse = func(nodeID *ua.NodeID, browsePath []string) error {
+		refs, err := client.Node(nodeID).References(id.HierarchicalReferences, ua.BrowseDirectionForward, ua.NodeClassObject|ua.NodeClassVariable, true)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if ref.BrowseName == nil || ref.NodeID == nil || ref.NodeID.NodeID == nil {
+				continue
+			}
+			if ref.ReferenceTypeID != nil && ref.ReferenceTypeID.IntID() == id.HasProperty {
+				continue // properties describe their parent rather than being tags themselves
+			}
+			childID := ref.NodeID.NodeID
+			if visited[childID.String()] {
+				continue
+			}
+			visited[childID.String()] = true
+
+			name := ref.BrowseName.Name
+			childPath := append(append([]string{}, browsePath...), name)
+			switch ref.NodeClass {
+			case ua.NodeClassObject:
+				if matchesAny(discovery.Exclude, name, "Object", "") {
+					continue
+				}
+				if discovery.MaxDepth == 0 || len(childPath) < discovery.MaxDepth {
+					if err := browse(childID, childPath); err != nil {
+						return err
+					}
+				}
+			case ua.NodeClassVariable:
+				candidates = append(candidates, discoveredNode{NodeID: childID, Path: childPath})
+			}
+		}
+		return nil
+	}
+	if err := browse(root, nil); err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	if err := readDataTypes(client, candidates); err != nil {
+		return nil, err
+	}
+	var nodes []discoveredNode
+	for _, node := range candidates {
+		name := node.Path[len(node.Path)-1]
+		if matchesAny(include, name, "Variable", node.DataType) && !matchesAny(discovery.Exclude, name, "Variable", node.DataType) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+// Fill in the data type names of the nodes
+func readDataTypes(client *opcua.Client, nodes []discoveredNode) error {
+	var nodesToRead []*ua.ReadValueID
+	for _, node := range nodes {
+		nodesToRead = append(nodesToRead, &ua.ReadValueID{NodeID: node.NodeID, AttributeID: ua.AttributeIDDataType})
+	}
+	results, err := readChunked(client, nodesToRead, ua.TimestampsToReturnNeither)
+	if err != nil {
+		return err
+	}
+	for i, result := range results {
+		if result.Status != ua.StatusOK || result.Value == nil {
+			continue
+		}
+		if dataType, ok := result.Value.Value().(*ua.NodeID); ok {
+			nodes[i].DataType = dataTypeName(dataType)
+		}
+	}
+	return nil
+}
+
+// Name a built-in data type, or fall back to the node ID for other types
+func dataTypeName(dataType *ua.NodeID) string {
+	if dataType.Namespace() == 0 {
+		if name, ok := dataTypeNames[dataType.IntID()]; ok {
+			return name
+		}
+	}
+	return dataType.String()
+}
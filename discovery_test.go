@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMetricNameFromPath(t *testing.T) {
+	testCases := map[string][]string{
+		"temperature":               {"Temperature"},
+		"press_motor_speed":         {"Press", "MotorSpeed"},
+		"oven_2_zone_1_temp":        {"Oven 2", "Zone-1 Temp"},
+		"_1st_stage_pressure":       {"1stStage", "Pressure"},
+		"line1_pump_speed_setpoint": {"Line1", "PUMP_SPEED", "Setpoint"},
+	}
+	for expected, path := range testCases {
+		assert.Equal(t, expected, metricNameFromPath(path), "%v", path)
+	}
+}
+
+func TestDiscoveryFilter(t *testing.T) {
+	filter := DiscoveryFilter{BrowseName: "Temp*", DataType: "Double"}
+	assert.True(t, filter.matches("Temperature", "Variable", "Double"))
+	assert.False(t, filter.matches("Temperature", "Variable", "Int32"))
+	assert.False(t, filter.matches("Pressure", "Variable", "Double"))
+
+	filters := []DiscoveryFilter{{NodeClass: "Object", BrowseName: "Diagnostics"}, {DataType: "String"}}
+	assert.True(t, matchesAny(filters, "Diagnostics", "Object", ""))
+	assert.True(t, matchesAny(filters, "SerialNumber", "Variable", "String"))
+	assert.False(t, matchesAny(filters, "Diagnostics", "Variable", "Int32"))
+	assert.True(t, matchesAny(defaultDiscoveryFilters, "Speed", "Variable", "Float"))
+	assert.False(t, matchesAny(defaultDiscoveryFilters, "Name", "Variable", "String"))
+}
+
+func TestDiscoveryNodeConfig(t *testing.T) {
+	discovery := DiscoveryConfig{
+		MetricPrefix: "plant",
+		PathLabels:   []string{"line", "machine"},
+		Labels:       map[string]string{"site": "boston"},
+		Type:         "counter",
+	}
+	node := discoveredNode{
+		NodeID: ua.NewStringNodeID(2, "Line1.Press.PartCount"),
+		Path:   []string{"Line1", "Press", "PartCount"},
+	}
+	nodeConfig, ok := discovery.nodeConfig(node)
+	assert.True(t, ok)
+	assert.Equal(t, NodeConfig{
+		NodeName:   "ns=2;s=Line1.Press.PartCount",
+		MetricName: "plant_part_count",
+		Labels:     map[string]string{"site": "boston", "line": "Line1", "machine": "Press"},
+		Type:       "counter",
+	}, nodeConfig)
+
+	// not enough path left for a metric name
+	_, ok = discovery.nodeConfig(discoveredNode{NodeID: node.NodeID, Path: []string{"Line1", "Status"}})
+	assert.False(t, ok)
+}
+
+func TestDiscoveryConfigValidate(t *testing.T) {
+	assert.NoError(t, DiscoveryConfig{PathLabels: []string{"line"}, Include: []DiscoveryFilter{{BrowseName: "Temp*"}}}.Validate())
+	assert.Error(t, DiscoveryConfig{Include: []DiscoveryFilter{{BrowseName: "Temp["}}}.Validate())
+	assert.Error(t, DiscoveryConfig{PathLabels: []string{"line-name"}}.Validate())
+	assert.Error(t, DiscoveryConfig{PathLabels: []string{"line"}, Labels: map[string]string{"line": "1"}}.Validate())
+	assert.NoError(t, DiscoveryConfig{Root: "/Objects/2:Line1"}.Validate())
+	assert.NoError(t, DiscoveryConfig{Root: "nsu=urn:line1;s=Line1"}.Validate())
+	assert.Error(t, DiscoveryConfig{Root: "/Line1"}.Validate())
+	assert.Error(t, DiscoveryConfig{Root: "ns=x;s=Line1"}.Validate())
+}
+
+func TestParseDiscoveryConfig(t *testing.T) {
+	content := `
+root: /Objects/Line1
+maxDepth: 3
+include:
+- browseName: "*Temp*"
+  dataType: Double
+exclude:
+- nodeClass: Object
+  browseName: Diagnostics
+pathLabels: [machine]
+`
+	var discovery DiscoveryConfig
+	assert.NoError(t, yaml.UnmarshalStrict([]byte(content), &discovery))
+	assert.Equal(t, DiscoveryConfig{
+		Root:       "/Objects/Line1",
+		MaxDepth:   3,
+		Include:    []DiscoveryFilter{{BrowseName: "*Temp*", DataType: "Double"}},
+		Exclude:    []DiscoveryFilter{{NodeClass: "Object", BrowseName: "Diagnostics"}},
+		PathLabels: []string{"machine"},
+	}, discovery)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Prefix of a config value to be replaced with the content of a file, e.g. file:/run/secrets/plc1
+const fileReferencePrefix = "file:"
+
+var envReferenceRegex = regexp.MustCompile(`\$\$|\$\{([^}]*)\}`)
+var envNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Replace ${VAR} in a string with the value of the environment variable, or ${VAR:-default} with
+// the default if it's not set. $$ is a literal $. Every variable that isn't set and has no default
+// is a problem.
+func expandEnvString(s string) (string, []string) {
+	var problems []string
+	expanded := envReferenceRegex.ReplaceAllStringFunc(s, func(reference string) string {
+		if reference == "$$" {
+			return "$"
+		}
+		name := reference[2 : len(reference)-1]
+		defaultValue, hasDefault := "", false
+		if j := strings.Index(name, ":-"); j >= 0 {
+			name, defaultValue, hasDefault = name[:j], name[j+2:], true
+		}
+		if !envNameRegex.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("Invalid environment variable reference %s", reference))
+			return reference
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			if !hasDefault {
+				problems = append(problems, fmt.Sprintf("Environment variable %s is not set", name))
+			}
+			return defaultValue
+		}
+		return value
+	})
+	return expanded, problems
+}
+
+// The problems with the environment variable references of a config, each with its line, so they
+// can be reported before it is parsed. Comment lines are left alone.
+func envProblems(content []byte) []configProblem {
+	var problems []configProblem
+	for i, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		_, messages := expandEnvString(line)
+		for _, message := range messages {
+			problems = append(problems, configProblem{i + 1, message})
+		}
+	}
+	return problems
+}
+
+// Expand the environment variable references in every string of a parsed config. Expanding after
+// parsing means a value can't change the structure of the YAML. The value points to a struct,
+// slice or map.
+func expandEnv(value interface{}) error {
+	var problems []string
+	expandEnvIn(reflect.ValueOf(value), &problems)
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func expandEnvIn(v reflect.Value, problems *[]string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			expandEnvIn(v.Elem(), problems)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" { // exported
+				expandEnvIn(v.Field(i), problems)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandEnvIn(v.Index(i), problems)
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			// Map values can't be changed in place, so change a copy and put it back
+			element := reflect.New(v.Type().Elem()).Elem()
+			element.Set(v.MapIndex(key))
+			expandEnvIn(element, problems)
+			v.SetMapIndex(key, element)
+		}
+	case reflect.String:
+		expanded, messages := expandEnvString(v.String())
+		v.SetString(expanded)
+		*problems = append(*problems, messages...)
+	}
+}
+
+// An error listing the problems, each with its line
+func problemsError(problems []configProblem) error {
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, fmt.Sprintf("line %d: %s", problem.Line, problem.Message))
+	}
+	return fmt.Errorf("%s", strings.Join(messages, "; "))
+}
+
+// A file: reference's path, relative to dir, the directory of the config file
+func fileReferencePath(value string, dir string) string {
+	path := strings.TrimPrefix(value, fileReferencePrefix)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return path
+}
+
+// Replace a value that starts with file: with the content of the file, without a trailing newline
+func resolveFileReference(value *string, dir string) error {
+	if !strings.HasPrefix(*value, fileReferencePrefix) {
+		return nil
+	}
+	path := fileReferencePath(*value, dir)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading %s%s: %v", fileReferencePrefix, path, err)
+	}
+	*value = strings.TrimRight(string(content), "\r\n")
+	return nil
+}
+
+// Replace a path that starts with file: with the path it refers to, relative to the config file
+func resolveFilePath(value *string, dir string) {
+	if strings.HasPrefix(*value, fileReferencePrefix) {
+		*value = fileReferencePath(*value, dir)
+	}
+}
+
+// Resolve the file: references of the credentials and the user certificate
+func (a *AuthConfig) resolveFileReferences(dir string) error {
+	if err := resolveFileReference(&a.Username, dir); err != nil {
+		return err
+	}
+	if err := resolveFileReference(&a.Password, dir); err != nil {
+		return err
+	}
+	resolveFilePath(&a.CertFile, dir)
+	return nil
+}
+
+// Resolve the file: references of the client certificate and key
+func (s *SecurityConfig) resolveFileReferences(dir string) {
+	resolveFilePath(&s.CertFile, dir)
+	resolveFilePath(&s.KeyFile, dir)
+}
+
+// Resolve the file: references of the endpoint, credentials and certificates of the servers and modules
+func (c *Config) resolveFileReferences(dir string) error {
+	for i := range c.Servers {
+		server := &c.Servers[i]
+		if err := resolveFileReference(&server.Endpoint, dir); err != nil {
+			return err
+		}
+		server.Security.resolveFileReferences(dir)
+		if err := server.Auth.resolveFileReferences(dir); err != nil {
+			return err
+		}
+	}
+	for name, module := range c.Modules {
+		module.Security.resolveFileReferences(dir)
+		if err := module.Auth.resolveFileReferences(dir); err != nil {
+			return err
+		}
+		c.Modules[name] = module
+	}
+	return nil
+}
+
+// Resolve the file: references of the document's server settings, servers and modules
+func (d *ConfigDocument) resolveFileReferences(dir string) error {
+	if err := resolveFileReference(&d.Server.Endpoint, dir); err != nil {
+		return err
+	}
+	d.Server.Security.resolveFileReferences(dir)
+	if err := d.Server.Auth.resolveFileReferences(dir); err != nil {
+		return err
+	}
+	servers := Config{Servers: d.Servers, Modules: d.Modules}
+	return servers.resolveFileReferences(dir)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("OPCUA_TEST_HOST", "plc1")
+	defer os.Unsetenv("OPCUA_TEST_HOST")
+
+	value, problems := expandEnvString("opc.tcp://${OPCUA_TEST_HOST}:${OPCUA_TEST_PORT:-4840} costs $$5")
+	assert.Equal(t, "opc.tcp://plc1:4840 costs $5", value)
+	assert.Empty(t, problems)
+	value, problems = expandEnvString("${OPCUA_TEST_UNSET} ${not a name}")
+	assert.Equal(t, " ${not a name}", value)
+	assert.Equal(t, []string{"Environment variable OPCUA_TEST_UNSET is not set", "Invalid environment variable reference ${not a name}"}, problems)
+
+	assert.Equal(t, []configProblem{
+		{4, "Environment variable OPCUA_TEST_UNSET is not set"},
+		{5, "Invalid environment variable reference ${not a name}"},
+	}, envProblems([]byte(`# ${NOT_EXPANDED_IN_COMMENTS}
+endpoint: opc.tcp://${OPCUA_TEST_HOST}:${OPCUA_TEST_PORT:-4840}
+price: $$5
+username: ${OPCUA_TEST_UNSET}
+password: ${not a name}
+`)))
+	assert.EqualError(t, problemsError([]configProblem{{4, "Environment variable OPCUA_TEST_UNSET is not set"}}), "line 4: Environment variable OPCUA_TEST_UNSET is not set")
+}
+
+func TestExpandEnvKeepsStructure(t *testing.T) {
+	// Values that would change the YAML if they were substituted into it
+	os.Setenv("OPCUA_TEST_PASSWORD", "pa#ss: word")
+	defer os.Unsetenv("OPCUA_TEST_PASSWORD")
+	os.Setenv("OPCUA_TEST_LINE", "Line 1\nmetricName: injected")
+	defer os.Unsetenv("OPCUA_TEST_LINE")
+	os.Setenv("OPCUA_TEST_USER", "exporter\n      mode: Anonymous")
+	defer os.Unsetenv("OPCUA_TEST_USER")
+
+	config, err := parseConfig(strings.NewReader(`
+servers:
+  - name: press
+    endpoint: opc.tcp://plc1:4840
+    auth:
+      mode: UserName
+      username: ${OPCUA_TEST_USER}
+      password: ${OPCUA_TEST_PASSWORD}
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: temperature
+        labels:
+          line: ${OPCUA_TEST_LINE}
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "pa#ss: word", config.Servers[0].Auth.Password)
+	assert.Equal(t, "exporter\n      mode: Anonymous", config.Servers[0].Auth.Username)
+	assert.Equal(t, "UserName", config.Servers[0].Auth.Mode)
+	assert.Equal(t, "temperature", config.Servers[0].Nodes[0].MetricName)
+	assert.Equal(t, map[string]string{"line": "Line 1\nmetricName: injected"}, config.Servers[0].Nodes[0].Labels)
+}
+
+func TestParseConfigWithReferences(t *testing.T) {
+	f, err := ioutil.TempFile("", "opcua_password")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("s3cret\n")
+	f.Close()
+	os.Setenv("OPCUA_TEST_HOST", "plc1")
+	defer os.Unsetenv("OPCUA_TEST_HOST")
+
+	config, err := parseConfig(strings.NewReader(`
+servers:
+  - name: press
+    endpoint: opc.tcp://${OPCUA_TEST_HOST}:4840
+    auth:
+      mode: UserName
+      username: exporter
+      password: file:` + f.Name() + `
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: temperature
+        labels:
+          host: ${OPCUA_TEST_HOST}
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "opc.tcp://plc1:4840", config.Servers[0].Endpoint)
+	assert.Equal(t, "s3cret", config.Servers[0].Auth.Password)
+	assert.Equal(t, map[string]string{"host": "plc1"}, config.Servers[0].Nodes[0].Labels)
+
+	config, err = parseConfig(strings.NewReader(`
+version: 1
+server:
+  endpoint: opc.tcp://${OPCUA_TEST_HOST}:4840
+  auth:
+    password: file:` + f.Name() + `
+nodes: []
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "opc.tcp://plc1:4840", config.settings["endpoint"])
+	assert.Equal(t, "s3cret", config.Servers[0].Auth.Password)
+	server := config.Servers[0]
+	applyFlagDefaults(&server)
+	assert.Equal(t, "s3cret", server.Auth.Password)
+	assert.Equal(t, *authMode, server.Auth.Mode)
+
+	_, err = parseConfig(strings.NewReader("servers:\n  - name: press\n    endpoint: ${OPCUA_TEST_UNSET}\n"))
+	assert.EqualError(t, err, "line 3: Environment variable OPCUA_TEST_UNSET is not set")
+	_, err = parseConfig(strings.NewReader("servers:\n  - name: press\n    endpoint: file:/no/such/file\n"))
+	assert.Error(t, err)
+}
+
+func TestValidateConfigEnv(t *testing.T) {
+	problems := validateConfig([]byte(`
+- nodeName: ns=1;s=${OPCUA_TEST_UNSET}
+  metricName: temperature
+`), prometheus.NewRegistry())
+	assert.Len(t, problems, 2, "%v", problems)
+	assert.Equal(t, configProblem{2, "Environment variable OPCUA_TEST_UNSET is not set"}, problems[0])
+}
+
+func TestFileReferencesRelativeToConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opcua_config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "password"), []byte("s3cret\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.yaml"), []byte(`
+servers:
+  - name: press
+    endpoint: opc.tcp://plc1:4840
+    security:
+      cert: file:certs/client.pem
+      key: certs/client.key
+    auth:
+      mode: UserName
+      username: exporter
+      password: file:password
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: temperature
+        help: "file:password"
+        labels:
+          source: file:password
+`), 0644))
+
+	config, err := readConfigFile(filepath.Join(dir, "config.yaml"))
+	assert.NoError(t, err)
+	server := config.Servers[0]
+	assert.Equal(t, "s3cret", server.Auth.Password)
+	assert.Equal(t, filepath.Join(dir, "certs/client.pem"), server.Security.CertFile)
+	assert.Equal(t, "certs/client.key", server.Security.KeyFile)
+	assert.Equal(t, "file:password", server.Nodes[0].Help)
+	assert.Equal(t, map[string]string{"source": "file:password"}, server.Nodes[0].Labels)
+}
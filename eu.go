@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// EUProperties holds the properties an AnalogItemType node advertises about its value
+type EUProperties struct {
+	Description      string
+	EURange          *ua.Range
+	InstrumentRange  *ua.Range
+	EngineeringUnits *ua.EUInformation
+}
+
+// Prometheus base unit suffixes for common UNECE unit codes, which OPC UA uses for EngineeringUnits
+var uneceUnitSuffixes = map[string]string{
+	"CEL": "celsius",
+	"FAH": "fahrenheit",
+	"KEL": "kelvin",
+	"PAL": "pascals",
+	"KPA": "kilopascals",
+	"BAR": "bar",
+	"MBR": "millibar",
+	"MTR": "meters",
+	"MMT": "millimeters",
+	"SEC": "seconds",
+	"C26": "milliseconds",
+	"MIN": "minutes",
+	"HUR": "hours",
+	"P1":  "percent",
+	"VLT": "volts",
+	"AMP": "amperes",
+	"4K":  "milliamperes",
+	"WTT": "watts",
+	"KWT": "kilowatts",
+	"KWH": "kilowatt_hours",
+	"HTZ": "hertz",
+	"RPM": "rpm",
+	"LTR": "liters",
+	"KGM": "kilograms",
+	"NEU": "newtons",
+	"NU":  "newton_meters",
+}
+
+var nonMetricCharsRegex = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// Read the node's description and EU properties from the server.
+// Missing properties are left nil; only communication errors are returned.
+func readEUProperties(client *opcua.Client, nodeID *ua.NodeID) (*EUProperties, error) {
+	node := client.Node(nodeID)
+	props := &EUProperties{}
+
+	description, err := node.Description()
+	if err == nil && description != nil {
+		props.Description = description.Text
+	}
+
+	refs, err := node.References(id.HasProperty, ua.BrowseDirectionForward, ua.NodeClassVariable, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if ref.BrowseName == nil {
+			continue
+		}
+		name := ref.BrowseName.Name
+		if name != "EURange" && name != "InstrumentRange" && name != "EngineeringUnits" {
+			continue
+		}
+		value, err := client.Node(ref.NodeID.NodeID).Value()
+		if err != nil {
+			return nil, err
+		}
+		eo, ok := value.Value().(*ua.ExtensionObject)
+		if !ok || eo == nil {
+			continue
+		}
+		switch v := eo.Value.(type) {
+		case *ua.Range:
+			if name == "EURange" {
+				props.EURange = v
+			} else if name == "InstrumentRange" {
+				props.InstrumentRange = v
+			}
+		case *ua.EUInformation:
+			props.EngineeringUnits = v
+		}
+	}
+	return props, nil
+}
+
+// Create the handlers that were waiting for their node's EU properties.
+// Called after each connect; nodes that were already set up are left alone. A node whose
+// properties can't be read, or whose metric can't be created from them, is logged and left
+// without a handler until the next connect; the others carry on. Returns the failed metrics
+// by the node name of their status.
+func resolveEngineeringUnits(client *opcua.Client, handlerMap HandlerMap) map[string][]string {
+	failed := make(map[string][]string)
+	for nodeName, records := range handlerMap {
+		for i, record := range records {
+			if record.handler != nil {
+				continue
+			}
+			handler, metricNames, err := createEUHandler(client, nodeName, record)
+			if err != nil {
+				log.Printf("Error creating metric %s for node %s from its engineering units: %v", prefixedMetricName(record.config.MetricName), nodeName, err)
+				failed[statusNodeName(record.config)] = append(failed[statusNodeName(record.config)], record.config.MetricName)
+				continue
+			}
+			records[i].handler = handler
+			records[i].metricNames = metricNames
+		}
+	}
+	return failed
+}
+
+// Read a node's EU properties and create its handler and metrics from them
+func createEUHandler(client *opcua.Client, nodeName string, record handlerMapRecord) (MsgHandler, []string, error) {
+	nodeID, err := ua.ParseNodeID(nodeName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid node ID %s: %v", nodeName, err)
+	}
+	props, err := readEUProperties(client, nodeID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nodeConfig := props.apply(record.config)
+	handler, err := createHandler(nodeConfig, record.factory)
+	if err != nil {
+		return nil, nil, err
+	}
+	metricName := prefixedMetricName(nodeConfig.MetricName)
+	metricNames := []string{metricName}
+	if props.EURange != nil {
+		if nodeConfig.EURangeMetrics {
+			if err := createEURangeMetrics(nodeConfig, props.EURange, record.factory); err != nil {
+				for _, name := range []string{metricName, metricName + "_eu_low", metricName + "_eu_high"} {
+					record.factory.Remove(name, nodeConfig.Labels)
+				}
+				return nil, nil, err
+			}
+			metricNames = append(metricNames, metricName+"_eu_low", metricName+"_eu_high")
+		}
+		handler = RangeCheckHandler{handler, *props.EURange, record.factory.ConstLabels["server"], nodeConfig.MetricName}
+	}
+	log.Printf("Created prom metric %s for OPC UA node %s", seriesName(nodeConfig.MetricName, nodeConfig.Labels), nodeName)
+	return handler, metricNames, nil
+}
+
+func createEURangeMetrics(nodeConfig NodeConfig, euRange *ua.Range, factory *MetricFactory) error {
+	metricName := prefixedMetricName(nodeConfig.MetricName)
+	low, err := factory.Gauge(metricName+"_eu_low", "Low end of the EURange of "+metricName, nodeConfig.Labels)
+	if err != nil {
+		return err
+	}
+	high, err := factory.Gauge(metricName+"_eu_high", "High end of the EURange of "+metricName, nodeConfig.Labels)
+	if err != nil {
+		return err
+	}
+	low.Set(euRange.Low)
+	high.Set(euRange.High)
+	return nil
+}
+
+// Fill in the help text and unit suffix of a node config from its EU properties.
+// Help text set in the config is kept.
+func (p *EUProperties) apply(nodeConfig NodeConfig) NodeConfig {
+	suffix := unitSuffix(p.EngineeringUnits)
+	if suffix != "" && !strings.HasSuffix(nodeConfig.MetricName, "_"+suffix) {
+		nodeConfig.MetricName = nodeConfig.MetricName + "_" + suffix
+	}
+
+	if nodeConfig.Help == "" {
+		help := p.Description
+		if help == "" {
+			help = "From OPC UA"
+		}
+		if p.EngineeringUnits != nil && p.EngineeringUnits.DisplayName != nil && p.EngineeringUnits.DisplayName.Text != "" {
+			help += fmt.Sprintf(" [%s]", p.EngineeringUnits.DisplayName.Text)
+		}
+		if p.EURange != nil {
+			help += fmt.Sprintf(" EURange %v to %v.", p.EURange.Low, p.EURange.High)
+		}
+		if p.InstrumentRange != nil {
+			help += fmt.Sprintf(" InstrumentRange %v to %v.", p.InstrumentRange.Low, p.InstrumentRange.High)
+		}
+		nodeConfig.Help = help
+	}
+	return nodeConfig
+}
+
+// Work out the Prometheus unit suffix for the engineering units. UnitID holds the
+// UNECE common code packed into an integer; for other units, fall back to the display name.
+func unitSuffix(eu *ua.EUInformation) string {
+	if eu == nil {
+		return ""
+	}
+	if suffix, ok := uneceUnitSuffixes[uneceCode(eu.UnitID)]; ok {
+		return suffix
+	}
+	if eu.DisplayName == nil {
+		return ""
+	}
+	return strings.Trim(strings.ToLower(nonMetricCharsRegex.ReplaceAllString(eu.DisplayName.Text, "_")), "_")
+}
+
+// Unpack a UNECE common code, e.g. 4408652 (0x43454C) is "CEL"
+func uneceCode(unitID int32) string {
+	var code []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if c := byte(unitID >> uint(shift)); c != 0 {
+			code = append(code, c)
+		}
+	}
+	return string(code)
+}
+
+// RangeCheckHandler counts values outside the node's EURange, then passes them on unchanged.
+type RangeCheckHandler struct {
+	handler    MsgHandler
+	euRange    ua.Range
+	server     string
+	metricName string
+}
+
+// Handle checks the value against the range and hands it to the wrapped handler
+func (h RangeCheckHandler) Handle(v ua.Variant) error {
+	floatVal, err := variantToFloat(v)
+	if err == nil && (floatVal < h.euRange.Low || floatVal > h.euRange.High) {
+		outOfRangeCounter.WithLabelValues(h.server, h.metricName).Inc()
+		if *debug {
+			log.Printf("Value %v of %s is outside its EURange %v to %v", floatVal, h.metricName, h.euRange.Low, h.euRange.High)
+		}
+	}
+	return h.handler.Handle(v)
+}
+
+// FloatValue returns the value computed by the wrapped handler
+func (h RangeCheckHandler) FloatValue(v ua.Variant) (float64, error) {
+	return h.handler.FloatValue(v)
+}
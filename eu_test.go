@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitSuffix(t *testing.T) {
+	testCases := map[string]*ua.EUInformation{
+		"":            nil,
+		"celsius":     {UnitID: 0x43454C, DisplayName: &ua.LocalizedText{Text: "°C"}},
+		"percent":     {UnitID: 0x5031, DisplayName: &ua.LocalizedText{Text: "%"}},
+		"pascals":     {UnitID: 0x50414C},
+		"strokes_min": {UnitID: -1, DisplayName: &ua.LocalizedText{Text: "Strokes/min"}},
+	}
+	for expected, eu := range testCases {
+		assert.Equal(t, expected, unitSuffix(eu), "%+v", eu)
+	}
+}
+
+func TestEUPropertiesApply(t *testing.T) {
+	props := EUProperties{
+		Description:      "Oven temperature",
+		EURange:          &ua.Range{Low: 0, High: 250},
+		EngineeringUnits: &ua.EUInformation{UnitID: 0x43454C, DisplayName: &ua.LocalizedText{Text: "°C"}},
+	}
+
+	nodeConfig := props.apply(NodeConfig{NodeName: "ns=2;s=Oven.Temp", MetricName: "oven_temperature"})
+	assert.Equal(t, "oven_temperature_celsius", nodeConfig.MetricName)
+	assert.Equal(t, "Oven temperature [°C] EURange 0 to 250.", nodeConfig.Help)
+
+	// an existing suffix and configured help text are kept
+	nodeConfig = props.apply(NodeConfig{MetricName: "oven_temperature_celsius", Help: "Oven 1"})
+	assert.Equal(t, "oven_temperature_celsius", nodeConfig.MetricName)
+	assert.Equal(t, "Oven 1", nodeConfig.Help)
+
+	// without any properties the config is unchanged apart from the default help
+	nodeConfig = (&EUProperties{}).apply(NodeConfig{MetricName: "oven_temperature"})
+	assert.Equal(t, "oven_temperature", nodeConfig.MetricName)
+	assert.Equal(t, "From OPC UA", nodeConfig.Help)
+}
+
+func TestRangeCheckHandler(t *testing.T) {
+	g := prom.NewGauge(prom.GaugeOpts{Name: "tank_level_percent"})
+	handler := RangeCheckHandler{OpcValueHandler{g}, ua.Range{Low: 0, High: 100}, "plant1", "tank_level_percent"}
+	before := testutil.ToFloat64(outOfRangeCounter.WithLabelValues("plant1", "tank_level_percent"))
+
+	assert.NoError(t, handler.Handle(*ua.MustVariant(42.0)))
+	assert.Equal(t, before, testutil.ToFloat64(outOfRangeCounter.WithLabelValues("plant1", "tank_level_percent")))
+	assert.Equal(t, 42.0, testutil.ToFloat64(g))
+
+	// values outside the range are counted but still exported
+	assert.NoError(t, handler.Handle(*ua.MustVariant(104.5)))
+	assert.Equal(t, before+1, testutil.ToFloat64(outOfRangeCounter.WithLabelValues("plant1", "tank_level_percent")))
+	assert.Equal(t, 104.5, testutil.ToFloat64(g))
+}
+
+func TestCreateEURangeMetrics(t *testing.T) {
+	registry := prom.NewRegistry()
+	factory := NewMetricFactory(nil, registry)
+	nodeConfig := NodeConfig{MetricName: "tank_level_percent", Labels: map[string]string{"tank": "1"}}
+	assert.NoError(t, createEURangeMetrics(nodeConfig, &ua.Range{Low: 0, High: 100}, factory))
+
+	metricFamilies, err := registry.Gather()
+	assert.NoError(t, err)
+	var names []string
+	for _, mf := range metricFamilies {
+		names = append(names, mf.GetName())
+	}
+	assert.Equal(t, []string{"tank_level_percent_eu_high", "tank_level_percent_eu_low"}, names)
+}
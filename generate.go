@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A node config written by one of the config generators, with comments for whoever reviews it
+type generatedNode struct {
+	Config   NodeConfig
+	Comments []string
+}
+
+// Unsigned integers named like these are often alarm or status words, with one bit per condition
+var bitVectorNameRegex = regexp.MustCompile(`(?i)(alarm|status|state|fault|error|warning|flag|word|bits)`)
+
+const bitVectorComment = "Possible bit vector: add extractBit to export a single bit, with one entry per bit"
+
+var unsignedDataTypes = map[string]bool{"Byte": true, "UInt16": true, "UInt32": true, "UInt64": true}
+
+func runGenerateConfig(args []string) error {
+	flags := newSubcommandFlagSet("generate-config", "Browse an OPC UA server, or read a UANodeSet2 XML file, and write a config file for the Variables found.")
+	root := flags.String("root", "ns=0;i=85", "Node ID, or browse path from the Root folder such as /Objects/Line1/Press, to start browsing from")
+	depth := flags.Int("depth", 0, "How many levels of Objects to browse below the root (0 for no limit)")
+	metricPrefix := flags.String("metric-prefix", "", "Prefix for the generated metric names")
+	output := flags.String("output", "", "File to write the config to (default standard output)")
+	nodeSetFile := flags.String("nodeset", "", "Read the nodes from this UANodeSet2 XML file instead of connecting to a server")
+	flags.Parse(args)
+	if *metricPrefix != "" && !metricNameRegex.MatchString(*metricPrefix) {
+		return fmt.Errorf("Invalid metric prefix %q", *metricPrefix)
+	}
+	if *nodeSetFile != "" {
+		return generateConfigFromNodeSet(*nodeSetFile, *root, *metricPrefix, *output)
+	}
+
+	client, err := connectFromFlags(context.Background())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	rootID, err := resolveDiscoveryRoot(client, *root)
+	if err != nil {
+		return err
+	}
+	discovery := DiscoveryConfig{Root: *root, MaxDepth: *depth, MetricPrefix: *metricPrefix}
+	nodes, err := browseVariables(client, rootID, discovery)
+	if err != nil {
+		return err
+	}
+
+	var generated []generatedNode
+	for _, node := range nodes {
+		nodeConfig, _ := discovery.nodeConfig(node)
+		generated = append(generated, newGeneratedNode(nodeConfig, strings.Join(node.Path, "/"), node.DataType))
+	}
+	header := fmt.Sprintf("Generated from %s below %s", *endpoint, *root)
+	return writeGeneratedConfig(*output, header, generated)
+}
+
+// Generate the config offline from a NodeSet file, e.g. one shipped by the PLC vendor
+func generateConfigFromNodeSet(path string, root string, metricPrefix string, output string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ns, err := parseNodeSet(f)
+	if err != nil {
+		return err
+	}
+	rootKey, err := ns.resolveRoot(root)
+	if err != nil {
+		return err
+	}
+	generated := ns.generateNodeConfigs(rootKey, metricPrefix)
+	header := fmt.Sprintf("Generated from %s below %s", filepath.Base(path), root)
+	return writeGeneratedConfig(output, header, generated)
+}
+
+// Describe where a node came from, and flag it if it looks like a bit vector
+func newGeneratedNode(nodeConfig NodeConfig, browsePath string, dataType string) generatedNode {
+	comments := []string{fmt.Sprintf("%s (%s)", browsePath, dataType)}
+	name := browsePath[strings.LastIndex(browsePath, "/")+1:]
+	if unsignedDataTypes[dataType] && bitVectorNameRegex.MatchString(name) {
+		comments = append(comments, bitVectorComment)
+	}
+	return generatedNode{nodeConfig, comments}
+}
+
+// Make the time series unique by numbering repeated metric names, e.g. temperature, temperature_2.
+// Nodes can share a metric name if their labels differ.
+func uniqueMetricNames(nodes []generatedNode) {
+	seen := make(map[string]bool)
+	for i := range nodes {
+		labels := nodes[i].Config.Labels
+		name := nodes[i].Config.MetricName
+		for n := 2; seen[seriesName(name, labels)]; n++ {
+			name = fmt.Sprintf("%s_%d", nodes[i].Config.MetricName, n)
+		}
+		seen[seriesName(name, labels)] = true
+		nodes[i].Config.MetricName = name
+	}
+}
+
+// Write the generated nodes to the file, or standard output if none is given
+func writeGeneratedConfig(path string, header string, nodes []generatedNode) error {
+	uniqueMetricNames(nodes)
+	var out bytes.Buffer
+	if err := writeConfigDocument(&out, header, nodes); err != nil {
+		return err
+	}
+	if path == "" {
+		_, err := os.Stdout.Write(out.Bytes())
+		return err
+	}
+	if err := ioutil.WriteFile(path, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d nodes to %s\n", len(nodes), path)
+	return nil
+}
+
+// Write the nodes as a versioned config document, with each node's comments above it
+func writeConfigDocument(w io.Writer, header string, nodes []generatedNode) error {
+	if header != "" {
+		for _, line := range strings.Split(header, "\n") {
+			fmt.Fprintf(w, "# %s\n", line)
+		}
+	}
+	fmt.Fprintf(w, "version: %d\n", configVersion)
+	if len(nodes) == 0 {
+		_, err := fmt.Fprintln(w, "nodes: []")
+		return err
+	}
+	fmt.Fprintln(w, "nodes:")
+	for _, node := range nodes {
+		content, err := yaml.Marshal([]NodeConfig{node.Config})
+		if err != nil {
+			return err
+		}
+		for _, comment := range node.Comments {
+			fmt.Fprintf(w, "# %s\n", comment)
+		}
+		if _, err := w.Write(content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewGeneratedNode(t *testing.T) {
+	nodeConfig := NodeConfig{NodeName: "ns=2;s=Press.AlarmWord", MetricName: "press_alarm_word"}
+	node := newGeneratedNode(nodeConfig, "Press/AlarmWord", "UInt16")
+	assert.Equal(t, 2, len(node.Comments))
+	assert.Contains(t, node.Comments[1], "bit vector")
+
+	// signed or floating point values are not bit vectors, nor are unsigned values with other names
+	assert.Equal(t, 1, len(newGeneratedNode(nodeConfig, "Press/AlarmWord", "Double").Comments))
+	assert.Equal(t, 1, len(newGeneratedNode(nodeConfig, "Press/PartCount", "UInt32").Comments))
+}
+
+func TestUniqueMetricNames(t *testing.T) {
+	nodes := []generatedNode{
+		{Config: NodeConfig{NodeName: "ns=2;i=1", MetricName: "temperature"}},
+		{Config: NodeConfig{NodeName: "ns=2;i=2", MetricName: "temperature"}},
+		{Config: NodeConfig{NodeName: "ns=2;i=3", MetricName: "temperature"}},
+		{Config: NodeConfig{NodeName: "ns=2;i=4", MetricName: "temperature", Labels: map[string]string{"machine": "Press"}}},
+	}
+	uniqueMetricNames(nodes)
+	var names []string
+	for _, node := range nodes {
+		names = append(names, node.Config.MetricName)
+	}
+	assert.Equal(t, []string{"temperature", "temperature_2", "temperature_3", "temperature"}, names)
+}
+
+func TestWriteNodeConfigYAML(t *testing.T) {
+	nodes := []generatedNode{
+		newGeneratedNode(NodeConfig{NodeName: "ns=2;s=Press.Temperature", MetricName: metricNameFromPath([]string{"Press", "Temperature"})}, "Press/Temperature", "Double"),
+		newGeneratedNode(NodeConfig{NodeName: "ns=2;s=Press.StatusWord", MetricName: metricNameFromPath([]string{"Press", "Status Word"})}, "Press/Status Word", "UInt16"),
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, writeConfigDocument(&out, "Generated from opc.tcp://plc1:4840", nodes))
+	assert.Equal(t, `# Generated from opc.tcp://plc1:4840
+version: 1
+nodes:
+# Press/Temperature (Double)
+- nodeName: ns=2;s=Press.Temperature
+  metricName: press_temperature
+# Press/Status Word (UInt16)
+# Possible bit vector: add extractBit to export a single bit, with one entry per bit
+- nodeName: ns=2;s=Press.StatusWord
+  metricName: press_status_word
+`, out.String())
+
+	// the output reads back as a config
+	document, err := parseConfigDocument(out.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, []NodeConfig{nodes[0].Config, nodes[1].Config}, document.Nodes)
+	for _, nodeConfig := range document.Nodes {
+		assert.Regexp(t, metricNameRegex, nodeConfig.MetricName)
+	}
+
+	out.Reset()
+	assert.NoError(t, writeConfigDocument(&out, "", nil))
+	document, err = parseConfigDocument(out.Bytes())
+	assert.NoError(t, err)
+	assert.Empty(t, document.Nodes)
+}
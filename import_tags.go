@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A tag read from a Kepware or Ignition export
+type importedTag struct {
+	Groups      []string // tag groups or folders, outermost first
+	Name        string
+	Address     string // device address; a boolean tag may address a bit of a word, e.g. 40001.3 or N7:0/3
+	NodeID      string
+	Kind        string // tagKindBoolean, tagKindInteger or tagKindFloat; empty if the tag can't be exported
+	DataType    string // as named in the export
+	SkipReason  string // why the tag can't be exported, if not because of its data type
+	Description string
+	Units       string
+}
+
+const (
+	tagKindBoolean = "boolean"
+	tagKindInteger = "integer"
+	tagKindFloat   = "float"
+)
+
+var kepwareTagKinds = map[string]string{
+	"Boolean": tagKindBoolean,
+	"Char":    tagKindInteger, "Byte": tagKindInteger, "Short": tagKindInteger, "Word": tagKindInteger,
+	"Long": tagKindInteger, "DWord": tagKindInteger, "LLong": tagKindInteger, "QWord": tagKindInteger,
+	"BCD": tagKindInteger, "LBCD": tagKindInteger,
+	"Float": tagKindFloat, "Double": tagKindFloat,
+}
+
+var ignitionTagKinds = map[string]string{
+	"Boolean": tagKindBoolean,
+	"Int1":    tagKindInteger, "Int2": tagKindInteger, "Int4": tagKindInteger, "Int8": tagKindInteger,
+	"Float4": tagKindFloat, "Float8": tagKindFloat,
+}
+
+var tagImporters = map[string]func(r io.Reader, nodePrefix string, namespace int) ([]importedTag, error){
+	"kepware":  parseKepwareCSV,
+	"ignition": parseIgnitionJSON,
+}
+
+func runImportTags(args []string) error {
+	flags := newOfflineFlagSet("import-tags", "Convert a Kepware CSV or Ignition JSON tag export into a config file.")
+	format := flags.String("format", "", "Format of the export: kepware (CSV) or ignition (JSON)")
+	input := flags.String("input", "", "Tag export file to read")
+	output := flags.String("output", "", "File to write the config to (default standard output)")
+	nodePrefix := flags.String("node-prefix", "", "Kepware channel and device, e.g. Channel1.Device1, which prefix the tag names in the OPC UA node IDs")
+	namespace := flags.Int("namespace", 2, "Namespace index of the Kepware tags on its OPC UA server")
+	groupLabels := flags.String("group-labels", "", "Comma-separated label names for the tag group levels, e.g. line,machine (default: one group label)")
+	metricPrefix := flags.String("metric-prefix", "", "Prefix for the generated metric names")
+	flags.Parse(args)
+
+	importTags, ok := tagImporters[*format]
+	if !ok {
+		return fmt.Errorf("Unknown tag export format %q (expected kepware or ignition)", *format)
+	}
+	if *input == "" {
+		return fmt.Errorf("Requires -input")
+	}
+	if *format == "kepware" && *nodePrefix == "" {
+		return fmt.Errorf("Kepware tags need -node-prefix, the channel and device the tags belong to")
+	}
+	if *metricPrefix != "" && !metricNameRegex.MatchString(*metricPrefix) {
+		return fmt.Errorf("Invalid metric prefix %q", *metricPrefix)
+	}
+	var labelNames []string
+	if *groupLabels != "" {
+		labelNames = strings.Split(*groupLabels, ",")
+	}
+	for _, name := range labelNames {
+		if !labelNameRegex.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("Invalid group label name %q", name)
+		}
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tags, err := importTags(f, *nodePrefix, *namespace)
+	if err != nil {
+		return err
+	}
+
+	generated, skipped := importedNodeConfigs(tags, labelNames, *metricPrefix)
+	header := append([]string{fmt.Sprintf("Imported from %s", filepath.Base(*input))}, skipped...)
+	return writeGeneratedConfig(*output, strings.Join(header, "\n"), generated)
+}
+
+// Read a Kepware CSV tag export. Tag groups are part of the tag name, e.g. Line1.Press.Temperature,
+// and the tags appear on Kepware's OPC UA server as ns=2;s=<channel>.<device>.<tag name>.
+func parseKepwareCSV(r io.Reader, nodePrefix string, namespace int) ([]importedTag, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading Kepware CSV: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("Kepware CSV is empty")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.TrimPrefix(strings.TrimSpace(name), "\ufeff")] = i
+	}
+	for _, name := range []string{"Tag Name", "Address", "Data Type"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("Kepware CSV has no %q column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var tags []importedTag
+	for _, record := range records[1:] {
+		tagName := field(record, "Tag Name")
+		if tagName == "" {
+			continue
+		}
+		dataType := field(record, "Data Type")
+		if field(record, "Scaling") != "" && field(record, "Scaled Data Type") != "" {
+			dataType = field(record, "Scaled Data Type") // Kepware scales the value before serving it
+		}
+		parts := strings.Split(tagName, ".")
+		tags = append(tags, importedTag{
+			Groups:      parts[:len(parts)-1],
+			Name:        parts[len(parts)-1],
+			Address:     field(record, "Address"),
+			NodeID:      fmt.Sprintf("ns=%d;s=%s.%s", namespace, nodePrefix, tagName),
+			Kind:        kepwareTagKinds[dataType],
+			DataType:    dataType,
+			Description: field(record, "Description"),
+			Units:       field(record, "Eng Units"),
+		})
+	}
+	return tags, nil
+}
+
+type ignitionTag struct {
+	Name          string        `json:"name"`
+	TagType       string        `json:"tagType"`
+	ValueSource   string        `json:"valueSource"`
+	DataType      string        `json:"dataType"`
+	OPCItemPath   string        `json:"opcItemPath"`
+	Documentation string        `json:"documentation"`
+	EngUnit       string        `json:"engUnit"`
+	Tags          []ignitionTag `json:"tags"`
+}
+
+// Read an Ignition tag JSON export. Folders and UDT instances become tag groups,
+// and the OPC item path of each OPC tag is its node ID.
+func parseIgnitionJSON(r io.Reader, _ string, _ int) ([]importedTag, error) {
+	var root ignitionTag
+	if err := json.NewDecoder(r).Decode(&root); err != nil {
+		return nil, fmt.Errorf("Error reading Ignition JSON: %v", err)
+	}
+
+	var tags []importedTag
+	var walk func(tag ignitionTag, groups []string)
+	walk = func(tag ignitionTag, groups []string) {
+		if len(tag.Tags) > 0 || tag.TagType == "Folder" || tag.TagType == "UdtInstance" || tag.TagType == "Provider" {
+			if tag.Name != "" && tag.TagType != "Provider" {
+				groups = append(append([]string{}, groups...), tag.Name)
+			}
+			for _, child := range tag.Tags {
+				walk(child, groups)
+			}
+			return
+		}
+		if tag.ValueSource != "opc" && (tag.ValueSource != "" || tag.OPCItemPath == "") {
+			return // memory, expression, query and reference tags have no OPC UA node
+		}
+		dataType := tag.DataType
+		if dataType == "" {
+			dataType = "Int4" // Ignition leaves out the default
+		}
+		imported := importedTag{
+			Groups:      groups,
+			Name:        tag.Name,
+			Address:     tag.OPCItemPath,
+			NodeID:      tag.OPCItemPath,
+			Kind:        ignitionTagKinds[dataType],
+			DataType:    dataType,
+			Description: tag.Documentation,
+			Units:       tag.EngUnit,
+		}
+		if strings.Contains(tag.OPCItemPath, "{") {
+			imported.Kind = ""
+			imported.SkipReason = "its OPC item path has UDT parameters"
+		}
+		tags = append(tags, imported)
+	}
+	walk(root, nil)
+	return tags, nil
+}
+
+// Split a bit address such as 40001.3 or N7:0/3 into the word address and the bit number
+func splitBitAddress(address string) (string, int, bool) {
+	i := strings.LastIndexAny(address, "./")
+	if i <= 0 {
+		return "", 0, false
+	}
+	bit, err := strconv.Atoi(address[i+1:])
+	if err != nil || bit < 0 || bit > 63 {
+		return "", 0, false
+	}
+	return address[:i], bit, true
+}
+
+// Build the node configs for the imported tags. Tag groups become labels: one label per level named
+// in labelNames (deeper levels go into the metric name), or a single group label if none are named.
+// A boolean tag that addresses a bit of a word tag in the same export reads that bit from the word's node.
+// Returns the tags that can't be exported as comments.
+func importedNodeConfigs(tags []importedTag, labelNames []string, metricPrefix string) ([]generatedNode, []string) {
+	words := make(map[string]importedTag)
+	hasGroups := false
+	for _, tag := range tags {
+		if tag.Kind == tagKindInteger && tag.Address != "" {
+			words[tag.Address] = tag
+		}
+		hasGroups = hasGroups || len(tag.Groups) > 0
+	}
+
+	var generated []generatedNode
+	var skipped []string
+	for _, tag := range tags {
+		tagPath := strings.Join(append(append([]string{}, tag.Groups...), tag.Name), "/")
+		if tag.Kind == "" {
+			reason := tag.SkipReason
+			if reason == "" {
+				reason = fmt.Sprintf("%s values can't be exported", tag.DataType)
+			}
+			skipped = append(skipped, fmt.Sprintf("Skipped %s: %s", tagPath, reason))
+			continue
+		}
+
+		labels := make(map[string]string)
+		nameParts := tag.Groups
+		if len(labelNames) > 0 {
+			for i, name := range labelNames {
+				labels[name] = ""
+				if i < len(tag.Groups) {
+					labels[name] = tag.Groups[i]
+				}
+			}
+			if len(tag.Groups) > len(labelNames) {
+				nameParts = tag.Groups[len(labelNames):]
+			} else {
+				nameParts = nil
+			}
+		} else if hasGroups {
+			labels["group"] = strings.Join(tag.Groups, "/")
+			nameParts = nil
+		}
+
+		metricName := metricNameFromPath(append(append([]string{}, nameParts...), tag.Name))
+		if metricPrefix != "" {
+			metricName = metricPrefix + "_" + metricName
+		}
+		nodeConfig := NodeConfig{NodeName: tag.NodeID, MetricName: metricName, Help: tag.Description}
+		if len(labels) > 0 {
+			nodeConfig.Labels = labels
+		}
+		if tag.Units != "" {
+			nodeConfig.Help = strings.TrimSpace(fmt.Sprintf("%s [%s]", tag.Description, tag.Units))
+		}
+
+		comments := []string{fmt.Sprintf("%s (%s)", tagPath, tag.DataType)}
+		if tag.Kind == tagKindBoolean {
+			if wordAddress, bit, ok := splitBitAddress(tag.Address); ok {
+				if word, ok := words[wordAddress]; ok {
+					nodeConfig.NodeName = word.NodeID
+					nodeConfig.ExtractBit = bit
+					comments = append(comments, fmt.Sprintf("Bit %d of %s", bit, strings.Join(append(append([]string{}, word.Groups...), word.Name), "/")))
+				}
+			}
+		} else if tag.Kind == tagKindInteger && bitVectorNameRegex.MatchString(tag.Name) {
+			comments = append(comments, bitVectorComment)
+		}
+		generated = append(generated, generatedNode{nodeConfig, comments})
+	}
+	return generated, skipped
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func importTestTags(t *testing.T, path string, importTags func(f *os.File) ([]importedTag, error)) []importedTag {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	tags, err := importTags(f)
+	assert.NoError(t, err)
+	return tags
+}
+
+// Write the generated nodes and read them back the way the exporter does
+func roundTrip(t *testing.T, generated []generatedNode) []NodeConfig {
+	var out bytes.Buffer
+	uniqueMetricNames(generated)
+	assert.NoError(t, writeConfigDocument(&out, "Imported", generated))
+	document, err := parseConfigDocument(out.Bytes())
+	assert.NoError(t, err)
+	assert.NoError(t, validateNodeLabels(document.Nodes))
+	return document.Nodes
+}
+
+func TestImportKepwareCSV(t *testing.T) {
+	tags := importTestTags(t, "testdata/kepware_tags.csv", func(f *os.File) ([]importedTag, error) {
+		return parseKepwareCSV(f, "Channel1.PLC1", 2)
+	})
+	generated, skipped := importedNodeConfigs(tags, []string{"line", "machine"}, "")
+	assert.Equal(t, []string{"Skipped Line1/Press/Recipe: String values can't be exported"}, skipped)
+
+	nodeConfigs := roundTrip(t, generated)
+	press1 := map[string]string{"line": "Line1", "machine": "Press"}
+	assert.Equal(t, []NodeConfig{
+		{NodeName: "ns=2;s=Channel1.PLC1.Line1.Press.Temperature", MetricName: "temperature", Labels: press1, Help: "Press platen temperature [°C]"},
+		{NodeName: "ns=2;s=Channel1.PLC1.Line1.Press.StatusWord", MetricName: "status_word", Labels: press1},
+		{NodeName: "ns=2;s=Channel1.PLC1.Line1.Press.StatusWord", MetricName: "running", Labels: press1, ExtractBit: 0, Help: "Press is running"},
+		{NodeName: "ns=2;s=Channel1.PLC1.Line1.Press.StatusWord", MetricName: "faulted", Labels: press1, ExtractBit: 3},
+		{NodeName: "ns=2;s=Channel1.PLC1.Line1.Press.DoorOpen", MetricName: "door_open", Labels: press1},
+		{NodeName: "ns=2;s=Channel1.PLC1.Line2.Press.Temperature", MetricName: "temperature", Labels: map[string]string{"line": "Line2", "machine": "Press"}, Help: "Press platen temperature [°C]"},
+	}, nodeConfigs)
+	assert.Equal(t, []string{"Line1/Press/StatusWord (Word)", bitVectorComment}, generated[1].Comments)
+	assert.Equal(t, []string{"Line1/Press/Faulted (Boolean)", "Bit 3 of Line1/Press/StatusWord"}, generated[3].Comments)
+	_, err := createMetrics(&nodeConfigs, nil, prometheus.NewRegistry())
+	assert.NoError(t, err)
+}
+
+func TestImportKepwareCSVDefaultGroupLabel(t *testing.T) {
+	tags := importTestTags(t, "testdata/kepware_tags.csv", func(f *os.File) ([]importedTag, error) {
+		return parseKepwareCSV(f, "Channel1.PLC1", 2)
+	})
+	generated, _ := importedNodeConfigs(tags, nil, "plant")
+	nodeConfigs := roundTrip(t, generated)
+	assert.Equal(t, "plant_temperature", nodeConfigs[0].MetricName)
+	assert.Equal(t, map[string]string{"group": "Line1/Press"}, nodeConfigs[0].Labels)
+}
+
+func TestImportIgnitionJSON(t *testing.T) {
+	tags := importTestTags(t, "testdata/ignition_tags.json", func(f *os.File) ([]importedTag, error) {
+		return parseIgnitionJSON(f, "", 0)
+	})
+	generated, skipped := importedNodeConfigs(tags, []string{"line"}, "")
+	assert.Equal(t, []string{"Skipped Line1/Conveyor/Running: its OPC item path has UDT parameters"}, skipped)
+
+	nodeConfigs := roundTrip(t, generated)
+	line1 := map[string]string{"line": "Line1"}
+	assert.Equal(t, []NodeConfig{
+		{NodeName: "ns=1;s=[PLC1]F8:0", MetricName: "oven_temperature", Labels: line1, Help: "Oven temperature [°C]"},
+		{NodeName: "ns=1;s=[PLC1]N7:0", MetricName: "oven_alarm_word", Labels: line1},
+		{NodeName: "ns=1;s=[PLC1]N7:0", MetricName: "oven_over_temp", Labels: line1, ExtractBit: 2},
+		{NodeName: "ns=1;s=[PLC1]F8:10", MetricName: "conveyor_speed", Labels: line1},
+	}, nodeConfigs)
+}
+
+func TestSplitBitAddress(t *testing.T) {
+	type bitAddressTest struct {
+		address string
+		word    string
+		bit     int
+		ok      bool
+	}
+	testCases := []bitAddressTest{
+		{"400001.3", "400001", 3, true},
+		{"N7:0/15", "N7:0", 15, true},
+		{"DB1.DBX4.7", "DB1.DBX4", 7, true},
+		{"DB1.DBW4", "", 0, false},
+		{"400001", "", 0, false},
+		{".3", "", 0, false},
+	}
+	for _, tc := range testCases {
+		word, bit, ok := splitBitAddress(tc.address)
+		assert.Equal(t, tc, bitAddressTest{tc.address, word, bit, ok})
+	}
+}
+
+func TestParseKepwareCSVErrors(t *testing.T) {
+	_, err := parseKepwareCSV(strings.NewReader(""), "Channel1.PLC1", 2)
+	assert.Error(t, err)
+	_, err = parseKepwareCSV(strings.NewReader("\"Tag Name\",\"Data Type\"\n"), "Channel1.PLC1", 2)
+	assert.Error(t, err)
+}
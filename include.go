@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// configLoader reads a config from several files and merges them. Servers of the same name are
+// merged, adding up their nodes; templates, modules and settings may only be given once.
+type configLoader struct {
+	config  *Config
+	read    map[string]bool   // files already read, by absolute path
+	sources map[string]string // the file each server, template, module, setting and metric series came from
+	nodes   map[string]string // the node name of each metric series, for duplicate messages
+	failed  bool              // whether a file failed to parse, rather than to merge
+}
+
+func newConfigLoader() *configLoader {
+	return &configLoader{
+		config:  &Config{},
+		read:    make(map[string]bool),
+		sources: make(map[string]string),
+		nodes:   make(map[string]string),
+	}
+}
+
+// The config files a -config path or include names: the file itself, the .yaml and .yml files
+// of a directory, or the files matching a glob
+func configFiles(path string) ([]string, error) {
+	paths := []string{path}
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid glob %s: %v", path, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("No config files match %s", path)
+		}
+		paths = matches
+	}
+
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var dirFiles []string
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				dirFiles = append(dirFiles, filepath.Join(path, entry.Name()))
+			}
+		}
+		if len(dirFiles) == 0 && len(paths) == 1 {
+			return nil, fmt.Errorf("No .yaml or .yml files in %s", path)
+		}
+		sort.Strings(dirFiles)
+		files = append(files, dirFiles...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No config files match %s", path)
+	}
+	return files, nil
+}
+
+// Read the files of a path, and the files they include. Files that were already read are skipped,
+// so a file can't be merged twice, or include itself.
+func (l *configLoader) load(path string) error {
+	files, err := configFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		absPath, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		if l.read[absPath] {
+			continue
+		}
+		l.read[absPath] = true
+
+		content, err := ioutil.ReadFile(absPath)
+		if err != nil {
+			return err
+		}
+		l.config.files = append(l.config.files, absPath)
+		config, err := parseConfigContent(content, filepath.Dir(absPath))
+		if err != nil {
+			l.failed = true
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if err := l.merge(config, file); err != nil {
+			return err
+		}
+
+		for _, include := range config.Include {
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(file), include)
+			}
+			if err := l.load(include); err != nil {
+				return fmt.Errorf("%s: include %s: %v", file, include, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Add the config of one file to the merged config
+func (l *configLoader) merge(config *Config, file string) error {
+	merged := l.config
+	for name, value := range config.settings {
+		key := "setting " + name
+		if merged.settings == nil {
+			merged.settings = make(map[string]string)
+		}
+		if previous, ok := merged.settings[name]; ok && previous != value {
+			return fmt.Errorf("Setting %s is %q in %s, but %q in %s", name, previous, l.sources[key], value, file)
+		}
+		merged.settings[name] = value
+		l.sources[key] = file
+	}
+	if !reflect.DeepEqual(config.defaults, NodeDefaults{}) {
+		if !reflect.DeepEqual(merged.defaults, NodeDefaults{}) && !reflect.DeepEqual(merged.defaults, config.defaults) {
+			return fmt.Errorf("Node defaults differ between %s and %s", l.sources["defaults"], file)
+		}
+		merged.defaults = config.defaults
+		l.sources["defaults"] = file
+	}
+
+	for name, nodes := range config.Templates {
+		key := "template " + name
+		if _, ok := merged.Templates[name]; ok {
+			return fmt.Errorf("Template %s is defined in both %s and %s", name, l.sources[key], file)
+		}
+		if merged.Templates == nil {
+			merged.Templates = make(map[string][]NodeConfig)
+		}
+		merged.Templates[name] = nodes
+		l.sources[key] = file
+	}
+
+	for name, module := range config.Modules {
+		key := "module " + name
+		if _, ok := merged.Modules[name]; ok {
+			return fmt.Errorf("Module %s is defined in both %s and %s", name, l.sources[key], file)
+		}
+		if err := l.addNodeSources(key, module.Nodes, file); err != nil {
+			return err
+		}
+		if merged.Modules == nil {
+			merged.Modules = make(map[string]ModuleConfig)
+		}
+		merged.Modules[name] = module
+		l.sources[key] = file
+	}
+
+	for _, server := range config.Servers {
+		if server.Name == "" && len(server.Nodes) == 0 && len(server.Instances) == 0 && len(server.Discover) == 0 {
+			continue // a versioned file with only templates or settings
+		}
+		key := fmt.Sprintf("server %q", server.Name)
+		if err := l.addNodeSources(key, server.Nodes, file); err != nil {
+			return err
+		}
+		i := serverIndex(merged.Servers, server.Name)
+		if i < 0 {
+			merged.Servers = append(merged.Servers, server)
+			l.sources[key] = file
+			continue
+		}
+
+		existing := &merged.Servers[i]
+		if server.Endpoint != "" {
+			if existing.Endpoint != "" && existing.Endpoint != server.Endpoint {
+				return fmt.Errorf("Server %q has endpoint %s in %s, but %s in %s", server.Name, existing.Endpoint, l.sources[key], server.Endpoint, file)
+			}
+			existing.Endpoint = server.Endpoint
+		}
+		if server.Security != (SecurityConfig{}) {
+			if existing.Security != (SecurityConfig{}) && existing.Security != server.Security {
+				return fmt.Errorf("Server %q has different security settings in %s and %s", server.Name, l.sources[key], file)
+			}
+			existing.Security = server.Security
+		}
+		if server.Auth != (AuthConfig{}) {
+			if existing.Auth != (AuthConfig{}) && existing.Auth != server.Auth {
+				return fmt.Errorf("Server %q has different auth settings in %s and %s", server.Name, l.sources[key], file)
+			}
+			existing.Auth = server.Auth
+		}
+		existing.Nodes = append(append([]NodeConfig{}, existing.Nodes...), server.Nodes...)
+		existing.Instances = append(append([]TemplateInstance{}, existing.Instances...), server.Instances...)
+		existing.Discover = append(append([]DiscoveryConfig{}, existing.Discover...), server.Discover...)
+	}
+	return nil
+}
+
+// Record which file each metric series of a server or module is in, and report series given twice
+func (l *configLoader) addNodeSources(owner string, nodeConfigs []NodeConfig, file string) error {
+	for _, nodeConfig := range nodeConfigs {
+		key := owner + " " + seriesName(nodeConfig.MetricName, nodeConfig.Labels)
+		if previousFile, ok := l.sources[key]; ok {
+			return fmt.Errorf("Nodes %s in %s and %s in %s both map to %s of %s",
+				l.nodes[key], previousFile, nodeConfig.NodeName, file, seriesName(nodeConfig.MetricName, nodeConfig.Labels), owner)
+		}
+		l.sources[key] = file
+		l.nodes[key] = nodeConfig.NodeName
+	}
+	return nil
+}
+
+func serverIndex(servers []ServerConfig, name string) int {
+	for i, server := range servers {
+		if server.Name == name {
+			return i
+		}
+	}
+	return -1
+}
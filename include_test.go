@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Write the files into a new temporary directory, and return its path
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "opcua_config")
+	assert.NoError(t, err)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestReadConfigDirectory(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"main.yaml": `
+version: 1
+server:
+  name: line1
+  endpoint: opc.tcp://plc1:4840
+defaults:
+  labels:
+    site: berlin
+nodes:
+  - nodeName: ns=1;s=Temperature
+    metricName: temperature_celsius
+`,
+		"motors.yml": `
+version: 1
+server:
+  name: line1
+templates:
+  motor:
+    - nodeName: ns=2;s=Motor{motor}.Speed
+      metricName: motor_speed_rpm
+instances:
+  - template: motor
+    parameters:
+      motor: 1..3
+`,
+		"notes.txt": "not a config file",
+	})
+	defer os.RemoveAll(dir)
+
+	config, err := readConfigFile(dir)
+	assert.NoError(t, err)
+	assert.Len(t, config.Servers, 1)
+	assert.Len(t, config.Servers[0].Nodes, 4)
+	assert.Equal(t, map[string]string{"site": "berlin", "motor": "3"}, config.Servers[0].Nodes[3].Labels)
+	assert.Equal(t, "opc.tcp://plc1:4840", config.settings["endpoint"])
+	assert.Len(t, config.files, 2)
+
+	config, err = readConfigFile(filepath.Join(dir, "m*.y*ml"))
+	assert.NoError(t, err)
+	assert.Len(t, config.Servers[0].Nodes, 4)
+
+	_, err = readConfigFile(filepath.Join(dir, "*.json"))
+	assert.EqualError(t, err, "No config files match "+filepath.Join(dir, "*.json"))
+
+	// A glob matching only directories without config files
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "empty1"), 0755))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "empty2"), 0755))
+	_, err = configFiles(filepath.Join(dir, "e*"))
+	assert.EqualError(t, err, "No config files match "+filepath.Join(dir, "e*"))
+}
+
+func TestReadConfigIncludes(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yaml": `
+include:
+  - servers/*.yaml
+  - modules.yaml
+servers:
+  - name: press
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: press_temperature_celsius
+`,
+		"servers/press.yaml": `
+include: [../config.yaml]
+servers:
+  - name: press
+    endpoint: opc.tcp://press:4840
+    nodes:
+      - nodeName: ns=1;s=Pressure
+        metricName: press_pressure_bar
+`,
+		"servers/oven.yaml": `
+servers:
+  - name: oven
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: oven_temperature_celsius
+`,
+		"modules.yaml": `
+modules:
+  line:
+    nodes:
+      - nodeName: ns=1;s=Speed
+        metricName: line_speed
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	config, err := readConfigFile(filepath.Join(dir, "config.yaml"))
+	assert.NoError(t, err)
+	assert.Len(t, config.Servers, 2)
+	assert.Equal(t, "press", config.Servers[0].Name)
+	assert.Equal(t, "opc.tcp://press:4840", config.Servers[0].Endpoint)
+	assert.Len(t, config.Servers[0].Nodes, 2)
+	assert.Equal(t, "oven", config.Servers[1].Name)
+	assert.Contains(t, config.Modules, "line")
+}
+
+func TestReadConfigConflicts(t *testing.T) {
+	conflicts := []struct {
+		files   map[string]string
+		message string
+	}{
+		{map[string]string{
+			"a.yaml": "servers:\n  - name: press\n    nodes:\n      - nodeName: ns=1;s=A\n        metricName: temperature\n",
+			"b.yaml": "servers:\n  - name: press\n    nodes:\n      - nodeName: ns=1;s=B\n        metricName: temperature\n",
+		}, "Nodes ns=1;s=A in DIR/a.yaml and ns=1;s=B in DIR/b.yaml both map to temperature of server \"press\""},
+		{map[string]string{
+			"a.yaml": "version: 1\nhttp:\n  port: 9000\n",
+			"b.yaml": "version: 1\nhttp:\n  port: 9001\n",
+		}, "Setting port is \"9000\" in DIR/a.yaml, but \"9001\" in DIR/b.yaml"},
+		{map[string]string{
+			"a.yaml": "servers:\n  - name: press\n    endpoint: opc.tcp://a:4840\n",
+			"b.yaml": "servers:\n  - name: press\n    endpoint: opc.tcp://b:4840\n",
+		}, "Server \"press\" has endpoint opc.tcp://a:4840 in DIR/a.yaml, but opc.tcp://b:4840 in DIR/b.yaml"},
+		{map[string]string{
+			"a.yaml": "modules:\n  line:\n    nodes: []\n",
+			"b.yaml": "modules:\n  line:\n    nodes: []\n",
+		}, "Module line is defined in both DIR/a.yaml and DIR/b.yaml"},
+		{map[string]string{
+			"a.yaml": "servers:\n  - name: press\n",
+			"b.yaml": "- nodeName: ns=1;s=A\n  metricName: temperature\n",
+		}, "Server 1 has no name; with several servers, each needs one"},
+		{map[string]string{
+			"a.yaml": "servers:\n  - name: press\n    nodes: [\n",
+		}, "DIR/a.yaml: yaml: line 3: did not find expected node content"},
+	}
+	for _, conflict := range conflicts {
+		dir := writeConfigFiles(t, conflict.files)
+		_, err := readConfigFile(dir)
+		assert.EqualError(t, err, strings.Replace(conflict.message, "DIR", dir, -1))
+		os.RemoveAll(dir)
+	}
+}
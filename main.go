@@ -11,7 +11,7 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/gopcua/opcua"
@@ -25,20 +25,48 @@ import (
 
 var port = flag.Int("port", 9686, "Port to publish metrics on.")
 var endpoint = flag.String("endpoint", "opc.tcp://localhost:4096", "OPC UA Endpoint to connect to.")
+var securityPolicy = flag.String("security-policy", "None", "OPC UA security policy: None, Basic256Sha256, Aes128Sha256RsaOaep or Aes256Sha256RsaPss")
+var securityMode = flag.String("security-mode", "", "OPC UA message security mode: None, Sign or SignAndEncrypt (default: most secure mode offered for the policy)")
+var certFile = flag.String("cert", "", "Path to the PEM-encoded client certificate")
+var keyFile = flag.String("key", "", "Path to the PEM-encoded client private key")
+var pkiDir = flag.String("pki-dir", "", "Directory holding the client certificate and the trusted/, rejected/ and issuers/ server certificate stores. A client certificate is generated if -cert and -key are not given.")
+var applicationURI = flag.String("application-uri", "", "Application URI for the generated client certificate (default urn:<hostname>:opcua_exporter)")
+var authMode = flag.String("auth-mode", "Anonymous", "OPC UA user identity: Anonymous, UserName or Certificate")
+var username = flag.String("username", "", "User name for -auth-mode UserName")
+var passwordFile = flag.String("password-file", "", "Path to a file containing the password for -auth-mode UserName")
+var passwordEnv = flag.String("password-env", "OPCUA_PASSWORD", "Environment variable containing the password for -auth-mode UserName, if -password-file is not set")
+var userCertFile = flag.String("user-cert", "", "Path to the PEM-encoded user certificate for -auth-mode Certificate. Must be the client certificate, as the user token is signed with its key (defaults to the client certificate)")
 var promPrefix = flag.String("prom-prefix", "", "Prefix will be appended to emitted prometheus metrics")
-var nodeListFile = flag.String("config", "", "Path to a file from which to read the list of OPC UA nodes to monitor")
+var nodeListFile = flag.String("config", "", "Path to a file from which to read the list of OPC UA nodes to monitor, or a directory or glob of such files")
 var configB64 = flag.String("config-b64", "", "Base64-encoded config JSON. Overrides -config")
 var debug = flag.Bool("debug", false, "Enable debug logging")
 var readTimeout = flag.Duration("read-timeout", 5*time.Second, "Timeout when waiting for OPCUA subscription messages")
-var maxTimeouts = flag.Int("max-timeouts", 0, "The exporter will quit trying after this many read timeouts (0 to disable).")
+var maxTimeouts = flag.Int("max-timeouts", 0, "The exporter will reconnect after this many read timeouts (0 to disable).")
 var bufferSize = flag.Int("buffer-size", 64, "Maximum number of messages in the receive buffer")
+var minBackoff = flag.Duration("reconnect-min-backoff", time.Second, "Initial delay between reconnect attempts")
+var maxBackoff = flag.Duration("reconnect-max-backoff", 2*time.Minute, "Maximum delay between reconnect attempts")
+var probeTimeout = flag.Duration("probe-timeout", 10*time.Second, "Timeout for /probe requests, if Prometheus doesn't send one")
+var strictNodes = flag.Bool("strict-nodes", false, "Exit if a configured node is missing on the server or doesn't fit its metric when first connecting, instead of logging it")
 var summaryInterval = flag.Duration("summary-interval", 5*time.Minute, "How frequently to print an event count summary")
+var watchConfig = flag.Duration("watch-config", 0, "How often to check the -config file for changes and reload it (0 to only reload on SIGHUP or POST /-/reload)")
 
 // NodeConfig : Structure for representing OPCUA nodes to monitor.
 type NodeConfig struct {
-	NodeName   string      `yaml:"nodeName"`             // OPC UA node identifier
-	MetricName string      `yaml:"metricName"`           // Prometheus metric name to emit
-	ExtractBit interface{} `yaml:"extractBit,omitempty"` // Optional numeric value. If present and positive, extract just this bit and emit it as a boolean metric
+	NodeName   string              `yaml:"nodeName"`             // OPC UA node identifier
+	MetricName string              `yaml:"metricName"`           // Prometheus metric name to emit
+	ExtractBit interface{}         `yaml:"extractBit,omitempty"` // Optional numeric value. If present and positive, extract just this bit and emit it as a boolean metric
+	Labels     map[string]string   `yaml:"labels,omitempty"`     // Optional Prometheus labels. Nodes can share a metric name if they have the same label names.
+	Type       string              `yaml:"type,omitempty"`       // gauge (the default), counter, histogram or summary
+	Buckets    []float64           `yaml:"buckets,omitempty"`    // Histogram buckets. Defaults to the Prometheus default buckets.
+	Objectives map[float64]float64 `yaml:"objectives,omitempty"` // Summary quantiles and their allowed errors. No quantiles by default.
+	CounterMax float64             `yaml:"counterMax,omitempty"` // Largest raw value of a PLC counter before it wraps to zero, e.g. 65535
+	Transform  ValueTransform      `yaml:",inline"`              // Optional scaling, offset, unit conversion and clamping
+	Help       string              `yaml:"help,omitempty"`       // Optional metric help text
+
+	EUProperties   bool `yaml:"euProperties,omitempty"`   // Read EURange, InstrumentRange and EngineeringUnits from the server for the help text and unit suffix
+	EURangeMetrics bool `yaml:"euRangeMetrics,omitempty"` // Also export the EURange as <metric>_eu_low and <metric>_eu_high gauges
+
+	Monitoring MonitoringConfig `yaml:"monitoring,omitempty"` // Optional sampling, queueing, deadband and publishing interval for the node
 }
 
 // MsgHandler interface can convert OPC UA Variant objects
@@ -52,13 +80,25 @@ type MsgHandler interface {
 type HandlerMap map[string][]handlerMapRecord
 
 type handlerMapRecord struct {
-	config  NodeConfig
-	handler MsgHandler
+	config      NodeConfig
+	handler     MsgHandler
+	factory     *MetricFactory // set while the handler waits for the node's engineering unit properties
+	metricNames []string       // the metrics created for the node, to remove if it's dropped on reload
 }
 
 var startTime = time.Now()
 var uptimeGauge prometheus.Gauge
 var messageCounter prometheus.Counter
+var outOfRangeCounter *prometheus.CounterVec
+var unmappedMessageCounter *prometheus.CounterVec
+var notificationErrorCounter *prometheus.CounterVec
+var nodeStatusGauge *prometheus.GaugeVec
+var connectionStateGauge *prometheus.GaugeVec
+var reconnectCounter *prometheus.CounterVec
+var configReloadCounter *prometheus.CounterVec
+var configReloadSuccessGauge prometheus.Gauge
+var configReloadTimeGauge prometheus.Gauge
+var configHashGauge prometheus.Gauge
 var eventSummaryCounter *EventSummaryCounter
 
 func init() {
@@ -78,77 +118,222 @@ func init() {
 	})
 	prometheus.MustRegister(messageCounter)
 
+	outOfRangeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: subsystem,
+		Name:      "values_out_of_range_total",
+		Help:      "Number of values received outside the EURange the server advertises for the node",
+	}, []string{"server", "metric"})
+	prometheus.MustRegister(outOfRangeCounter)
+
+	unmappedMessageCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: subsystem,
+		Name:      "unmapped_messages_total",
+		Help:      "Number of OPCUA channel updates received for a node ID with no metric mapped to it",
+	}, []string{"server", "node"})
+	prometheus.MustRegister(unmappedMessageCounter)
+
+	notificationErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: subsystem,
+		Name:      "notification_errors_total",
+		Help:      "Number of OPCUA subscription notifications that were skipped because of an error",
+	}, []string{"server"})
+	prometheus.MustRegister(notificationErrorCounter)
+
+	nodeStatusGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: subsystem,
+		Name:      "node_status",
+		Help:      "Result of checking each configured node against the OPCUA server when connecting; 1 for the current status",
+	}, []string{"server", "node", "metric", "status"})
+	prometheus.MustRegister(nodeStatusGauge)
+
+	connectionStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: subsystem,
+		Name:      "connected",
+		Help:      "1 if the exporter has an active OPCUA session, 0 otherwise",
+	}, []string{"server", "endpoint"})
+	prometheus.MustRegister(connectionStateGauge)
+
+	reconnectCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: subsystem,
+		Name:      "reconnect_attempts_total",
+		Help:      "Total number of times the exporter has tried to reconnect to the OPCUA server",
+	}, []string{"server", "endpoint"})
+	prometheus.MustRegister(reconnectCounter)
+
+	configReloadCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: subsystem,
+		Name:      "config_reloads_total",
+		Help:      "Number of attempts to reload the config file, by result (success or failure)",
+	}, []string{"result"})
+	prometheus.MustRegister(configReloadCounter)
+
+	configReloadSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: subsystem,
+		Name:      "config_last_reload_successful",
+		Help:      "1 if the last attempt to load the config file succeeded, 0 otherwise",
+	})
+	prometheus.MustRegister(configReloadSuccessGauge)
+
+	configReloadTimeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: subsystem,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Time of the last successful load of the config file, in seconds since the epoch",
+	})
+	prometheus.MustRegister(configReloadTimeGauge)
+
+	configHashGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: subsystem,
+		Name:      "config_hash",
+		Help:      "Hash of the config in use, to tell whether exporters have the same config",
+	})
+	prometheus.MustRegister(configHashGauge)
+
 	eventSummaryCounter = NewEventSummaryCounter(*summaryInterval)
 }
 
 func main() {
+	if runSubcommand(os.Args[1:]) {
+		return
+	}
+
 	log.Print("Starting up.")
 	flag.Parse()
-	opcua_debug.Enable = *debug
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	eventSummaryCounter.Start(ctx)
-
-	var nodes []NodeConfig
-	var readError error
+	if flag.NArg() > 0 {
+		log.Fatalf("Unknown command %q (expected one of %s)", flag.Arg(0), subcommandNames())
+	}
 	if *configB64 != "" {
 		log.Print("Using base64-encoded config")
-		nodes, readError = readConfigBase64(configB64)
 	} else if *nodeListFile != "" {
 		log.Printf("Reading config from %s", *nodeListFile)
-		nodes, readError = readConfigFile(*nodeListFile)
 	} else {
 		log.Fatal("Requires -config or -config-b64")
 	}
-
+	config, readError := loadConfig()
 	if readError != nil {
 		log.Fatalf("Error reading config JSON: %v", readError)
 	}
+	if err := applySettings(config.settings, flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	opcua_debug.Enable = *debug
 
-	client := getClient(endpoint)
-	log.Printf("Connecting to OPCUA server at %s", *endpoint)
-	if err := client.Connect(ctx); err != nil {
-		log.Fatalf("Error connecting to OPC UA client: %v", err)
-	} else {
-		log.Print("Connected successfully")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventSummaryCounter.Interval = *summaryInterval
+	eventSummaryCounter.Start(ctx)
+
+	reloader := NewReloader(config)
+	for _, server := range config.Servers {
+		applyFlagDefaults(&server)
+		if server.Security.PKIDir != "" && server.Security.CertFile == "" && server.Security.KeyFile == "" {
+			// Generate the certificate now, so that it can be trusted on the server before the first connection attempt
+			if err := NewPKI(server.Security.PKIDir).Init(server.Security.ApplicationURI); err != nil {
+				log.Fatalf("Error initializing PKI directory: %v", err)
+			}
+		}
+		if err := server.Security.Validate(); err != nil {
+			log.Fatalf("Invalid security settings for %s: %v", server.Endpoint, err)
+		}
+		if err := server.Auth.Validate(); err != nil {
+			log.Fatalf("Invalid auth settings for %s: %v", server.Endpoint, err)
+		}
+		if err := server.Auth.checkUserCertificate(server.Security); err != nil {
+			log.Fatalf("Invalid auth settings for %s: %v", server.Endpoint, err)
+		}
+		for _, discovery := range server.Discover {
+			if err := discovery.Validate(); err != nil {
+				log.Fatalf("Invalid discovery settings for %s: %v", server.Endpoint, err)
+			}
+		}
+
+		var labels prometheus.Labels
+		if server.Name != "" {
+			labels = prometheus.Labels{"server": server.Name}
+		}
+		factory := NewMetricFactory(labels, prometheus.DefaultRegisterer)
+		metricMap := make(HandlerMap)
+		if err := metricMap.addNodes(server.Nodes, factory); err != nil {
+			log.Fatalf("Error creating metrics for %s: %v", server.Endpoint, err)
+		}
+		supervisor := NewConnectionSupervisor(server, metricMap, factory, *bufferSize, NewBackoff(*minBackoff, *maxBackoff))
+		if err := supervisor.registerMetrics(prometheus.DefaultRegisterer); err != nil {
+			log.Fatalf("Error registering the connection metrics of server %q: %v", server.Name, err)
+		}
+		reloader.Supervisors[server.Name] = supervisor
+		go supervisor.Run(ctx)
 	}
-	defer client.Close()
 
-	metricMap := createMetrics(&nodes)
-	go setupMonitor(ctx, client, metricMap, *bufferSize)
+	for name, module := range config.Modules {
+		if err := validateModule(name, module); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	reloader.Probe = NewProbeHandler(config.Modules)
+	reloader.Start(ctx, *watchConfig)
 
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/probe", reloader.Probe)
+	http.Handle("/-/reload", reloader)
 	var listenOn = fmt.Sprintf(":%d", *port)
 	log.Printf("Serving metrics on %s", listenOn)
 	log.Fatal(http.ListenAndServe(listenOn, nil))
 }
 
-func getClient(endpoint *string) *opcua.Client {
-	client := opcua.NewClient(*endpoint)
-	return client
+// Fill in any server settings missing from the config file from the command line flags
+func applyFlagDefaults(server *ServerConfig) {
+	if server.Endpoint == "" {
+		server.Endpoint = *endpoint
+	}
+	if server.Security == (SecurityConfig{}) {
+		server.Security = SecurityConfig{
+			Policy:         *securityPolicy,
+			Mode:           *securityMode,
+			CertFile:       *certFile,
+			KeyFile:        *keyFile,
+			PKIDir:         *pkiDir,
+			ApplicationURI: *applicationURI,
+		}
+	}
+	if server.Auth == (AuthConfig{Password: server.Auth.Password}) {
+		// A password on its own goes with the identity from the flags
+		server.Auth = AuthConfig{
+			Mode:         *authMode,
+			Username:     *username,
+			Password:     server.Auth.Password,
+			PasswordFile: *passwordFile,
+			PasswordEnv:  *passwordEnv,
+			CertFile:     *userCertFile,
+		}
+	}
+	if server.Auth.CertFile == "" {
+		server.Auth.CertFile = server.Security.CertFile
+	}
 }
 
-// Subscribe to all the nodes and update the appropriate prometheus metrics on change
-func setupMonitor(ctx context.Context, client *opcua.Client, handlerMap HandlerMap, bufferSize int) {
-	m, err := monitor.NewNodeMonitor(client)
-	if err != nil {
-		log.Fatal(err)
-	}
+// Subscribe to all the nodes and update the appropriate prometheus metrics on change.
+// Nodes are grouped into a subscription per publishing interval.
+// A new HandlerMap sent on the updates channel replaces the current one, and the nodes
+// are added to or removed from the subscriptions to match.
+// subscribed is called once all the nodes are subscribed to.
+// Returns when the context is cancelled or a subscription is lost.
+func setupMonitor(ctx context.Context, client *opcua.Client, server string, handlerMap HandlerMap, bufferSize int, updates <-chan HandlerMap, subscribed func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	var nodeList []string
 	for nodeName := range handlerMap { // Node names are keys of handlerMap
 		nodeList = append(nodeList, nodeName)
 	}
+	sort.Strings(nodeList)
 
-	ch := make(chan *monitor.DataChangeMessage, bufferSize)
-	params := opcua.SubscriptionParameters{Interval: time.Second}
-	sub, err := m.ChanSubscribe(ctx, &params, ch, nodeList...)
-	if err != nil {
-		log.Fatal(err)
+	subs := newSubscriptions(ctx, client, server, bufferSize)
+	defer subs.close()
+	if err := subs.add(handlerMap, nodeList); err != nil {
+		return err
 	}
-	defer cleanup(sub)
+	subscribed()
 
 	lag := time.Millisecond * 10
 	timeoutCount := 0
@@ -156,44 +341,61 @@ func setupMonitor(ctx context.Context, client *opcua.Client, handlerMap HandlerM
 		uptimeGauge.Set(time.Now().Sub(startTime).Seconds())
 		select {
 		case <-ctx.Done():
-			return
-		case msg := <-ch:
-			if msg.Error != nil {
-				log.Printf("[error ] sub=%d error=%s", sub.SubscriptionID(), msg.Error)
-			} else if msg.Value == nil {
-				log.Printf("nil value received for node %s", msg.NodeID)
-			} else {
-				if *debug {
-					log.Printf("[message ] sub=%d ts=%s node=%s value=%v", sub.SubscriptionID(), msg.SourceTimestamp.UTC().Format(time.RFC3339), msg.NodeID, msg.Value.Value())
+			return nil
+		case newMap := <-updates:
+			if err := subs.update(handlerMap, newMap); err != nil {
+				return err
+			}
+			handlerMap = newMap
+		case data := <-subs.notifyCh:
+			timeoutCount = 0
+			messages, err := subs.messages(data)
+			if err != nil {
+				return err
+			}
+			for _, msg := range messages {
+				if msg.Error != nil {
+					log.Printf("[error ] sub=%d error=%s", data.SubscriptionID, msg.Error)
+				} else if msg.Value == nil {
+					log.Printf("nil value received for node %s", msg.NodeID)
+				} else {
+					if *debug {
+						log.Printf("[message ] sub=%d ts=%s node=%s value=%v", data.SubscriptionID, msg.SourceTimestamp.UTC().Format(time.RFC3339), msg.NodeID, msg.Value.Value())
+					}
+
+					messageCounter.Inc()
+					nodeID := msg.NodeID.String()
+					eventSummaryCounter.Inc(nodeID)
+
+					handleMessage(msg, handlerMap, server)
 				}
-
-				messageCounter.Inc()
-				nodeID := msg.NodeID.String()
-				eventSummaryCounter.Inc(nodeID)
-
-				handleMessage(msg, handlerMap)
 			}
 			time.Sleep(lag)
-		case <-time.After(*readTimeout):
+		case <-time.After(subs.readTimeout(*readTimeout)):
 			timeoutCount++
 			log.Printf("Timeout %d wating for subscription messages", timeoutCount)
 			if *maxTimeouts > 0 && timeoutCount >= *maxTimeouts {
-				log.Fatalf("Max timeouts (%d) exceeded. Quitting.", *maxTimeouts)
+				return fmt.Errorf("max timeouts (%d) exceeded", *maxTimeouts)
 			}
 		}
 	}
-
-}
-
-func cleanup(sub *monitor.Subscription) {
-	log.Printf("stats: sub=%d delivered=%d dropped=%d", sub.SubscriptionID(), sub.Delivered(), sub.Dropped())
-	sub.Unsubscribe()
 }
 
-func handleMessage(msg *monitor.DataChangeMessage, handlerMap HandlerMap) {
+func handleMessage(msg *monitor.DataChangeMessage, handlerMap HandlerMap, server string) {
 	nodeID := msg.NodeID.String()
-	for _, handlerMapRec := range handlerMap[nodeID] {
+	records, ok := handlerMap[nodeID]
+	if !ok {
+		unmappedMessageCounter.WithLabelValues(server, nodeID).Inc()
+		if *debug {
+			log.Printf("No metric for node %s", nodeID)
+		}
+		return
+	}
+	for _, handlerMapRec := range records {
 		handler := handlerMapRec.handler
+		if handler == nil {
+			continue // not created yet
+		}
 		value := msg.Value
 		if *debug {
 			log.Printf("Handling %s --> %s", nodeID, handlerMapRec.config.MetricName)
@@ -205,61 +407,186 @@ func handleMessage(msg *monitor.DataChangeMessage, handlerMap HandlerMap) {
 	}
 }
 
-// Initialize a Prometheus gauge for each node. Return them as a map.
-func createMetrics(nodeConfigs *[]NodeConfig) HandlerMap {
+// Initialize a Prometheus metric for each node and register it. Return them as a map.
+// The labels are added to every metric, to tell apart metrics from different servers.
+func createMetrics(nodeConfigs *[]NodeConfig, labels prometheus.Labels, registerer prometheus.Registerer) (HandlerMap, error) {
 	handlerMap := make(HandlerMap)
-	for _, nodeConfig := range *nodeConfigs {
-		nodeName := nodeConfig.NodeName
-		metricName := nodeConfig.MetricName
-		mapRecord := handlerMapRecord{nodeConfig, createHandler(nodeConfig)}
+	if err := handlerMap.addNodes(*nodeConfigs, NewMetricFactory(labels, registerer)); err != nil {
+		return nil, err
+	}
+	return handlerMap, nil
+}
+
+// Create the metrics for more nodes, such as those found by discovery, and add them to the map.
+// The nodes must not clash with the ones already in the map.
+func (handlerMap HandlerMap) addNodes(nodeConfigs []NodeConfig, factory *MetricFactory) error {
+	var allConfigs []NodeConfig
+	for _, records := range handlerMap {
+		for _, record := range records {
+			allConfigs = append(allConfigs, record.config)
+		}
+	}
+	if err := validateNodeLabels(append(allConfigs, nodeConfigs...)); err != nil {
+		return err
+	}
+	if err := validateNodeMonitoring(append(allConfigs, nodeConfigs...)); err != nil {
+		return err
+	}
+
+	for _, nodeConfig := range nodeConfigs {
+		nodeName, err := canonicalNodeName(nodeConfig.NodeName)
+		if err != nil {
+			return fmt.Errorf("Metric %s: %v", nodeConfig.MetricName, err)
+		}
+		if nodeConfig.EUProperties {
+			// The metric name and help text depend on what the server says, so wait until we're connected
+			handlerMap[nodeName] = append(handlerMap[nodeName], handlerMapRecord{nodeConfig, nil, factory, nil})
+			log.Printf("Deferred prom metric %s for OPC UA node %s until its engineering units are read", nodeConfig.MetricName, nodeName)
+			continue
+		}
+		handler, err := createHandler(nodeConfig, factory)
+		if err != nil {
+			return err
+		}
+		mapRecord := handlerMapRecord{nodeConfig, handler, nil, []string{prefixedMetricName(nodeConfig.MetricName)}}
 		handlerMap[nodeName] = append(handlerMap[nodeName], mapRecord)
-		log.Printf("Created prom metric %s for OPC UA node %s", metricName, nodeName)
+		log.Printf("Created prom metric %s for OPC UA node %s", seriesName(nodeConfig.MetricName, nodeConfig.Labels), nodeName)
+	}
+	return nil
+}
+
+func createHandler(nodeConfig NodeConfig, factory *MetricFactory) (MsgHandler, error) {
+	metricName := prefixedMetricName(nodeConfig.MetricName)
+
+	metricType := nodeConfig.Type
+	if metricType == "" {
+		metricType = metricTypeGauge
+	}
+	if nodeConfig.ExtractBit != nil && metricType != metricTypeGauge {
+		return nil, fmt.Errorf("Metric %s: extractBit can only be used with gauges", metricName)
+	}
+	if _, err := extractBitIndex(nodeConfig.ExtractBit); err != nil {
+		return nil, fmt.Errorf("Metric %s: %v", metricName, err)
 	}
 
-	return handlerMap
+	transform := nodeConfig.Transform
+	if !transform.IsIdentity() {
+		if nodeConfig.ExtractBit != nil {
+			return nil, fmt.Errorf("Metric %s: extractBit can not be combined with scaling or unit conversion", metricName)
+		}
+		if err := transform.Validate(); err != nil {
+			return nil, fmt.Errorf("Metric %s: %v", metricName, err)
+		}
+	}
+
+	if metricType == metricTypeCounter && transform.Clamp != nil {
+		return nil, fmt.Errorf("Metric %s: clamp can not be used with counters", metricName)
+	}
+
+	handler, err := createTypedHandler(nodeConfig, metricName, metricType, factory)
+	if err != nil || transform.IsIdentity() {
+		return handler, err
+	}
+	if counterHandler, ok := handler.(OpcCounterHandler); ok {
+		// The counter detects wraps on the raw values, so it scales the increases itself
+		counterHandler.transform = transform
+		return counterHandler, nil
+	}
+	return TransformHandler{handler, transform}, nil
 }
 
-func createHandler(nodeConfig NodeConfig) MsgHandler {
-	metricName := nodeConfig.MetricName
-	if *promPrefix != "" {
-		metricName = fmt.Sprintf("%s_%s", *promPrefix, metricName)
+func createTypedHandler(nodeConfig NodeConfig, metricName string, metricType string, factory *MetricFactory) (MsgHandler, error) {
+	labels := nodeConfig.Labels
+	help := nodeConfig.Help
+	if help == "" {
+		help = "From OPC UA"
 	}
-	g := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: metricName,
-		Help: "From OPC UA",
-	})
-	prometheus.MustRegister(g)
+	switch metricType {
+	case metricTypeGauge:
+		g, err := factory.Gauge(metricName, help, labels)
+		if err != nil {
+			return nil, err
+		}
+		if nodeConfig.ExtractBit != nil {
+			extractBit, _ := extractBitIndex(nodeConfig.ExtractBit) // checked by createHandler()
+			return OpcuaBitVectorHandler{g, extractBit, *debug}, nil
+		}
+		return OpcValueHandler{g}, nil
+	case metricTypeCounter:
+		c, err := factory.Counter(metricName, help, labels)
+		if err != nil {
+			return nil, err
+		}
+		return NewOpcCounterHandler(c, nodeConfig.CounterMax, *debug), nil
+	case metricTypeHistogram:
+		h, err := factory.Histogram(metricName, help, labels, nodeConfig.Buckets)
+		if err != nil {
+			return nil, err
+		}
+		return OpcObserverHandler{h}, nil
+	case metricTypeSummary:
+		s, err := factory.Summary(metricName, help, labels, nodeConfig.Objectives)
+		if err != nil {
+			return nil, err
+		}
+		return OpcObserverHandler{s}, nil
+	default:
+		return nil, fmt.Errorf("Metric %s has unknown type %q (expected gauge, counter, histogram or summary)", metricName, nodeConfig.Type)
+	}
+}
 
-	var handler MsgHandler
-	if nodeConfig.ExtractBit != nil {
-		extractBit := nodeConfig.ExtractBit.(int) // coerce interface to an integer
-		handler = OpcuaBitVectorHandler{g, extractBit, *debug}
-	} else {
-		handler = OpcValueHandler{g}
+// The metric name with the -prom-prefix, if any
+func prefixedMetricName(metricName string) string {
+	if *promPrefix == "" {
+		return metricName
 	}
-	return handler
+	return fmt.Sprintf("%s_%s", *promPrefix, metricName)
 }
 
-func readConfigFile(path string) ([]NodeConfig, error) {
-	absPath, err := filepath.Abs(path)
-	if err != nil {
-		return nil, err
+// The bit to extract, which YAML must have given as a non-negative integer. Returns -1 if there is none.
+func extractBitIndex(extractBit interface{}) (int, error) {
+	if extractBit == nil {
+		return -1, nil
+	}
+	bit, ok := extractBit.(int)
+	if !ok || bit < 0 {
+		return -1, fmt.Errorf("extractBit must be a non-negative integer, not %#v", extractBit)
 	}
+	return bit, nil
+}
 
-	f, err := os.Open(absPath)
-	if err != nil {
-		return nil, err
+// Read the config from -config-b64 or -config
+func loadConfig() (*Config, error) {
+	if *configB64 != "" {
+		return readConfigBase64(configB64)
 	}
+	if *nodeListFile != "" {
+		return readConfigFile(*nodeListFile)
+	}
+	return nil, fmt.Errorf("Requires -config or -config-b64")
+}
 
-	return parseConfigYAML(f)
+// Read the config from a file, the .yaml and .yml files of a directory, or the files matching a glob,
+// along with the files they include
+func readConfigFile(path string) (*Config, error) {
+	loader := newConfigLoader()
+	if err := loader.load(path); err != nil {
+		return nil, err
+	}
+	config := loader.config
+	if err := config.complete(); err != nil {
+		return nil, err
+	}
+	config.logNodeCounts()
+	return config, nil
 }
 
-func readConfigBase64(encodedConfig *string) ([]NodeConfig, error) {
+func readConfigBase64(encodedConfig *string) (*Config, error) {
 	config, decodeErr := base64.StdEncoding.DecodeString(*encodedConfig)
 	if decodeErr != nil {
 		log.Fatal(decodeErr)
 	}
-	return parseConfigYAML(bytes.NewReader(config))
+	return parseConfig(bytes.NewReader(config))
 }
 
 func parseConfigYAML(config io.Reader) ([]NodeConfig, error) {
@@ -5,6 +5,7 @@ import (
 
 	"github.com/gopcua/opcua/monitor"
 	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -60,7 +61,7 @@ func TestHandleMessage(t *testing.T) {
 
 	// Handle a fake message addressed to nodeID1
 	msg := makeTestMessage(nodeID1)
-	handleMessage(&msg, handlerMap)
+	handleMessage(&msg, handlerMap, "")
 
 	// All three nodeName1 handlers should have been called
 	for _, record := range handlerMap[nodeName1] {
@@ -79,21 +80,38 @@ func TestHandleMessage(t *testing.T) {
 func TestCreateMetrics(t *testing.T) {
 	nodeconfigs := []NodeConfig{
 		{
-			NodeName:   "foo",
+			NodeName:   "ns=1;s=foo",
 			MetricName: "foo_level_blorbs",
 		},
 		{
-			NodeName:   "bar",
+			NodeName:   "ns=1;s=bar",
 			MetricName: "bar_level_blorbs",
 		},
 		{
-			NodeName:   "foo",
+			NodeName:   "ns=1;s=foo",
 			MetricName: "foo_rate_blarbs",
 		},
 	}
 
-	handlerMap := createMetrics(&nodeconfigs)
+	handlerMap, err := createMetrics(&nodeconfigs, nil, prometheus.NewRegistry())
+	assert.NoError(t, err)
 	assert.Equal(t, len(handlerMap), 2)
-	assert.Equal(t, len(handlerMap["foo"]), 2)
-	assert.Equal(t, len(handlerMap["bar"]), 1)
+	assert.Equal(t, len(handlerMap["ns=1;s=foo"]), 2)
+	assert.Equal(t, len(handlerMap["ns=1;s=bar"]), 1)
+}
+
+func TestAddNodes(t *testing.T) {
+	factory := NewMetricFactory(nil, prometheus.NewRegistry())
+	handlerMap := make(HandlerMap)
+	assert.NoError(t, handlerMap.addNodes([]NodeConfig{{NodeName: "ns=1;s=foo", MetricName: "foo_level_blorbs"}}, factory))
+
+	// discovered nodes can share a metric with configured ones if their labels tell them apart
+	assert.Error(t, handlerMap.addNodes([]NodeConfig{{NodeName: "ns=1;s=bar", MetricName: "foo_level_blorbs"}}, factory))
+	assert.NoError(t, handlerMap.addNodes([]NodeConfig{{NodeName: "ns=1;s=bar", MetricName: "bar_level_blorbs"}}, factory))
+	assert.Equal(t, 2, len(handlerMap))
+
+	// nodes are keyed the way the server reports them, and unparsable node IDs are rejected
+	assert.NoError(t, handlerMap.addNodes([]NodeConfig{{NodeName: "ns=0;i=2258", MetricName: "server_time"}}, factory))
+	assert.Len(t, handlerMap["i=2258"], 1)
+	assert.Error(t, handlerMap.addNodes([]NodeConfig{{NodeName: "Voltmeter", MetricName: "voltage"}}, factory))
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var metricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Metric types that can be configured for a node
+const (
+	metricTypeGauge     = "gauge"
+	metricTypeCounter   = "counter"
+	metricTypeHistogram = "histogram"
+	metricTypeSummary   = "summary"
+)
+
+// MetricFactory creates and registers the Prometheus collectors for configured nodes.
+// Nodes with the same metric name share one vector, told apart by their labels,
+// so a dozen identical pumps can all feed pump_speed_rpm{pump="..."}.
+// The first node for a metric name decides its type, buckets and objectives.
+type MetricFactory struct {
+	ConstLabels prometheus.Labels // added to every metric, e.g. the server name
+	Registerer  prometheus.Registerer
+	vecs        map[string]*labeledVec
+}
+
+type labeledVec struct {
+	metricType string
+	labelNames []string
+	collector  prometheus.Collector
+	series     map[string]bool // the label values in use, so the vector can be unregistered when none are left
+}
+
+// NewMetricFactory creates a factory that registers metrics with the given registerer
+func NewMetricFactory(constLabels prometheus.Labels, registerer prometheus.Registerer) *MetricFactory {
+	return &MetricFactory{
+		ConstLabels: constLabels,
+		Registerer:  registerer,
+		vecs:        make(map[string]*labeledVec),
+	}
+}
+
+// Gauge returns the gauge for the metric name and label values, creating and registering its vector if needed.
+func (f *MetricFactory) Gauge(metricName string, help string, labels map[string]string) (prometheus.Gauge, error) {
+	lv, err := f.vec(metricName, metricTypeGauge, labels, func(labelNames []string) prometheus.Collector {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        metricName,
+			Help:        help,
+			ConstLabels: f.ConstLabels,
+		}, labelNames)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lv.collector.(*prometheus.GaugeVec).GetMetricWith(labels)
+}
+
+// Counter returns the counter for the metric name and label values, creating and registering its vector if needed.
+func (f *MetricFactory) Counter(metricName string, help string, labels map[string]string) (prometheus.Counter, error) {
+	lv, err := f.vec(metricName, metricTypeCounter, labels, func(labelNames []string) prometheus.Collector {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        metricName,
+			Help:        help,
+			ConstLabels: f.ConstLabels,
+		}, labelNames)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lv.collector.(*prometheus.CounterVec).GetMetricWith(labels)
+}
+
+// Histogram returns the histogram for the metric name and label values, creating and registering its vector if needed.
+func (f *MetricFactory) Histogram(metricName string, help string, labels map[string]string, buckets []float64) (prometheus.Observer, error) {
+	lv, err := f.vec(metricName, metricTypeHistogram, labels, func(labelNames []string) prometheus.Collector {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        metricName,
+			Help:        help,
+			ConstLabels: f.ConstLabels,
+			Buckets:     buckets,
+		}, labelNames)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lv.collector.(*prometheus.HistogramVec).GetMetricWith(labels)
+}
+
+// Summary returns the summary for the metric name and label values, creating and registering its vector if needed.
+func (f *MetricFactory) Summary(metricName string, help string, labels map[string]string, objectives map[float64]float64) (prometheus.Observer, error) {
+	lv, err := f.vec(metricName, metricTypeSummary, labels, func(labelNames []string) prometheus.Collector {
+		return prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name:        metricName,
+			Help:        help,
+			ConstLabels: f.ConstLabels,
+			Objectives:  objectives,
+		}, labelNames)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lv.collector.(*prometheus.SummaryVec).GetMetricWith(labels)
+}
+
+// Look up the vector for a metric name, or create and register it.
+// Nodes sharing a metric name must agree on its type and label names.
+func (f *MetricFactory) vec(metricName string, metricType string, labels map[string]string, newVec func([]string) prometheus.Collector) (*labeledVec, error) {
+	labelNames := sortedLabelNames(labels)
+	lv, ok := f.vecs[metricName]
+	if !ok {
+		collector := newVec(labelNames)
+		if err := f.Registerer.Register(collector); err != nil {
+			return nil, fmt.Errorf("Error registering metric %s: %v", metricName, err)
+		}
+		lv = &labeledVec{metricType, labelNames, collector, make(map[string]bool)}
+		f.vecs[metricName] = lv
+		lv.series[seriesName(metricName, labels)] = true
+		return lv, nil
+	}
+
+	if lv.metricType != metricType {
+		return nil, fmt.Errorf("Metric %s is a %s, but was already created as a %s", metricName, metricType, lv.metricType)
+	}
+	if strings.Join(lv.labelNames, ",") != strings.Join(labelNames, ",") {
+		return nil, fmt.Errorf("Metric %s has labels [%s], but was already created with labels [%s]",
+			metricName, strings.Join(labelNames, ", "), strings.Join(lv.labelNames, ", "))
+	}
+	lv.series[seriesName(metricName, labels)] = true
+	return lv, nil
+}
+
+// Remove deletes the metric for the label values, and unregisters its vector once no node uses it.
+// Used when a node is dropped from the config on reload.
+func (f *MetricFactory) Remove(metricName string, labels map[string]string) {
+	lv, ok := f.vecs[metricName]
+	if !ok {
+		return
+	}
+	if vec, ok := lv.collector.(interface{ Delete(prometheus.Labels) bool }); ok {
+		vec.Delete(labels)
+	}
+	delete(lv.series, seriesName(metricName, labels))
+	if len(lv.series) == 0 {
+		f.Registerer.Unregister(lv.collector)
+		delete(f.vecs, metricName)
+	}
+}
+
+// Check that the label names are valid, that nodes sharing a metric name use the same label names,
+// and that no two nodes would write to the same time series.
+func validateNodeLabels(nodeConfigs []NodeConfig) error {
+	checker := newNodeLabelChecker()
+	for _, nodeConfig := range nodeConfigs {
+		if err := checker.add(nodeConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeLabelChecker checks the labels of nodes one at a time against the nodes added before
+type nodeLabelChecker struct {
+	labelNamesByMetric map[string]string
+	seenSeries         map[string]string // node name by series
+}
+
+func newNodeLabelChecker() *nodeLabelChecker {
+	return &nodeLabelChecker{
+		labelNamesByMetric: make(map[string]string),
+		seenSeries:         make(map[string]string),
+	}
+}
+
+// add checks the node's labels and adds it, unless they clash with the nodes added so far
+func (c *nodeLabelChecker) add(nodeConfig NodeConfig) error {
+	for name := range nodeConfig.Labels {
+		if !labelNameRegex.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("Invalid label name %q for metric %s", name, nodeConfig.MetricName)
+		}
+	}
+
+	labelNames := strings.Join(sortedLabelNames(nodeConfig.Labels), ",")
+	if existing, ok := c.labelNamesByMetric[nodeConfig.MetricName]; ok && existing != labelNames {
+		return fmt.Errorf("Metric %s is configured with different label names: [%s] and [%s]", nodeConfig.MetricName, existing, labelNames)
+	}
+	series := seriesName(nodeConfig.MetricName, nodeConfig.Labels)
+	if otherNode, ok := c.seenSeries[series]; ok {
+		return fmt.Errorf("Nodes %s and %s both map to %s", otherNode, nodeConfig.NodeName, series)
+	}
+	c.labelNamesByMetric[nodeConfig.MetricName] = labelNames
+	c.seenSeries[series] = nodeConfig.NodeName
+	return nil
+}
+
+func sortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Format a metric name and labels the way Prometheus displays a time series, e.g. pump_speed_rpm{pump="3"}
+func seriesName(metricName string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return metricName
+	}
+	var pairs []string
+	for _, name := range sortedLabelNames(labels) {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return fmt.Sprintf("%s{%s}", metricName, strings.Join(pairs, ","))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabeledMetrics(t *testing.T) {
+	nodes := []NodeConfig{
+		{NodeName: "ns=2;s=Pump1.Speed", MetricName: "pump_speed_rpm", Labels: map[string]string{"pump": "1"}},
+		{NodeName: "ns=2;s=Pump2.Speed", MetricName: "pump_speed_rpm", Labels: map[string]string{"pump": "2"}},
+		{NodeName: "ns=2;s=Pump3.Speed", MetricName: "pump_speed_rpm", Labels: map[string]string{"pump": "3"}},
+	}
+	registry := prometheus.NewRegistry()
+	handlerMap, err := createMetrics(&nodes, nil, registry)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(handlerMap))
+
+	msg := makeTestMessage(ua.NewStringNodeID(2, "Pump3.Speed"))
+	msg.Value = ua.MustVariant(1450.0)
+	handleMessage(&msg, handlerMap, "")
+
+	expected := `
+# HELP pump_speed_rpm From OPC UA
+# TYPE pump_speed_rpm gauge
+pump_speed_rpm{pump="1"} 0
+pump_speed_rpm{pump="2"} 0
+pump_speed_rpm{pump="3"} 1450
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "pump_speed_rpm"))
+}
+
+func TestValidateNodeLabels(t *testing.T) {
+	badConfigs := [][]NodeConfig{
+		{ // inconsistent label names
+			{NodeName: "a", MetricName: "pump_speed_rpm", Labels: map[string]string{"pump": "1"}},
+			{NodeName: "b", MetricName: "pump_speed_rpm", Labels: map[string]string{"motor": "1"}},
+		},
+		{ // missing labels
+			{NodeName: "a", MetricName: "pump_speed_rpm", Labels: map[string]string{"pump": "1"}},
+			{NodeName: "b", MetricName: "pump_speed_rpm"},
+		},
+		{ // same series twice
+			{NodeName: "a", MetricName: "pump_speed_rpm", Labels: map[string]string{"pump": "1"}},
+			{NodeName: "b", MetricName: "pump_speed_rpm", Labels: map[string]string{"pump": "1"}},
+		},
+		{ // the old MustRegister panic
+			{NodeName: "a", MetricName: "pump_speed_rpm"},
+			{NodeName: "b", MetricName: "pump_speed_rpm"},
+		},
+		{ // invalid label names
+			{NodeName: "a", MetricName: "pump_speed_rpm", Labels: map[string]string{"pump-id": "1"}},
+		},
+		{
+			{NodeName: "a", MetricName: "pump_speed_rpm", Labels: map[string]string{"__name__": "1"}},
+		},
+	}
+	for _, nodes := range badConfigs {
+		assert.Error(t, validateNodeLabels(nodes), "%+v", nodes)
+		_, err := createMetrics(&nodes, nil, prometheus.NewRegistry())
+		assert.Error(t, err)
+	}
+}
+
+func TestNodeLabelChecker(t *testing.T) {
+	checker := newNodeLabelChecker()
+	assert.NoError(t, checker.add(NodeConfig{NodeName: "a", MetricName: "pump_speed_rpm", Labels: map[string]string{"pump": "1"}}))
+	assert.Error(t, checker.add(NodeConfig{NodeName: "b", MetricName: "pump_speed_rpm", Labels: map[string]string{"pump": "1"}}))
+	assert.Error(t, checker.add(NodeConfig{NodeName: "c", MetricName: "pump_speed_rpm", Labels: map[string]string{"line": "1"}}))
+
+	// a node that was refused isn't counted against later ones
+	assert.Error(t, checker.add(NodeConfig{NodeName: "d", MetricName: "tank_level", Labels: map[string]string{"tank-id": "1"}}))
+	assert.NoError(t, checker.add(NodeConfig{NodeName: "e", MetricName: "tank_level"}))
+}
+
+func TestSeriesName(t *testing.T) {
+	assert.Equal(t, "foo", seriesName("foo", nil))
+	assert.Equal(t, `foo{a="1",b="x"}`, seriesName("foo", map[string]string{"b": "x", "a": "1"}))
+}
+
+func TestMetricTypes(t *testing.T) {
+	yaml := `
+- nodeName: ns=1;s=Pieces
+  metricName: pieces_total
+  type: counter
+  counterMax: 65535
+- nodeName: ns=1;s=Vibration
+  metricName: vibration_mm_s
+  type: histogram
+  buckets: [0.5, 1, 2, 5]
+- nodeName: ns=1;s=Flow
+  metricName: flow_l_min
+  type: summary
+  objectives: {0.5: 0.05, 0.99: 0.001}
+- nodeName: ns=1;s=Level
+  metricName: level_percent
+`
+	nodes, err := parseConfigYAML(strings.NewReader(yaml))
+	assert.NoError(t, err)
+	assert.Equal(t, map[float64]float64{0.5: 0.05, 0.99: 0.001}, nodes[2].Objectives)
+
+	handlerMap, err := createMetrics(&nodes, nil, prometheus.NewRegistry())
+	assert.NoError(t, err)
+	assert.IsType(t, OpcCounterHandler{}, handlerMap["ns=1;s=Pieces"][0].handler)
+	assert.IsType(t, OpcObserverHandler{}, handlerMap["ns=1;s=Vibration"][0].handler)
+	assert.IsType(t, OpcObserverHandler{}, handlerMap["ns=1;s=Flow"][0].handler)
+	assert.IsType(t, OpcValueHandler{}, handlerMap["ns=1;s=Level"][0].handler)
+}
+
+func TestMetricTypeErrors(t *testing.T) {
+	badConfigs := [][]NodeConfig{
+		{{NodeName: "ns=1;s=a", MetricName: "foo", Type: "meter"}},
+		{{NodeName: "ns=1;s=a", MetricName: "foo", Type: "counter", ExtractBit: 3}},
+		{{NodeName: "ns=1;s=a", MetricName: "foo", ExtractBit: "3"}},
+		{{NodeName: "ns=1;s=a", MetricName: "foo", ExtractBit: -1}},
+		{ // one metric name, two types
+			{NodeName: "ns=1;s=a", MetricName: "foo", Type: "counter", Labels: map[string]string{"n": "a"}},
+			{NodeName: "ns=1;s=b", MetricName: "foo", Type: "gauge", Labels: map[string]string{"n": "b"}},
+		},
+	}
+	for _, nodes := range badConfigs {
+		_, err := createMetrics(&nodes, nil, prometheus.NewRegistry())
+		assert.Error(t, err, "%+v", nodes)
+	}
+}
+
+func TestMetricFactoryRemove(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	factory := NewMetricFactory(nil, registry)
+	_, err := factory.Gauge("pump_speed_rpm", "Speed", map[string]string{"pump": "1"})
+	assert.NoError(t, err)
+	_, err = factory.Gauge("pump_speed_rpm", "Speed", map[string]string{"pump": "2"})
+	assert.NoError(t, err)
+
+	factory.Remove("pump_speed_rpm", map[string]string{"pump": "1"})
+	expected := `
+# HELP pump_speed_rpm Speed
+# TYPE pump_speed_rpm gauge
+pump_speed_rpm{pump="2"} 0
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "pump_speed_rpm"))
+
+	// Once the last series is gone, the metric can be created again as another type
+	factory.Remove("pump_speed_rpm", map[string]string{"pump": "2"})
+	_, err = factory.Counter("pump_speed_rpm", "Speed", map[string]string{"pump": "2"})
+	assert.NoError(t, err)
+	factory.Remove("no_such_metric", nil)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+func runMigrateConfig(args []string) error {
+	flags := newOfflineFlagSet("migrate-config", "Convert a config file to the versioned format. Exporter flags given here are written to the file as settings.")
+	var flagNames []string
+	for _, documentFlag := range documentFlags {
+		flagNames = append(flagNames, documentFlag.name)
+	}
+	addExporterFlags(flags, append([]string{"config"}, flagNames...))
+	output := flags.String("output", "", "File to write the config to (default standard output)")
+	flags.Parse(args)
+	if *nodeListFile == "" {
+		return fmt.Errorf("Requires -config")
+	}
+
+	content, err := ioutil.ReadFile(*nodeListFile)
+	if err != nil {
+		return err
+	}
+	document, err := migrateConfig(content)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	if err := document.setFlagValues(values); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "# Migrated from %s\n", filepath.Base(*nodeListFile))
+	if err := yaml.NewEncoder(&out).Encode(document); err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err := os.Stdout.Write(out.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(*output, out.Bytes(), 0644)
+}
+
+// Turn a config in any of the formats parseConfig() reads into a versioned config document
+func migrateConfig(content []byte) (*ConfigDocument, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	switch doc.(type) {
+	case []interface{}:
+		document := &ConfigDocument{Version: configVersion}
+		if err := yaml.UnmarshalStrict(content, &document.Nodes); err != nil {
+			return nil, err
+		}
+		return document, nil
+	case map[interface{}]interface{}:
+		if _, ok := doc.(map[interface{}]interface{})["version"]; ok {
+			return parseConfigDocument(content)
+		}
+		var config Config
+		if err := yaml.UnmarshalStrict(content, &config); err != nil {
+			return nil, err
+		}
+		return &ConfigDocument{Version: configVersion, Include: config.Include, Templates: config.Templates, Servers: config.Servers, Modules: config.Modules}, nil
+	default:
+		return nil, fmt.Errorf("Config must be a list of nodes, or a document with a list of servers")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	legacy := `
+- nodeName: ns=1;s=Voltmeter
+  metricName: circuit_input_volts
+- nodeName: ns=1;s=CircuitBreakerStates
+  extractBit: 3
+  metricName: circuit_breaker_three_tripped
+`
+	document, err := migrateConfig([]byte(legacy))
+	assert.NoError(t, err)
+	assert.NoError(t, document.setFlagValues(map[string]string{"endpoint": "opc.tcp://plc1:4840", "buffer-size": "128", "strict-nodes": "true"}))
+	content, err := yaml.Marshal(document)
+	assert.NoError(t, err)
+
+	// the migrated config reads back the same, with the flags as settings
+	config, err := parseConfig(strings.NewReader(string(content)))
+	assert.NoError(t, err)
+	assert.Len(t, config.Servers, 1)
+	assert.Len(t, config.Servers[0].Nodes, 2)
+	assert.Equal(t, 3, config.Servers[0].Nodes[1].ExtractBit)
+	assert.Equal(t, map[string]string{"endpoint": "opc.tcp://plc1:4840", "buffer-size": "128", "strict-nodes": "true"}, config.settings)
+}
+
+func TestMigrateServersConfig(t *testing.T) {
+	servers := `
+servers:
+  - name: press1
+    endpoint: opc.tcp://plc1:4840
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: press_temperature
+`
+	document, err := migrateConfig([]byte(servers))
+	assert.NoError(t, err)
+	assert.Equal(t, configVersion, document.Version)
+	assert.Len(t, document.Servers, 1)
+	assert.Equal(t, "opc.tcp://plc1:4840", document.Servers[0].Endpoint)
+
+	document, err = migrateConfig([]byte("include: [more.yaml]\nservers:\n  - name: press1\n    nodes: []\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"more.yaml"}, document.Include)
+
+	_, err = migrateConfig([]byte("servers:\n  - name: press1\n    nodez: []\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// MonitoringConfig sets how the server samples a node and reports its changes.
+// Empty fields take the node defaults, and then the OPC UA defaults.
+type MonitoringConfig struct {
+	PublishingInterval time.Duration `yaml:"publishingInterval,omitempty"` // How often the server sends changes, 1s by default. Nodes are grouped into a subscription per interval.
+	SamplingInterval   time.Duration `yaml:"samplingInterval,omitempty"`   // How often the server samples the node. By default as fast as it practically can.
+	QueueSize          uint32        `yaml:"queueSize,omitempty"`          // Changes the server keeps between publishes, 10 by default
+	Discard            string        `yaml:"discard,omitempty"`            // Which change to drop when the queue is full: oldest (the default) or newest
+	Trigger            string        `yaml:"trigger,omitempty"`            // The changes to report: Status, StatusValue (the default) or StatusValueTimestamp
+	Deadband           string        `yaml:"deadband,omitempty"`           // none (the default), absolute, or percent of the node's EURange
+	DeadbandValue      float64       `yaml:"deadbandValue,omitempty"`      // The smallest change of value to report
+}
+
+const defaultPublishingInterval = time.Second
+const defaultQueueSize = 10
+
+var dataChangeTriggers = map[string]ua.DataChangeTrigger{
+	"Status":               ua.DataChangeTriggerStatus,
+	"StatusValue":          ua.DataChangeTriggerStatusValue,
+	"StatusValueTimestamp": ua.DataChangeTriggerStatusValueTimestamp,
+}
+
+var deadbandTypes = map[string]ua.DeadbandType{
+	"none":     ua.DeadbandTypeNone,
+	"absolute": ua.DeadbandTypeAbsolute,
+	"percent":  ua.DeadbandTypePercent,
+}
+
+// Validate checks that the settings are known and in range
+func (m MonitoringConfig) Validate() error {
+	if m.PublishingInterval < 0 || m.SamplingInterval < 0 {
+		return fmt.Errorf("Intervals can't be negative")
+	}
+	if m.Discard != "" && m.Discard != "oldest" && m.Discard != "newest" {
+		return fmt.Errorf("Unsupported discard policy %q (expected oldest or newest)", m.Discard)
+	}
+	if _, ok := dataChangeTriggers[m.Trigger]; m.Trigger != "" && !ok {
+		return fmt.Errorf("Unsupported trigger %q (expected Status, StatusValue or StatusValueTimestamp)", m.Trigger)
+	}
+	if _, ok := deadbandTypes[m.Deadband]; m.Deadband != "" && !ok {
+		return fmt.Errorf("Unsupported deadband %q (expected none, absolute or percent)", m.Deadband)
+	}
+	if m.DeadbandValue < 0 {
+		return fmt.Errorf("deadbandValue can't be negative")
+	}
+	if m.DeadbandValue > 0 && (m.Deadband == "" || m.Deadband == "none") {
+		return fmt.Errorf("deadbandValue requires deadband absolute or percent")
+	}
+	if m.Deadband == "percent" && m.DeadbandValue > 100 {
+		return fmt.Errorf("A percent deadband can't be more than 100")
+	}
+	return nil
+}
+
+// The settings with those that aren't set taken from the defaults. The deadband and its value go together.
+func (m MonitoringConfig) withDefaults(defaults MonitoringConfig) MonitoringConfig {
+	if m.PublishingInterval == 0 {
+		m.PublishingInterval = defaults.PublishingInterval
+	}
+	if m.SamplingInterval == 0 {
+		m.SamplingInterval = defaults.SamplingInterval
+	}
+	if m.QueueSize == 0 {
+		m.QueueSize = defaults.QueueSize
+	}
+	if m.Discard == "" {
+		m.Discard = defaults.Discard
+	}
+	if m.Trigger == "" {
+		m.Trigger = defaults.Trigger
+	}
+	if m.Deadband == "" && m.DeadbandValue == 0 {
+		m.Deadband = defaults.Deadband
+		m.DeadbandValue = defaults.DeadbandValue
+	}
+	return m
+}
+
+// The publishing interval of the subscription the node belongs in
+func (m MonitoringConfig) publishingInterval() time.Duration {
+	if m.PublishingInterval == 0 {
+		return defaultPublishingInterval
+	}
+	return m.PublishingInterval
+}
+
+// The DataChangeFilter for the trigger and deadband, or nil for the server's default of StatusValue without a deadband
+func (m MonitoringConfig) filter() *ua.ExtensionObject {
+	if m.Trigger == "" && (m.Deadband == "" || m.Deadband == "none") {
+		return nil
+	}
+	filter := &ua.DataChangeFilter{Trigger: ua.DataChangeTriggerStatusValue}
+	if m.Trigger != "" {
+		filter.Trigger = dataChangeTriggers[m.Trigger]
+	}
+	if m.Deadband != "" {
+		filter.DeadbandType = uint32(deadbandTypes[m.Deadband])
+		filter.DeadbandValue = m.DeadbandValue
+	}
+	return &ua.ExtensionObject{
+		EncodingMask: ua.ExtensionObjectBinary,
+		TypeID:       ua.NewFourByteExpandedNodeID(0, id.DataChangeFilter_Encoding_DefaultBinary),
+		Value:        filter,
+	}
+}
+
+// The request to monitor the value of a node with these settings
+func (m MonitoringConfig) createRequest(nodeID *ua.NodeID, clientHandle uint32) *ua.MonitoredItemCreateRequest {
+	queueSize := m.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultQueueSize
+	}
+	return &ua.MonitoredItemCreateRequest{
+		ItemToMonitor: &ua.ReadValueID{
+			NodeID:       nodeID,
+			AttributeID:  ua.AttributeIDValue,
+			DataEncoding: &ua.QualifiedName{},
+		},
+		MonitoringMode: ua.MonitoringModeReporting,
+		RequestedParameters: &ua.MonitoringParameters{
+			ClientHandle:     clientHandle,
+			SamplingInterval: float64(m.SamplingInterval) / float64(time.Millisecond),
+			Filter:           m.filter(),
+			QueueSize:        queueSize,
+			DiscardOldest:    m.Discard != "newest",
+		},
+	}
+}
+
+// Check the monitoring settings of each node, and that the metrics of a node agree on them
+func validateNodeMonitoring(nodeConfigs []NodeConfig) error {
+	seen := make(map[string]NodeConfig)
+	for _, nodeConfig := range nodeConfigs {
+		if err := checkNodeMonitoring(nodeConfig, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the monitoring settings of a node, and compare them to those of the nodes seen so far by node ID
+func checkNodeMonitoring(nodeConfig NodeConfig, seen map[string]NodeConfig) error {
+	if err := nodeConfig.Monitoring.Validate(); err != nil {
+		return fmt.Errorf("Metric %s: %v", prefixedMetricName(nodeConfig.MetricName), err)
+	}
+	nodeName, err := canonicalNodeName(nodeConfig.NodeName)
+	if err != nil {
+		return nil // reported with the node's other problems
+	}
+	if other, ok := seen[nodeName]; ok && other.Monitoring != nodeConfig.Monitoring {
+		return fmt.Errorf("Metrics %s and %s of node %s have different monitoring settings",
+			prefixedMetricName(other.MetricName), prefixedMetricName(nodeConfig.MetricName), nodeName)
+	}
+	seen[nodeName] = nodeConfig
+	return nil
+}
+
+// The monitoring settings of a node in the map, which all its metrics share
+func (handlerMap HandlerMap) monitoring(nodeName string) MonitoringConfig {
+	records := handlerMap[nodeName]
+	if len(records) == 0 {
+		return MonitoringConfig{}
+	}
+	return records[0].config.Monitoring
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitoringConfigValidate(t *testing.T) {
+	valid := []MonitoringConfig{
+		{},
+		{PublishingInterval: 5 * time.Second, SamplingInterval: 500 * time.Millisecond, QueueSize: 1, Discard: "newest"},
+		{Trigger: "StatusValueTimestamp"},
+		{Deadband: "absolute", DeadbandValue: 0.5},
+		{Deadband: "percent", DeadbandValue: 2},
+		{Deadband: "none"},
+	}
+	for _, monitoring := range valid {
+		assert.NoError(t, monitoring.Validate(), "%+v", monitoring)
+	}
+	invalid := []MonitoringConfig{
+		{PublishingInterval: -time.Second},
+		{Discard: "latest"},
+		{Trigger: "Value"},
+		{Deadband: "relative", DeadbandValue: 1},
+		{DeadbandValue: 1},
+		{Deadband: "absolute", DeadbandValue: -1},
+		{Deadband: "percent", DeadbandValue: 101},
+	}
+	for _, monitoring := range invalid {
+		assert.Error(t, monitoring.Validate(), "%+v", monitoring)
+	}
+}
+
+func TestMonitoringConfigWithDefaults(t *testing.T) {
+	defaults := MonitoringConfig{PublishingInterval: 5 * time.Second, QueueSize: 5, Deadband: "percent", DeadbandValue: 1}
+	assert.Equal(t, defaults, MonitoringConfig{}.withDefaults(defaults))
+	assert.Equal(t,
+		MonitoringConfig{PublishingInterval: time.Second, QueueSize: 5, Deadband: "absolute", DeadbandValue: 0.1},
+		MonitoringConfig{PublishingInterval: time.Second, Deadband: "absolute", DeadbandValue: 0.1}.withDefaults(defaults))
+	assert.Equal(t, "none", MonitoringConfig{Deadband: "none"}.withDefaults(defaults).Deadband)
+}
+
+func TestMonitoringCreateRequest(t *testing.T) {
+	nodeID := ua.NewStringNodeID(1, "Temperature")
+	request := MonitoringConfig{}.createRequest(nodeID, 7)
+	assert.Equal(t, nodeID, request.ItemToMonitor.NodeID)
+	assert.Equal(t, uint32(7), request.RequestedParameters.ClientHandle)
+	assert.Equal(t, uint32(10), request.RequestedParameters.QueueSize)
+	assert.True(t, request.RequestedParameters.DiscardOldest)
+	assert.Nil(t, request.RequestedParameters.Filter)
+	assert.Equal(t, time.Second, MonitoringConfig{}.publishingInterval())
+
+	monitoring := MonitoringConfig{SamplingInterval: 250 * time.Millisecond, QueueSize: 3, Discard: "newest", Trigger: "StatusValueTimestamp", Deadband: "absolute", DeadbandValue: 0.5}
+	request = monitoring.createRequest(nodeID, 8)
+	assert.Equal(t, 250.0, request.RequestedParameters.SamplingInterval)
+	assert.Equal(t, uint32(3), request.RequestedParameters.QueueSize)
+	assert.False(t, request.RequestedParameters.DiscardOldest)
+	assert.Equal(t, &ua.DataChangeFilter{
+		Trigger:       ua.DataChangeTriggerStatusValueTimestamp,
+		DeadbandType:  uint32(ua.DeadbandTypeAbsolute),
+		DeadbandValue: 0.5,
+	}, request.RequestedParameters.Filter.Value)
+	_, err := ua.Encode(request)
+	assert.NoError(t, err)
+
+	filter := MonitoringConfig{Deadband: "percent", DeadbandValue: 2}.filter()
+	assert.Equal(t, &ua.DataChangeFilter{Trigger: ua.DataChangeTriggerStatusValue, DeadbandType: uint32(ua.DeadbandTypePercent), DeadbandValue: 2}, filter.Value)
+}
+
+func TestValidateNodeMonitoring(t *testing.T) {
+	assert.NoError(t, validateNodeMonitoring([]NodeConfig{
+		{NodeName: "ns=1;s=Temperature", MetricName: "temperature_celsius", Monitoring: MonitoringConfig{QueueSize: 5}},
+		{NodeName: "ns=1;s=Temperature", MetricName: "temperature_fahrenheit", Monitoring: MonitoringConfig{QueueSize: 5}},
+		{NodeName: "ns=1;s=Pressure", MetricName: "pressure_bar"},
+	}))
+	assert.EqualError(t, validateNodeMonitoring([]NodeConfig{
+		{NodeName: "ns=1;s=Temperature", MetricName: "temperature_celsius", Monitoring: MonitoringConfig{QueueSize: 5}},
+		{NodeName: "ns=1;s=Temperature", MetricName: "temperature_fahrenheit"},
+	}), "Metrics temperature_celsius and temperature_fahrenheit of node ns=1;s=Temperature have different monitoring settings")
+	assert.EqualError(t, validateNodeMonitoring([]NodeConfig{
+		{NodeName: "ns=1;s=Temperature", MetricName: "temperature_celsius", Monitoring: MonitoringConfig{Trigger: "Value"}},
+	}), `Metric temperature_celsius: Unsupported trigger "Value" (expected Status, StatusValue or StatusValueTimestamp)`)
+}
+
+func TestParseConfigMonitoring(t *testing.T) {
+	config, err := parseConfig(strings.NewReader(`
+version: 1
+defaults:
+  monitoring:
+    publishingInterval: 5s
+    deadband: percent
+    deadbandValue: 1
+nodes:
+  - nodeName: ns=1;s=Temperature
+    metricName: temperature_celsius
+  - nodeName: ns=1;s=Alarm
+    metricName: alarm
+    monitoring:
+      publishingInterval: 100ms
+      samplingInterval: 50ms
+      queueSize: 20
+      discard: newest
+      trigger: StatusValueTimestamp
+      deadband: none
+`))
+	assert.NoError(t, err)
+	nodes := config.Servers[0].Nodes
+	assert.Equal(t, MonitoringConfig{PublishingInterval: 5 * time.Second, Deadband: "percent", DeadbandValue: 1}, nodes[0].Monitoring)
+	assert.Equal(t, MonitoringConfig{
+		PublishingInterval: 100 * time.Millisecond,
+		SamplingInterval:   50 * time.Millisecond,
+		QueueSize:          20,
+		Discard:            "newest",
+		Trigger:            "StatusValueTimestamp",
+		Deadband:           "none",
+	}, nodes[1].Monitoring)
+}
+
+func TestHandlerMapReloadMonitoring(t *testing.T) {
+	factory := NewMetricFactory(nil, prometheus.NewRegistry())
+	handlerMap := make(HandlerMap)
+	assert.NoError(t, handlerMap.addNodes([]NodeConfig{
+		{NodeName: "ns=1;s=Temperature", MetricName: "temperature_celsius"},
+		{NodeName: "ns=1;s=Pressure", MetricName: "pressure_bar"},
+	}, factory))
+
+	monitoring := MonitoringConfig{PublishingInterval: 10 * time.Second}
+	newMap, err := handlerMap.reload([]NodeConfig{
+		{NodeName: "ns=1;s=Temperature", MetricName: "temperature_celsius", Monitoring: monitoring},
+		{NodeName: "ns=1;s=Pressure", MetricName: "pressure_bar"},
+	}, factory, "")
+	assert.NoError(t, err)
+	assert.Equal(t, handlerMap["ns=1;s=Temperature"][0].handler, newMap["ns=1;s=Temperature"][0].handler, "the metric is kept")
+	assert.Equal(t, monitoring, newMap.monitoring("ns=1;s=Temperature"))
+
+	added, removed := changedNodes(handlerMap, newMap)
+	assert.Equal(t, []string{"ns=1;s=Temperature"}, added)
+	assert.Equal(t, []string{"ns=1;s=Temperature"}, removed)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Results of checking a configured node against the server, reported in opcua_exporter_node_status
+const (
+	nodeStatusOK              = "ok"
+	nodeStatusNotFound        = "not_found"        // the server doesn't have the node
+	nodeStatusUnresolved      = "unresolved"       // a browse path or namespace URI couldn't be resolved
+	nodeStatusNotVariable     = "not_variable"     // the node is an Object, Method, etc. and has no value
+	nodeStatusNotReadable     = "not_readable"     // the AccessLevel doesn't allow reading the current value
+	nodeStatusUnsupportedType = "unsupported_type" // the value isn't numeric or boolean
+	nodeStatusArray           = "array"            // the value is an array rather than a single value
+	nodeStatusIncompatible    = "incompatible"     // the metric's settings don't fit the node's data type
+	nodeStatusError           = "error"            // the node's attributes couldn't be read
+	nodeStatusNotMonitored    = "not_monitored"    // the server refused to monitor the node, e.g. with its deadband
+	nodeStatusEUError         = "eu_error"         // the EU properties couldn't be read, or the metric couldn't be created from them
+)
+
+// Built-in data types that can't be turned into a metric value
+var unsupportedDataTypes = map[string]bool{"String": true, "DateTime": true, "Guid": true, "ByteString": true}
+
+var floatDataTypes = map[string]bool{"Float": true, "Double": true}
+
+// The attributes of a node that say whether it can be exported
+type nodeAttributes struct {
+	Status      ua.StatusCode // status of reading the NodeClass
+	NodeClass   ua.NodeClass
+	DataType    string
+	ValueRank   int32
+	AccessLevel ua.AccessLevelType
+}
+
+// The status last reported for each server, node and metric, so that the old series can be removed
+var nodeStatuses = make(map[[3]string]string)
+var nodeStatusMutex sync.Mutex
+
+func setNodeStatus(server string, nodeName string, metricName string, status string) {
+	nodeStatusMutex.Lock()
+	defer nodeStatusMutex.Unlock()
+	key := [3]string{server, nodeName, metricName}
+	if previous, ok := nodeStatuses[key]; ok && previous != status {
+		nodeStatusGauge.DeleteLabelValues(server, nodeName, metricName, previous)
+	}
+	nodeStatuses[key] = status
+	nodeStatusGauge.WithLabelValues(server, nodeName, metricName, status).Set(1)
+}
+
+// The node name a status is reported under: the name as configured, so that the status of a
+// browse path or namespace URI stays the same series once the name resolves to a node ID
+func statusNodeName(nodeConfig NodeConfig) string {
+	if nodeName, err := canonicalNodeName(nodeConfig.NodeName); err == nil {
+		return nodeName
+	}
+	return nodeConfig.NodeName
+}
+
+// Remove the status of a node that is no longer configured
+func deleteNodeStatus(server string, nodeName string, metricName string) {
+	nodeStatusMutex.Lock()
+	defer nodeStatusMutex.Unlock()
+	key := [3]string{server, nodeName, metricName}
+	if previous, ok := nodeStatuses[key]; ok {
+		nodeStatusGauge.DeleteLabelValues(server, nodeName, metricName, previous)
+		delete(nodeStatuses, key)
+	}
+}
+
+// Read the attributes of every node the exporter is about to subscribe to, and check that they
+// can be exported as configured. Nodes of the configured map that are missing from the resolved
+// one couldn't be resolved. Returns the number of nodes with problems, which are logged.
+func checkNodes(client *opcua.Client, server string, configured HandlerMap, resolved HandlerMap) (int, error) {
+	var nodeNames []string
+	var nodesToRead []*ua.ReadValueID
+	found := make(map[string]bool)
+	for nodeName, records := range resolved {
+		nodeID, err := ua.ParseNodeID(nodeName)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid node ID %s: %v", nodeName, err)
+		}
+		nodeNames = append(nodeNames, nodeName)
+		for _, attributeID := range []ua.AttributeID{ua.AttributeIDNodeClass, ua.AttributeIDDataType, ua.AttributeIDValueRank, ua.AttributeIDAccessLevel} {
+			nodesToRead = append(nodesToRead, &ua.ReadValueID{NodeID: nodeID, AttributeID: attributeID})
+		}
+		for _, record := range records {
+			found[seriesName(record.config.MetricName, record.config.Labels)] = true
+		}
+	}
+
+	problems := 0
+	for nodeName, records := range configured {
+		for _, record := range records {
+			if !found[seriesName(record.config.MetricName, record.config.Labels)] {
+				log.Printf("Node %s for metric %s: the node name could not be resolved", nodeName, record.config.MetricName)
+				setNodeStatus(server, statusNodeName(record.config), record.config.MetricName, nodeStatusUnresolved)
+				problems++
+			}
+		}
+	}
+	if len(nodesToRead) == 0 {
+		return problems, nil
+	}
+
+	results, err := readChunked(client, nodesToRead, ua.TimestampsToReturnNeither)
+	if err != nil {
+		return 0, err
+	}
+	for i, nodeName := range nodeNames {
+		attributes := readNodeAttributes(results[i*4 : i*4+4])
+		for _, record := range resolved[nodeName] {
+			status, problem := checkNode(record.config, attributes)
+			setNodeStatus(server, statusNodeName(record.config), record.config.MetricName, status)
+			if status != nodeStatusOK {
+				log.Printf("Node %s for metric %s: %s", nodeName, record.config.MetricName, problem)
+				problems++
+			}
+		}
+	}
+	return problems, nil
+}
+
+// Collect the NodeClass, DataType, ValueRank and AccessLevel, read in that order
+func readNodeAttributes(results []*ua.DataValue) nodeAttributes {
+	attribute := func(i int) interface{} {
+		if results[i].Status != ua.StatusOK || results[i].Value == nil {
+			return nil
+		}
+		return results[i].Value.Value()
+	}
+	attributes := nodeAttributes{Status: results[0].Status, ValueRank: -1, AccessLevel: ua.AccessLevelTypeCurrentRead}
+	if nodeClass, ok := attribute(0).(int32); ok {
+		attributes.NodeClass = ua.NodeClass(nodeClass)
+	}
+	if dataType, ok := attribute(1).(*ua.NodeID); ok {
+		attributes.DataType = dataTypeName(dataType)
+	}
+	if valueRank, ok := attribute(2).(int32); ok {
+		attributes.ValueRank = valueRank
+	}
+	if accessLevel, ok := attribute(3).(uint8); ok {
+		attributes.AccessLevel = ua.AccessLevelType(accessLevel)
+	}
+	return attributes
+}
+
+// Check that a node's value can be exported as the node config says. Returns the status, and what's wrong if it isn't ok.
+func checkNode(nodeConfig NodeConfig, attributes nodeAttributes) (string, string) {
+	switch {
+	case attributes.Status == ua.StatusBadNodeIDUnknown:
+		return nodeStatusNotFound, "the node doesn't exist on the server"
+	case attributes.Status != ua.StatusOK:
+		return nodeStatusError, fmt.Sprintf("error reading the node's attributes: %v", attributes.Status)
+	case attributes.NodeClass != ua.NodeClassVariable:
+		return nodeStatusNotVariable, fmt.Sprintf("the node is %s, not a Variable", strings.TrimPrefix(attributes.NodeClass.String(), "NodeClass"))
+	case attributes.AccessLevel&ua.AccessLevelTypeCurrentRead == 0:
+		return nodeStatusNotReadable, "the node's value can't be read"
+	case unsupportedDataTypes[attributes.DataType]:
+		return nodeStatusUnsupportedType, fmt.Sprintf("%s values can't be exported", attributes.DataType)
+	case attributes.ValueRank >= 0:
+		return nodeStatusArray, "the node's value is an array"
+	case nodeConfig.ExtractBit != nil && (floatDataTypes[attributes.DataType] || attributes.DataType == "Boolean"):
+		return nodeStatusIncompatible, fmt.Sprintf("extractBit needs an integer node, not %s", attributes.DataType)
+	case nodeConfig.Type == metricTypeCounter && attributes.DataType == "Boolean":
+		return nodeStatusIncompatible, "a Boolean node can't be a counter"
+	}
+	return nodeStatusOK, ""
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckNode(t *testing.T) {
+	variable := func(dataType string) nodeAttributes {
+		return nodeAttributes{
+			Status:      ua.StatusOK,
+			NodeClass:   ua.NodeClassVariable,
+			DataType:    dataType,
+			ValueRank:   -1,
+			AccessLevel: ua.AccessLevelTypeCurrentRead,
+		}
+	}
+	gauge := NodeConfig{MetricName: "temperature"}
+	bit := NodeConfig{MetricName: "breaker_tripped", ExtractBit: 3}
+
+	testCases := []struct {
+		config     NodeConfig
+		attributes nodeAttributes
+		expected   string
+	}{
+		{gauge, variable("Double"), nodeStatusOK},
+		{bit, variable("UInt16"), nodeStatusOK},
+		{gauge, nodeAttributes{Status: ua.StatusBadNodeIDUnknown}, nodeStatusNotFound},
+		{gauge, nodeAttributes{Status: ua.StatusBadTimeout}, nodeStatusError},
+		{gauge, nodeAttributes{Status: ua.StatusOK, NodeClass: ua.NodeClassObject}, nodeStatusNotVariable},
+		{gauge, nodeAttributes{Status: ua.StatusOK, NodeClass: ua.NodeClassVariable, DataType: "Double", ValueRank: -1}, nodeStatusNotReadable},
+		{gauge, variable("String"), nodeStatusUnsupportedType},
+		{gauge, nodeAttributes{Status: ua.StatusOK, NodeClass: ua.NodeClassVariable, DataType: "Double", ValueRank: 1, AccessLevel: ua.AccessLevelTypeCurrentRead}, nodeStatusArray},
+		{bit, variable("Float"), nodeStatusIncompatible},
+		{NodeConfig{MetricName: "running_total", Type: metricTypeCounter}, variable("Boolean"), nodeStatusIncompatible},
+	}
+	for _, tc := range testCases {
+		status, problem := checkNode(tc.config, tc.attributes)
+		assert.Equal(t, tc.expected, status, "%+v", tc.attributes)
+		assert.Equal(t, status == nodeStatusOK, problem == "")
+	}
+}
+
+func TestSetNodeStatus(t *testing.T) {
+	setNodeStatus("line1", "ns=1;s=Temperature", "temperature", nodeStatusNotFound)
+	setNodeStatus("line2", "ns=1;s=Temperature", "temperature", nodeStatusNotFound)
+	setNodeStatus("line1", "ns=1;s=Temperature", "temperature", nodeStatusOK)
+	assert.Equal(t, 1.0, testutil.ToFloat64(nodeStatusGauge.WithLabelValues("line1", "ns=1;s=Temperature", "temperature", nodeStatusOK)))
+
+	// the old status is removed rather than left at 1, and other servers' statuses are left alone
+	assert.True(t, nodeStatusGauge.DeleteLabelValues("line1", "ns=1;s=Temperature", "temperature", nodeStatusOK))
+	assert.False(t, nodeStatusGauge.DeleteLabelValues("line1", "ns=1;s=Temperature", "temperature", nodeStatusNotFound))
+	deleteNodeStatus("line2", "ns=1;s=Temperature", "temperature")
+	assert.False(t, nodeStatusGauge.DeleteLabelValues("line2", "ns=1;s=Temperature", "temperature", nodeStatusNotFound))
+}
+
+// A symbolic node keeps its status series once its name resolves
+func TestStatusNodeName(t *testing.T) {
+	nodeConfig := NodeConfig{NodeName: "/Objects/Line1/Temperature", MetricName: "temperature"}
+	configured := make(HandlerMap)
+	configured[statusNodeName(nodeConfig)] = []handlerMapRecord{{config: nodeConfig}}
+	problems, err := checkNodes(nil, "line3", configured, HandlerMap{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, problems)
+	nodeName := statusNodeName(nodeConfig)
+	assert.Equal(t, 1.0, testutil.ToFloat64(nodeStatusGauge.WithLabelValues("line3", nodeName, "temperature", nodeStatusUnresolved)))
+
+	// as checkNodes does for the resolved node
+	setNodeStatus("line3", statusNodeName(nodeConfig), "temperature", nodeStatusOK)
+	assert.False(t, nodeStatusGauge.DeleteLabelValues("line3", nodeName, "temperature", nodeStatusUnresolved))
+	deleteNodeStatus("line3", nodeName, "temperature")
+	assert.Equal(t, "ns=1;s=Temperature", statusNodeName(NodeConfig{NodeName: "ns=1;s=Temperature"}))
+}
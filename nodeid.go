@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// parseNodeID parses a node ID such as ns=1;s=Voltmeter. Unlike ua.ParseNodeID, it doesn't
+// take anything without an identifier type, such as Voltmeter or ns=1;Voltmeter, as a string ID.
+func parseNodeID(nodeName string) (*ua.NodeID, error) {
+	identifier := nodeName
+	if strings.HasPrefix(identifier, "ns=") {
+		i := strings.Index(identifier, ";")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid node ID %q: no identifier after the namespace", nodeName)
+		}
+		identifier = identifier[i+1:]
+	}
+	if len(identifier) < 3 || identifier[1] != '=' || !strings.Contains("isgb", identifier[:1]) {
+		return nil, fmt.Errorf("Invalid node ID %q: expected ns=<index>;<i, s, g or b>=<identifier>", nodeName)
+	}
+	nodeID, err := ua.ParseNodeID(nodeName)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid node ID %q: %v", nodeName, err)
+	}
+	return nodeID, nil
+}
+
+// canonicalNodeName returns the form of the node name that the HandlerMap is keyed on. Node IDs
+// are written the way the server reports them, so ns=0;i=2258 becomes i=2258, and symbolic names
+// are checked here but kept as they are until they are resolved on the server.
+func canonicalNodeName(nodeName string) (string, error) {
+	nodeName = strings.TrimSpace(nodeName)
+	if !isSymbolicNodeName(nodeName) {
+		nodeID, err := parseNodeID(nodeName)
+		if err != nil {
+			return "", err
+		}
+		return nodeID.String(), nil
+	}
+
+	_, rest, err := splitNamespaceURI(nodeName)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(rest, "/") {
+		_, err = parseBrowsePath(nodeName)
+	} else {
+		_, err = parseNodeID(rest)
+	}
+	if err != nil {
+		return "", err
+	}
+	return nodeName, nil
+}
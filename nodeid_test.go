@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalNodeName(t *testing.T) {
+	testCases := map[string]string{
+		"ns=0;i=2258":                       "i=2258",
+		"i=2258":                            "i=2258",
+		"ns=1;s=Voltmeter":                  "ns=1;s=Voltmeter",
+		" ns=01;i=5 ":                       "ns=1;i=5",
+		"ns=2;s=Channel1.PLC1.Temperature":  "ns=2;s=Channel1.PLC1.Temperature",
+		"nsu=urn:line1;s=Press.Temperature": "nsu=urn:line1;s=Press.Temperature",
+		"/Objects/Line1/Press/Temperature":  "/Objects/Line1/Press/Temperature",
+	}
+	for nodeName, expected := range testCases {
+		canonical, err := canonicalNodeName(nodeName)
+		assert.NoError(t, err, nodeName)
+		assert.Equal(t, expected, canonical, nodeName)
+	}
+
+	for _, nodeName := range []string{"", "Voltmeter", "ns=1;Voltmeter", "ns=x;s=1", "ns=1;i=abc", "ns=1,s=Foo", "ns=1;x=1", "nsu=urn:line1;Press", "/Objects//Press"} {
+		_, err := canonicalNodeName(nodeName)
+		assert.Error(t, err, nodeName)
+	}
+}
+
+func TestHandleUnmappedMessage(t *testing.T) {
+	handler := &mockHandler{}
+	handlerMap := HandlerMap{"i=2258": {{config: NodeConfig{MetricName: "server_time"}, handler: handler}}}
+
+	msg := makeTestMessage(ua.NewNumericNodeID(0, 2258))
+	handleMessage(&msg, handlerMap, "")
+	assert.True(t, handler.called)
+
+	before := testutil.ToFloat64(unmappedMessageCounter.WithLabelValues("", "ns=1;s=Unknown"))
+	msg = makeTestMessage(ua.NewStringNodeID(1, "Unknown"))
+	handleMessage(&msg, handlerMap, "")
+	assert.Equal(t, before+1, testutil.ToFloat64(unmappedMessageCounter.WithLabelValues("", "ns=1;s=Unknown")))
+}
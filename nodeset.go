@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// The parts of a UANodeSet2 XML document needed to find the Variables and their browse paths
+type nodeSet struct {
+	NamespaceURIs []string       `xml:"NamespaceUris>Uri"`
+	Aliases       []nodeSetAlias `xml:"Aliases>Alias"`
+	Objects       []nodeSetNode  `xml:"UAObject"`
+	Variables     []nodeSetNode  `xml:"UAVariable"`
+	ObjectTypes   []nodeSetNode  `xml:"UAObjectType"`
+	nodes         map[string]*nodeSetNode
+	children      map[string][]string
+}
+
+type nodeSetAlias struct {
+	Alias  string `xml:"Alias,attr"`
+	NodeID string `xml:",chardata"`
+}
+
+type nodeSetNode struct {
+	NodeID       string             `xml:"NodeId,attr"`
+	BrowseName   string             `xml:"BrowseName,attr"`
+	ParentNodeID string             `xml:"ParentNodeId,attr"`
+	DataType     string             `xml:"DataType,attr"`
+	AccessLevel  string             `xml:"AccessLevel,attr"`
+	References   []nodeSetReference `xml:"References>Reference"`
+	nodeClass    string
+}
+
+type nodeSetReference struct {
+	ReferenceType string `xml:"ReferenceType,attr"`
+	IsForward     string `xml:"IsForward,attr"`
+	Target        string `xml:",chardata"`
+}
+
+// Standard reference types that NodeSets may refer to by name rather than by node ID
+var referenceTypeIDs = map[string]uint32{
+	"Organizes":           id.Organizes,
+	"HasComponent":        id.HasComponent,
+	"HasOrderedComponent": id.HasOrderedComponent,
+	"HasProperty":         id.HasProperty,
+	"HasTypeDefinition":   id.HasTypeDefinition,
+}
+
+// Reference types that make up the instance hierarchy. HasProperty is left out on purpose.
+var nodeSetHierarchicalReferences = map[string]bool{
+	ua.NewNumericNodeID(0, id.Organizes).String():           true,
+	ua.NewNumericNodeID(0, id.HasComponent).String():        true,
+	ua.NewNumericNodeID(0, id.HasOrderedComponent).String(): true,
+}
+
+var hasTypeDefinition = ua.NewNumericNodeID(0, id.HasTypeDefinition).String()
+
+// Object types that say nothing about what an object is
+var genericObjectTypes = map[string]bool{
+	ua.NewNumericNodeID(0, id.BaseObjectType).String(): true,
+	ua.NewNumericNodeID(0, id.FolderType).String():     true,
+}
+
+// Parse a UANodeSet2 XML document and index its nodes by ID
+func parseNodeSet(r io.Reader) (*nodeSet, error) {
+	var ns nodeSet
+	if err := xml.NewDecoder(r).Decode(&ns); err != nil {
+		return nil, fmt.Errorf("Error parsing NodeSet XML: %v", err)
+	}
+
+	ns.nodes = make(map[string]*nodeSetNode)
+	for _, group := range []struct {
+		nodes     []nodeSetNode
+		nodeClass string
+	}{{ns.Objects, "Object"}, {ns.Variables, "Variable"}, {ns.ObjectTypes, "ObjectType"}} {
+		for i := range group.nodes {
+			node := &group.nodes[i]
+			node.nodeClass = group.nodeClass
+			ns.nodes[ns.key(node.NodeID)] = node
+		}
+	}
+
+	// Link each node to its parent, whichever side of the reference it was declared on
+	ns.children = make(map[string][]string)
+	linked := make(map[string]bool)
+	link := func(parent string, child string) {
+		if !linked[parent+" "+child] {
+			linked[parent+" "+child] = true
+			ns.children[parent] = append(ns.children[parent], child)
+		}
+	}
+	for _, group := range [][]nodeSetNode{ns.Objects, ns.Variables} {
+		for _, node := range group {
+			nodeKey := ns.key(node.NodeID)
+			for _, ref := range node.References {
+				if !nodeSetHierarchicalReferences[ns.key(ref.ReferenceType)] {
+					continue
+				}
+				if ref.IsForward == "false" {
+					link(ns.key(ref.Target), nodeKey)
+				} else {
+					link(nodeKey, ns.key(ref.Target))
+				}
+			}
+			if node.ParentNodeID != "" {
+				link(ns.key(node.ParentNodeID), nodeKey)
+			}
+		}
+	}
+
+	// Sort by browse name, so that the generated config is easy to find your way around
+	for _, children := range ns.children {
+		sort.Slice(children, func(i, j int) bool {
+			return ns.sortName(children[i]) < ns.sortName(children[j])
+		})
+	}
+	return &ns, nil
+}
+
+// Resolve aliases and standard reference type names, and normalise a node ID from the document
+// so that i=85 and ns=0;i=85 compare equal. Unparsable IDs are returned as they are.
+func (ns *nodeSet) key(nodeID string) string {
+	nodeID = strings.TrimSpace(nodeID)
+	for _, alias := range ns.Aliases {
+		if alias.Alias == nodeID {
+			nodeID = strings.TrimSpace(alias.NodeID)
+			break
+		}
+	}
+	if refTypeID, ok := referenceTypeIDs[nodeID]; ok {
+		return ua.NewNumericNodeID(0, refTypeID).String()
+	}
+	if parsed, err := ua.ParseNodeID(nodeID); err == nil {
+		return parsed.String()
+	}
+	return nodeID
+}
+
+// The data type name of a Variable, as reported by the browse command
+func (ns *nodeSet) dataTypeName(node *nodeSetNode) string {
+	if node.DataType == "" {
+		return "BaseDataType"
+	}
+	dataType, err := ua.ParseNodeID(ns.key(node.DataType))
+	if err != nil {
+		return node.DataType
+	}
+	return dataTypeName(dataType)
+}
+
+func (ns *nodeSet) sortName(nodeKey string) string {
+	if node, ok := ns.nodes[nodeKey]; ok {
+		return nodeSetBrowseName(node.BrowseName) + " " + nodeKey
+	}
+	return nodeKey
+}
+
+// Strip the namespace index from a browse name such as 1:Temperature
+func nodeSetBrowseName(browseName string) string {
+	if i := strings.Index(browseName, ":"); i >= 0 {
+		if _, err := strconv.Atoi(browseName[:i]); err == nil {
+			return browseName[i+1:]
+		}
+	}
+	return browseName
+}
+
+// The object type of an Object, if it is a specific one
+func (ns *nodeSet) typeDefinition(node *nodeSetNode) string {
+	for _, ref := range node.References {
+		if ns.key(ref.ReferenceType) == hasTypeDefinition && ref.IsForward != "false" {
+			typeID := ns.key(ref.Target)
+			if !genericObjectTypes[typeID] {
+				return typeID
+			}
+		}
+	}
+	return ""
+}
+
+// Label name for instances of an object type, e.g. PumpType gives pump
+func (ns *nodeSet) instanceLabelName(typeID string) string {
+	if objectType, ok := ns.nodes[typeID]; ok {
+		name := strings.TrimSuffix(nodeSetBrowseName(objectType.BrowseName), "Type")
+		if name != "" {
+			return strings.TrimPrefix(metricNameFromPath([]string{name}), "_")
+		}
+	}
+	return "instance"
+}
+
+// Generate node configs for the readable numeric and boolean Variables below the root node.
+// Sibling Objects of the same type, such as Pump1 and Pump2 of PumpType, are told apart
+// by a label instead of by their metric names.
+func (ns *nodeSet) generateNodeConfigs(root string, metricPrefix string) []generatedNode {
+	var generated []generatedNode
+	visited := make(map[string]bool)
+	var walk func(nodeKey string, nameParts []string, browsePath []string, labels map[string]string)
+	walk = func(nodeKey string, nameParts []string, browsePath []string, labels map[string]string) {
+		visited[nodeKey] = true
+
+		typeCounts := make(map[string]int)
+		for _, childKey := range ns.children[nodeKey] {
+			if child, ok := ns.nodes[childKey]; ok && child.nodeClass == "Object" {
+				if typeID := ns.typeDefinition(child); typeID != "" {
+					typeCounts[typeID]++
+				}
+			}
+		}
+
+		for _, childKey := range ns.children[nodeKey] {
+			child, ok := ns.nodes[childKey]
+			if !ok || visited[childKey] {
+				continue
+			}
+			name := nodeSetBrowseName(child.BrowseName)
+			childPath := append(append([]string{}, browsePath...), name)
+
+			switch child.nodeClass {
+			case "Object":
+				typeID := ns.typeDefinition(child)
+				labelName := ns.instanceLabelName(typeID)
+				if _, taken := labels[labelName]; typeCounts[typeID] > 1 && !taken {
+					childLabels := map[string]string{labelName: name}
+					for k, v := range labels {
+						childLabels[k] = v
+					}
+					walk(childKey, nameParts, childPath, childLabels)
+				} else {
+					walk(childKey, append(append([]string{}, nameParts...), name), childPath, labels)
+				}
+			case "Variable":
+				visited[childKey] = true
+				dataType := ns.dataTypeName(child)
+				if !matchesAny(defaultDiscoveryFilters, name, "Variable", dataType) || !nodeSetReadable(child) {
+					continue
+				}
+				metricName := metricNameFromPath(append(append([]string{}, nameParts...), name))
+				if metricPrefix != "" {
+					metricName = metricPrefix + "_" + metricName
+				}
+				nodeConfig := NodeConfig{NodeName: ns.nodeName(childKey), MetricName: metricName}
+				if len(labels) > 0 {
+					nodeConfig.Labels = labels
+				}
+				generated = append(generated, newGeneratedNode(nodeConfig, strings.Join(childPath, "/"), dataType))
+			}
+		}
+	}
+	walk(root, nil, nil, nil)
+	return generated
+}
+
+// The root is a node ID, or a browse path from the Root folder as for discovery
+func (ns *nodeSet) resolveRoot(root string) (string, error) {
+	if !strings.HasPrefix(root, "/") {
+		return ns.key(root), nil
+	}
+	if err := checkRootName(root); err != nil {
+		return "", err
+	}
+	path, err := parseBrowsePath(root)
+	if err != nil {
+		return "", err
+	}
+	nodeKey := ua.NewNumericNodeID(0, rootFolderIDs[path.Names[0].Name]).String()
+	for _, name := range path.Names[1:] {
+		next := ""
+		for _, childKey := range ns.children[nodeKey] {
+			if child, ok := ns.nodes[childKey]; ok && nodeSetBrowseName(child.BrowseName) == name.Name {
+				next = childKey
+				break
+			}
+		}
+		if next == "" {
+			return "", fmt.Errorf("Root %s not found in NodeSet: no %s below %s", root, name.Name, nodeKey)
+		}
+		nodeKey = next
+	}
+	return nodeKey, nil
+}
+
+// Variables are readable unless their AccessLevel says otherwise
+func nodeSetReadable(node *nodeSetNode) bool {
+	if node.AccessLevel == "" {
+		return true
+	}
+	accessLevel, err := strconv.Atoi(node.AccessLevel)
+	return err != nil || ua.AccessLevelType(accessLevel)&ua.AccessLevelTypeCurrentRead != 0
+}
+
+// The node name for a node of the NodeSet, with the namespace URI instead of the NodeSet's own
+// namespace index, which the server is likely to number differently
+func (ns *nodeSet) nodeName(nodeKey string) string {
+	nodeID, err := ua.ParseNodeID(nodeKey)
+	if err != nil || nodeID.Namespace() == 0 || int(nodeID.Namespace()) > len(ns.NamespaceURIs) {
+		return nodeKey
+	}
+	identifier := nodeKey[strings.Index(nodeKey, ";")+1:]
+	return fmt.Sprintf("nsu=%s;%s", ns.NamespaceURIs[nodeID.Namespace()-1], identifier)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseTestNodeSet(t *testing.T) *nodeSet {
+	f, err := os.Open("testdata/line1.NodeSet2.xml")
+	assert.NoError(t, err)
+	defer f.Close()
+	ns, err := parseNodeSet(f)
+	assert.NoError(t, err)
+	return ns
+}
+
+func TestNodeSetGenerateNodeConfigs(t *testing.T) {
+	ns := parseTestNodeSet(t)
+	root, err := ns.resolveRoot("i=85")
+	assert.NoError(t, err)
+	generated := ns.generateNodeConfigs(root, "")
+
+	var nodeConfigs []NodeConfig
+	for _, node := range generated {
+		nodeConfigs = append(nodeConfigs, node.Config)
+	}
+	// the string, the write-only setpoint, the EURange property and the type's own Speed are left out,
+	// and the two pumps share a metric told apart by a label named after their type
+	assert.Equal(t, []NodeConfig{
+		{NodeName: "nsu=http://example.com/Line1/;s=Line1.AlarmWord", MetricName: "line1_alarm_word"},
+		{NodeName: "nsu=http://example.com/Line1/;s=Line1.Pump1.Speed", MetricName: "line1_speed", Labels: map[string]string{"pump": "Pump1"}},
+		{NodeName: "nsu=http://example.com/Line1/;s=Line1.Pump2.Speed", MetricName: "line1_speed", Labels: map[string]string{"pump": "Pump2"}},
+	}, nodeConfigs)
+	assert.Equal(t, []string{"Line1/AlarmWord (UInt16)", "Possible bit vector: add extractBit to export a single bit, with one entry per bit"}, generated[0].Comments)
+	assert.Equal(t, []string{"Line1/Pump1/Speed (Double)"}, generated[1].Comments)
+	assert.NoError(t, validateNodeLabels(nodeConfigs))
+}
+
+func TestNodeSetResolveRoot(t *testing.T) {
+	ns := parseTestNodeSet(t)
+	root, err := ns.resolveRoot("/Objects/Line1")
+	assert.NoError(t, err)
+	assert.Equal(t, "ns=1;s=Line1", root)
+
+	generated := ns.generateNodeConfigs(root, "plant")
+	assert.Equal(t, "plant_alarm_word", generated[0].Config.MetricName)
+
+	_, err = ns.resolveRoot("/Objects/Line2")
+	assert.Error(t, err)
+	_, err = ns.resolveRoot("/Line1")
+	assert.Error(t, err)
+}
+
+func TestNodeSetConfigRoundTrip(t *testing.T) {
+	ns := parseTestNodeSet(t)
+	generated := ns.generateNodeConfigs("i=85", "")
+
+	var out bytes.Buffer
+	assert.NoError(t, writeConfigDocument(&out, "Generated from line1.NodeSet2.xml", generated))
+	document, err := parseConfigDocument(out.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, len(generated), len(document.Nodes))
+	assert.Equal(t, map[string]string{"pump": "Pump2"}, document.Nodes[2].Labels)
+}
+
+func TestNodeSetBrowseName(t *testing.T) {
+	assert.Equal(t, "Temperature", nodeSetBrowseName("1:Temperature"))
+	assert.Equal(t, "EURange", nodeSetBrowseName("EURange"))
+	assert.Equal(t, "a:b", nodeSetBrowseName("a:b"))
+}
+
+func TestParseNodeSetError(t *testing.T) {
+	_, err := parseNodeSet(bytes.NewReader([]byte("<UANodeSet><UAObject")))
+	assert.Error(t, err)
+}
+
+func TestNodeSetNodeName(t *testing.T) {
+	ns := parseTestNodeSet(t)
+	assert.Equal(t, "nsu=http://example.com/Line1/;i=1002", ns.nodeName("ns=1;i=1002"))
+	assert.Equal(t, "i=85", ns.nodeName("i=85"))
+	assert.Equal(t, "ns=2;s=Other", ns.nodeName("ns=2;s=Other")) // not in the NodeSet's namespaces
+}
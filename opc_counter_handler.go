@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OpcCounterHandler turns an ever-increasing PLC counter (a totalizer, a piece count...)
+// into a Prometheus counter. Since Prometheus counters can only be incremented,
+// it remembers the last raw value and adds the difference.
+//
+// When the raw value goes down, the PLC counter has either been reset or has wrapped around.
+// If counterMax is set (e.g. 65535 for a uint16 counter) and treating the drop as a wrap-around
+// gives an increase of less than half the counter range, we count it as a wrap.
+// Otherwise, it's a reset, and the new raw value is all counted as an increase.
+//
+// Wraps are detected on the raw values; the increases are then scaled to engineering units.
+type OpcCounterHandler struct {
+	counter    prometheus.Counter
+	counterMax float64        // largest raw value before the PLC counter wraps to zero. 0 if it doesn't wrap.
+	transform  ValueTransform // scaling and unit conversion of the counted values, without clamping
+	debug      bool
+	state      *counterState
+}
+
+type counterState struct {
+	mutex   sync.Mutex
+	last    float64
+	hasLast bool
+}
+
+// NewOpcCounterHandler creates a counter handler
+func NewOpcCounterHandler(counter prometheus.Counter, counterMax float64, debug bool) OpcCounterHandler {
+	return OpcCounterHandler{counter, counterMax, ValueTransform{}, debug, &counterState{}}
+}
+
+// Handle computes the increase since the last value and adds it to the counter
+func (h OpcCounterHandler) Handle(v ua.Variant) error {
+	floatVal, err := variantToFloat(v)
+	if err != nil {
+		return err
+	}
+	if floatVal < 0 {
+		return fmt.Errorf("Counter value can not be negative: %v", floatVal)
+	}
+
+	h.state.mutex.Lock()
+	defer h.state.mutex.Unlock()
+	first := !h.state.hasLast
+	increase := h.increase(floatVal)
+	h.state.last = floatVal
+	h.state.hasLast = true
+
+	// The first value counts in full, so the offset applies to it; later increases are only scaled
+	scaled := h.transform.Apply(increase)
+	if !first {
+		scaled -= h.transform.Apply(0)
+	}
+	if h.debug {
+		log.Printf("Counter raw value=%v increase=%v", floatVal, scaled)
+	}
+	if scaled < 0 {
+		return fmt.Errorf("Counter increase can not be negative: %v", scaled)
+	}
+	h.counter.Add(scaled)
+	return nil
+}
+
+// FloatValue returns the counter value in engineering units
+func (h OpcCounterHandler) FloatValue(v ua.Variant) (float64, error) {
+	floatVal, err := variantToFloat(v)
+	if err != nil {
+		return 0.0, err
+	}
+	return h.transform.Apply(floatVal), nil
+}
+
+// Work out how much the counter went up since the last value.
+// The first value we see counts in full, so the exported counter tracks the PLC total.
+func (h OpcCounterHandler) increase(value float64) float64 {
+	if !h.state.hasLast {
+		return value
+	}
+	last := h.state.last
+	if value >= last {
+		return value - last
+	}
+
+	if h.counterMax > 0 {
+		wrapped := (h.counterMax - last) + value + 1
+		if wrapped < (h.counterMax+1)/2 {
+			return wrapped
+		}
+	}
+	return value
+}
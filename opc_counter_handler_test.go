@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestCounterHandler(counterMax float64) (OpcCounterHandler, prom.Counter) {
+	c := prom.NewCounter(prom.CounterOpts{Name: "pieces_total"})
+	return NewOpcCounterHandler(c, counterMax, false), c
+}
+
+func TestCounterHandler(t *testing.T) {
+	type step struct {
+		value interface{}
+		want  float64 // exported counter value after handling
+	}
+
+	testCases := []struct {
+		counterMax float64
+		steps      []step
+	}{
+		{0, []step{ // plain increases, starting from the PLC total
+			{uint32(100), 100},
+			{uint32(100), 100},
+			{uint32(150), 150},
+			{float64(151.5), 151.5},
+		}},
+		{0, []step{ // reset
+			{uint32(100), 100},
+			{uint32(5), 105},
+			{uint32(10), 110},
+		}},
+		{65535, []step{ // uint16 wrap-around
+			{uint16(65530), 65530},
+			{uint16(65535), 65535},
+			{uint16(4), 65540},
+		}},
+		{65535, []step{ // a big drop is a reset, even for a wrapping counter
+			{uint16(30000), 30000},
+			{uint16(10), 30010},
+		}},
+	}
+
+	for _, tc := range testCases {
+		handler, counter := getTestCounterHandler(tc.counterMax)
+		for _, s := range tc.steps {
+			assert.NoError(t, handler.Handle(*ua.MustVariant(s.value)))
+			assert.Equal(t, s.want, testutil.ToFloat64(counter), "%+v", tc)
+		}
+	}
+}
+
+func TestCounterHandlerErrors(t *testing.T) {
+	handler, counter := getTestCounterHandler(0)
+	assert.Error(t, handler.Handle(*ua.MustVariant(int16(-3))))
+	assert.Error(t, handler.Handle(*ua.MustVariant("lots")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(counter))
+}
+
+func TestCounterHandlerScaledWrap(t *testing.T) {
+	registry := prom.NewRegistry()
+	scale := 0.1
+	handler, err := createHandler(NodeConfig{
+		NodeName:   "ns=1;s=Energy",
+		MetricName: "energy_kwh_total",
+		Type:       metricTypeCounter,
+		CounterMax: 65535,
+		Transform:  ValueTransform{Scale: &scale, Offset: 1000},
+	}, NewMetricFactory(nil, registry))
+	assert.NoError(t, err)
+	counterHandler := handler.(OpcCounterHandler)
+
+	for _, raw := range []uint16{65530, 65535, 4} { // the raw counter wraps after 65535
+		assert.NoError(t, handler.Handle(*ua.MustVariant(raw)))
+	}
+	// 7553 counted in full with the offset, then 5 and 5 raw steps of 0.1
+	assert.InDelta(t, 7553+1.0, testutil.ToFloat64(counterHandler.counter), 1e-9)
+
+	value, err := handler.FloatValue(*ua.MustVariant(uint16(100)))
+	assert.NoError(t, err)
+	assert.InDelta(t, 1010, value, 1e-9)
+
+	min := 0.0
+	_, err = createHandler(NodeConfig{
+		NodeName:   "ns=1;s=Energy",
+		MetricName: "energy_kwh_total",
+		Type:       metricTypeCounter,
+		Transform:  ValueTransform{Clamp: &ClampLimits{Min: &min}},
+	}, NewMetricFactory(nil, prom.NewRegistry()))
+	assert.Error(t, err)
+}
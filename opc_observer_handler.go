@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OpcObserverHandler feeds every value it receives into a histogram or summary.
+// This suits noisy analog values, where the distribution between scrapes is more
+// interesting than whichever value happened to arrive last.
+type OpcObserverHandler struct {
+	observer prometheus.Observer
+}
+
+// Handle converts the value to a float and observes it
+func (h OpcObserverHandler) Handle(v ua.Variant) error {
+	floatVal, err := h.FloatValue(v)
+	if err != nil {
+		return err
+	}
+	h.observer.Observe(floatVal)
+	return nil
+}
+
+// FloatValue converts a ua.Variant to float64
+func (h OpcObserverHandler) FloatValue(v ua.Variant) (float64, error) {
+	return variantToFloat(v)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserverHandler(t *testing.T) {
+	h := prom.NewHistogram(prom.HistogramOpts{Name: "vibration_mm_s", Help: "From OPC UA", Buckets: []float64{1, 5}})
+	handler := OpcObserverHandler{h}
+
+	for _, v := range []interface{}{float32(0.5), float64(3), int16(7)} {
+		assert.NoError(t, handler.Handle(*ua.MustVariant(v)))
+	}
+	assert.Error(t, handler.Handle(*ua.MustVariant("loud")))
+
+	expected := `
+# HELP vibration_mm_s From OPC UA
+# TYPE vibration_mm_s histogram
+vibration_mm_s_bucket{le="1"} 1
+vibration_mm_s_bucket{le="5"} 2
+vibration_mm_s_bucket{le="+Inf"} 3
+vibration_mm_s_sum 10.5
+vibration_mm_s_count 3
+`
+	assert.NoError(t, testutil.CollectAndCompare(h, strings.NewReader(expected)))
+}
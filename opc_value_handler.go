@@ -30,6 +30,10 @@ func (h OpcValueHandler) Handle(v ua.Variant) error {
 // All prometheus metics are float64.
 // Since OPCUA message values have variable types, sort out how to convert them to float.
 func (h OpcValueHandler) FloatValue(v ua.Variant) (float64, error) {
+	return variantToFloat(v)
+}
+
+func variantToFloat(v ua.Variant) (float64, error) {
 	switch v.Type() {
 	case ua.TypeIDNull:
 		return 0.0, errors.New("Can not convert null value to float64")
@@ -42,8 +42,10 @@ func TestReadNodeFile(t *testing.T) {
 func TestB64Config(t *testing.T) {
 	data, _ := yaml.Marshal(testNodes)
 	encodedData := base64.StdEncoding.EncodeToString(data)
-	results, err := readConfigBase64(&encodedData)
+	config, err := readConfigBase64(&encodedData)
 	assert.NoError(t, err)
+	assert.Equal(t, 1, len(config.Servers))
+	results := config.Servers[0].Nodes
 	assert.Equal(t, len(testNodes), len(results))
 	assert.IsType(t, NodeConfig{}, results[0])
 	assert.Equal(t, testNodes[0].NodeName, results[0].NodeName)
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PKI manages the exporter's application instance certificate and the
+// certificate trust lists, using the directory layout common to OPC UA applications:
+//
+//	own/cert.pem          application instance certificate (generated if missing)
+//	own/private/key.pem   its private key
+//	trusted/              server certificates (or CAs) we trust
+//	issuers/              intermediate CA certificates used to build chains, but not trusted by themselves
+//	rejected/             server certificates we refused. Move them to trusted/ to accept them.
+type PKI struct {
+	Dir string
+}
+
+// NewPKI creates a PKI rooted at the given directory
+func NewPKI(dir string) *PKI {
+	return &PKI{Dir: dir}
+}
+
+// CertFile is the path of the application instance certificate
+func (p *PKI) CertFile() string {
+	return filepath.Join(p.Dir, "own", "cert.pem")
+}
+
+// KeyFile is the path of the application instance private key
+func (p *PKI) KeyFile() string {
+	return filepath.Join(p.Dir, "own", "private", "key.pem")
+}
+
+func (p *PKI) trustedDir() string  { return filepath.Join(p.Dir, "trusted") }
+func (p *PKI) issuersDir() string  { return filepath.Join(p.Dir, "issuers") }
+func (p *PKI) rejectedDir() string { return filepath.Join(p.Dir, "rejected") }
+
+// Init creates the directory structure, and a self-signed application instance
+// certificate for the application URI if there isn't one already.
+// An empty application URI is replaced with one derived from the hostname.
+func (p *PKI) Init(applicationURI string) error {
+	if applicationURI == "" {
+		applicationURI = defaultApplicationURI()
+	}
+	dirs := []string{
+		filepath.Dir(p.KeyFile()),
+		p.trustedDir(),
+		p.issuersDir(),
+		p.rejectedDir(),
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(p.CertFile()); err == nil {
+		return nil
+	}
+	log.Printf("Generating application instance certificate for %s in %s", applicationURI, p.CertFile())
+	return generateCertificate(applicationURI, p.CertFile(), p.KeyFile())
+}
+
+// VerifyServerCertificate accepts a DER-encoded server certificate if it is in the trusted
+// directory, or chains up to a trusted CA. Otherwise it is written to the rejected directory.
+func (p *PKI) VerifyServerCertificate(der []byte) error {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("Error parsing server certificate: %v", err)
+	}
+
+	trusted, err := readCertificateDir(p.trustedDir())
+	if err != nil {
+		return err
+	}
+	for _, t := range trusted {
+		if bytes.Equal(t.Raw, der) {
+			return nil
+		}
+	}
+
+	issuers, err := readCertificateDir(p.issuersDir())
+	if err != nil {
+		return err
+	}
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, t := range trusted {
+		if t.IsCA {
+			opts.Roots.AddCert(t)
+		}
+	}
+	for _, i := range issuers {
+		opts.Intermediates.AddCert(i)
+	}
+	if _, err := cert.Verify(opts); err == nil {
+		return nil
+	}
+
+	rejectedPath := filepath.Join(p.rejectedDir(), certificateThumbprint(der)+".der")
+	if err := ioutil.WriteFile(rejectedPath, der, 0600); err != nil {
+		return err
+	}
+	return fmt.Errorf("Server certificate %q is not trusted. Move %s to %s to trust it", cert.Subject.CommonName, rejectedPath, p.trustedDir())
+}
+
+func certificateThumbprint(der []byte) string {
+	sum := sha1.Sum(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// Read all the DER or PEM certificates in a directory
+func readCertificateDir(dir string) ([]*x509.Certificate, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		der := content
+		if block, _ := pem.Decode(content); block != nil {
+			der = block.Bytes
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			log.Printf("Ignoring %s: %v", path, err)
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// Generate a self-signed application instance certificate, with the
+// application URI in the subject alternative names as OPC UA requires.
+func generateCertificate(applicationURI string, certFile string, keyFile string) error {
+	appURI, err := url.Parse(applicationURI)
+	if err != nil {
+		return fmt.Errorf("Invalid application URI %q: %v", applicationURI, err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "opcua_exporter",
+			Organization: []string{"opcua_exporter"},
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		URIs:                  []*url.URL{appURI},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = []string{hostname}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return ioutil.WriteFile(certFile, certPEM, 0644)
+}
+
+// The default application URI identifies this exporter instance by hostname
+func defaultApplicationURI() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("urn:%s:opcua_exporter", hostname)
+}
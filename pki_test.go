@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPKIInit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opcua_pki")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pki := NewPKI(dir)
+	assert.NoError(t, pki.Init("urn:test:opcua_exporter"))
+	for _, sub := range []string{"trusted", "issuers", "rejected"} {
+		assert.DirExists(t, filepath.Join(dir, sub))
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(pki.CertFile(), pki.KeyFile())
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "urn:test:opcua_exporter", cert.URIs[0].String())
+
+	// A second Init keeps the existing certificate
+	assert.NoError(t, pki.Init("urn:other:opcua_exporter"))
+	again, err := tls.LoadX509KeyPair(pki.CertFile(), pki.KeyFile())
+	assert.NoError(t, err)
+	assert.Equal(t, keyPair.Certificate[0], again.Certificate[0])
+}
+
+func TestPKIVerifyServerCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opcua_pki")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pki := NewPKI(dir)
+	assert.NoError(t, pki.Init(""))
+
+	// Make a "server" certificate somewhere else
+	serverDir, err := ioutil.TempDir("", "opcua_server")
+	assert.NoError(t, err)
+	defer os.RemoveAll(serverDir)
+	serverCert := filepath.Join(serverDir, "cert.pem")
+	assert.NoError(t, generateCertificate("urn:test:server", serverCert, filepath.Join(serverDir, "key.pem")))
+	der, err := loadCertificateDER(serverCert)
+	assert.NoError(t, err)
+
+	// Unknown certificates are refused and end up in rejected/
+	assert.Error(t, pki.VerifyServerCertificate(der))
+	rejected := filepath.Join(dir, "rejected", certificateThumbprint(der)+".der")
+	assert.FileExists(t, rejected)
+
+	// Until someone moves them to trusted/
+	assert.NoError(t, os.Rename(rejected, filepath.Join(dir, "trusted", "server.der")))
+	assert.NoError(t, pki.VerifyServerCertificate(der))
+}
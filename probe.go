@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ProbeHandler serves /probe?target=<endpoint>&module=<name> in the style of the blackbox exporter.
+// Each request connects to the target, reads the module's nodes once, and returns just those metrics.
+// If the probe fails, only probe_success and probe_duration_seconds are returned.
+type ProbeHandler struct {
+	Modules map[string]ModuleConfig
+	mutex   sync.RWMutex
+}
+
+// NewProbeHandler creates a probe handler for the configured modules
+func NewProbeHandler(modules map[string]ModuleConfig) *ProbeHandler {
+	return &ProbeHandler{Modules: modules}
+}
+
+// SetModules replaces the modules when the config is reloaded. Probes already running keep the old module.
+func (ph *ProbeHandler) SetModules(modules map[string]ModuleConfig) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+	ph.Modules = modules
+}
+
+func (ph *ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	moduleName := r.URL.Query().Get("module")
+	ph.mutex.RLock()
+	module, ok := ph.Modules[moduleName]
+	ph.mutex.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeoutFor(r))
+	defer cancel()
+
+	probeRegistry := prometheus.NewRegistry()
+	successGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Whether the OPCUA probe succeeded",
+	})
+	durationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "How long the OPCUA probe took, in seconds",
+	})
+	probeRegistry.MustRegister(successGauge, durationGauge)
+
+	start := time.Now()
+	registry := prometheus.NewRegistry() // the module's metrics, served only if the probe succeeds
+	factory := NewMetricFactory(nil, registry)
+	handlerMap := make(HandlerMap)
+	if err := handlerMap.addNodes(module.Nodes, factory); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	server := ServerConfig{
+		Endpoint: target,
+		Security: module.Security,
+		Auth:     module.Auth,
+		Nodes:    module.Nodes, // so that discovered nodes clashing with them are skipped
+		Discover: module.Discover,
+	}
+	applyFlagDefaults(&server)
+
+	// A target that doesn't respond may block the OPC UA client past the timeout, so don't wait for it
+	result := make(chan error, 1)
+	go func() { result <- probe(ctx, server, handlerMap, factory) }()
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	durationGauge.Set(time.Since(start).Seconds())
+
+	var gatherer prometheus.Gatherer = probeRegistry
+	if err != nil {
+		log.Printf("Probe of %s with module %s failed: %v", target, moduleName, err)
+	} else {
+		successGauge.Set(1)
+		gatherer = prometheus.Gatherers{probeRegistry, registry}
+	}
+	promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// Connect to the server, discover any more nodes, read the value of every node in the HandlerMap,
+// and pass it to the handlers
+func probe(ctx context.Context, server ServerConfig, handlerMap HandlerMap, factory *MetricFactory) error {
+	client, err := getClient(ctx, server.Endpoint, server.Security, server.Auth)
+	if err != nil {
+		return err
+	}
+	if err := client.Connect(ctx); err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if len(server.Discover) > 0 {
+		nodeConfigs, err := discoverNodes(client, server.Discover, server.Nodes)
+		if err != nil {
+			return err
+		}
+		if err := handlerMap.addNodes(nodeConfigs, factory); err != nil {
+			return err
+		}
+	}
+
+	handlerMap, err = handlerMap.resolve(client)
+	if err != nil {
+		return err
+	}
+	resolveEngineeringUnits(client, handlerMap)
+
+	var nodeNames []string
+	var nodesToRead []*ua.ReadValueID
+	for nodeName := range handlerMap {
+		nodeID, err := ua.ParseNodeID(nodeName)
+		if err != nil {
+			return fmt.Errorf("Invalid node ID %s: %v", nodeName, err)
+		}
+		nodeNames = append(nodeNames, nodeName)
+		nodesToRead = append(nodesToRead, &ua.ReadValueID{NodeID: nodeID, AttributeID: ua.AttributeIDValue})
+	}
+
+	results, err := readChunked(client, nodesToRead, ua.TimestampsToReturnBoth)
+	if err != nil {
+		return err
+	}
+
+	handleProbeResults(handlerMap, nodeNames, results)
+	return nil
+}
+
+// Pass the value read for each node to its handlers. Nodes whose engineering units failed have
+// no handler, and are skipped.
+func handleProbeResults(handlerMap HandlerMap, nodeNames []string, results []*ua.DataValue) {
+	for i, result := range results {
+		nodeName := nodeNames[i]
+		if result.Status != ua.StatusOK {
+			log.Printf("Error reading node %s: %v", nodeName, result.Status)
+			continue
+		}
+		if result.Value == nil {
+			log.Printf("nil value received for node %s", nodeName)
+			continue
+		}
+		for _, handlerMapRec := range handlerMap[nodeName] {
+			if handlerMapRec.handler == nil {
+				continue
+			}
+			if err := handlerMapRec.handler.Handle(*result.Value); err != nil {
+				log.Printf("Error handling opcua value: %s (%s)\n", err, handlerMapRec.config.MetricName)
+			}
+		}
+	}
+}
+
+// Use the scrape timeout Prometheus sends, if any, less a little to return before it gives up.
+func probeTimeoutFor(r *http.Request) time.Duration {
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil && seconds > 1 {
+			return time.Duration((seconds - 0.5) * float64(time.Second))
+		}
+	}
+	return *probeTimeout
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeBadRequests(t *testing.T) {
+	handler := NewProbeHandler(map[string]ModuleConfig{
+		"press_line": {Nodes: []NodeConfig{{NodeName: "ns=1;s=Temperature", MetricName: "press_temperature"}}},
+	})
+
+	badURLs := []string{
+		"/probe?module=press_line",
+		"/probe?target=opc.tcp://localhost:4840",
+		"/probe?target=opc.tcp://localhost:4840&module=nonesuch",
+	}
+	for _, url := range badURLs {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+	}
+}
+
+func TestProbeUnreachableTarget(t *testing.T) {
+	handler := NewProbeHandler(map[string]ModuleConfig{
+		"press_line": {Nodes: []NodeConfig{{NodeName: "ns=1;s=Temperature", MetricName: "press_temperature"}}},
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/probe?target=opc.tcp://127.0.0.1:1&module=press_line", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "probe_success 0")
+	assert.NotContains(t, w.Body.String(), "press_temperature", "no made-up values for a failed probe")
+}
+
+func TestProbeTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept() // and never answer
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	handler := NewProbeHandler(map[string]ModuleConfig{
+		"press_line": {Nodes: []NodeConfig{{NodeName: "ns=1;s=Temperature", MetricName: "press_temperature"}}},
+	})
+	r := httptest.NewRequest("GET", "/probe?target=opc.tcp://"+listener.Addr().String()+"&module=press_line", nil)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "1.5")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(w, r)
+	assert.True(t, time.Since(start) < 3*time.Second, "probe took %v", time.Since(start))
+	assert.Contains(t, w.Body.String(), "probe_success 0")
+}
+
+func TestProbeTimeoutFor(t *testing.T) {
+	r := httptest.NewRequest("GET", "/probe", nil)
+	assert.Equal(t, *probeTimeout, probeTimeoutFor(r))
+
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+	assert.Equal(t, 9500*time.Millisecond, probeTimeoutFor(r))
+}
+
+func TestHandleProbeResultsFailedEU(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	factory := NewMetricFactory(nil, registry)
+	handlerMap := make(HandlerMap)
+	assert.NoError(t, handlerMap.addNodes([]NodeConfig{
+		{NodeName: "ns=1;s=Level", MetricName: "tank_level", EUProperties: true},
+		{NodeName: "ns=1;s=Level", MetricName: "tank_level_raw"},
+	}, factory))
+	// resolveEngineeringUnits leaves the handler of a node whose EU properties failed nil
+
+	value := &ua.DataValue{Status: ua.StatusOK, Value: ua.MustVariant(42.0)}
+	assert.NotPanics(t, func() {
+		handleProbeResults(handlerMap, []string{"ns=1;s=Level"}, []*ua.DataValue{value})
+	})
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	assert.Len(t, families, 1)
+	assert.Equal(t, "tank_level_raw", families[0].GetName())
+	assert.Equal(t, 42.0, families[0].GetMetric()[0].GetGauge().GetValue())
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// Reloader re-reads the config and applies the node changes to the running exporter, on SIGHUP,
+// on POST /-/reload, and optionally when the config file changes. Each server's session and
+// subscription is kept; only the monitored items that changed are added or removed.
+// Settings other than the nodes and modules take effect on restart.
+type Reloader struct {
+	Supervisors map[string]*ConnectionSupervisor // by server name
+	Probe       *ProbeHandler
+	config      *Config
+	mutex       sync.Mutex
+}
+
+// NewReloader creates a reloader for the config the exporter started with
+func NewReloader(config *Config) *Reloader {
+	setConfigLoaded(config)
+	return &Reloader{Supervisors: make(map[string]*ConnectionSupervisor), config: config}
+}
+
+// Start reloading on SIGHUP, and when the -config files change if the interval isn't 0
+func (r *Reloader) Start(ctx context.Context, watchInterval time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				signal.Stop(signals)
+				return
+			case <-signals:
+				log.Print("Reloading config on SIGHUP")
+				r.Reload()
+			}
+		}
+	}()
+
+	if watchInterval > 0 && *nodeListFile != "" && *configB64 == "" {
+		go r.watch(ctx, *nodeListFile, watchInterval)
+	}
+}
+
+func (r *Reloader) watch(ctx context.Context, path string, interval time.Duration) {
+	modTime, files := r.modTime(path), watchedFiles(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// The glob is expanded again, so that files added or removed since are noticed
+			t, f := r.modTime(path), watchedFiles(path)
+			if !t.Equal(modTime) || !reflect.DeepEqual(f, files) {
+				modTime, files = t, f
+				log.Printf("Reloading config on change to %s", path)
+				r.Reload()
+			}
+		}
+	}
+}
+
+// The latest modification time of the -config path and the files the config was read from.
+// A directory's changes when files are added to it or removed.
+func (r *Reloader) modTime(path string) time.Time {
+	r.mutex.Lock()
+	paths := append([]string{path}, r.config.files...)
+	r.mutex.Unlock()
+	var latest time.Time
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// The files a -config path names now. Nil if it names none, e.g. because no file matches its glob.
+func watchedFiles(path string) []string {
+	files, _ := configFiles(path)
+	return files
+}
+
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.Reload(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reload config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// Reload reads the config again and applies it. The config is checked for every server and module
+// before anything changes; if that fails, the exporter carries on with the old config.
+func (r *Reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	err := r.reload()
+	if err != nil {
+		log.Printf("Error reloading config: %v", err)
+		configReloadCounter.WithLabelValues("failure").Inc()
+		configReloadSuccessGauge.Set(0)
+		return err
+	}
+	configReloadCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+func (r *Reloader) reload() error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if configHash(config) == configHash(r.config) {
+		log.Print("Config is unchanged")
+		setConfigLoaded(config)
+		return nil
+	}
+
+	var names []string
+	for _, server := range config.Servers {
+		supervisor, ok := r.Supervisors[server.Name]
+		if !ok {
+			return fmt.Errorf("Server %q is new; adding servers needs a restart", server.Name)
+		}
+		applyFlagDefaults(&server)
+		if server.Endpoint != supervisor.Server.Endpoint || server.Security != supervisor.Server.Security || server.Auth != supervisor.Server.Auth {
+			log.Printf("Warning: connection settings of server %q change on restart, not on reload", server.Name)
+		}
+		if err := validateNodes(server.Nodes); err != nil {
+			return fmt.Errorf("Invalid nodes for server %q: %v", server.Name, err)
+		}
+		names = append(names, server.Name)
+	}
+	if len(names) != len(r.Supervisors) {
+		return fmt.Errorf("Servers were removed; removing servers needs a restart")
+	}
+	for name, module := range config.Modules {
+		if err := validateModule(name, module); err != nil {
+			return err
+		}
+	}
+
+	if err := r.reloadServers(config.Servers); err != nil {
+		return err
+	}
+	if r.Probe != nil {
+		r.Probe.SetModules(config.Modules)
+	}
+	r.config = config
+	setConfigLoaded(config)
+	log.Print("Reloaded config")
+	return nil
+}
+
+// Apply the servers' new nodes all together, or not at all. Every server's nodes are checked and resolved
+// before any of them change, and if the metrics of one server can't be created after all, those
+// already changed go back to their old nodes.
+func (r *Reloader) reloadServers(servers []ServerConfig) error {
+	var supervisors []*ConnectionSupervisor
+	for _, server := range servers {
+		supervisor := r.Supervisors[server.Name]
+		supervisor.nodesMutex.Lock()
+		defer supervisor.nodesMutex.Unlock()
+		supervisors = append(supervisors, supervisor)
+	}
+
+	var pending []*pendingReload
+	for i, server := range servers {
+		p, err := supervisors[i].prepareReload(server.Nodes)
+		if err != nil {
+			return fmt.Errorf("Error reloading nodes for server %q: %v", server.Name, err)
+		}
+		pending = append(pending, p)
+	}
+	if err := validateServerMetrics(supervisors, pending); err != nil {
+		return err
+	}
+
+	for i, server := range servers {
+		if err := supervisors[i].commitReload(pending[i]); err != nil {
+			for j := 0; j < i; j++ {
+				if err := supervisors[j].commitReload(pending[j].rollback()); err != nil {
+					log.Printf("Error restoring the nodes of server %q: %v", servers[j].Name, err)
+				}
+			}
+			return fmt.Errorf("Error reloading nodes for server %q: %v", server.Name, err)
+		}
+	}
+	return nil
+}
+
+// Check that the new metrics of all the servers can be registered together, as they share a registry,
+// without registering them anywhere that matters
+func validateServerMetrics(supervisors []*ConnectionSupervisor, pending []*pendingReload) error {
+	registry := prometheus.NewRegistry()
+	for i, supervisor := range supervisors {
+		factory := NewMetricFactory(supervisor.Factory.ConstLabels, registry)
+		for _, nodeConfig := range pending[i].allConfigs {
+			if nodeConfig.EUProperties {
+				continue // named once connected
+			}
+			if _, err := createHandler(nodeConfig, factory); err != nil {
+				return fmt.Errorf("Invalid nodes for server %q: %v", supervisor.Server.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Record a successful load of the config in the metrics
+func setConfigLoaded(config *Config) {
+	configReloadSuccessGauge.Set(1)
+	configReloadTimeGauge.SetToCurrentTime()
+	configHashGauge.Set(configHash(config))
+}
+
+// A hash of the servers, modules and settings, as a metric value. It's the first 48 bits of
+// the SHA-256 of the config encoded as YAML, which a float64 holds exactly.
+func configHash(config *Config) float64 {
+	hash := sha256.New()
+	for _, part := range []interface{}{config, config.settings} {
+		content, err := yaml.Marshal(part)
+		if err != nil {
+			return 0
+		}
+		hash.Write(content)
+	}
+	sum := hash.Sum(nil)
+	return float64(binary.BigEndian.Uint64(append([]byte{0, 0}, sum[:6]...)))
+}
+
+// Check a module's nodes and discovery settings
+func validateModule(name string, module ModuleConfig) error {
+	if err := validateNodes(module.Nodes); err != nil {
+		return fmt.Errorf("Invalid nodes in module %s: %v", name, err)
+	}
+	for _, discovery := range module.Discover {
+		if err := discovery.Validate(); err != nil {
+			return fmt.Errorf("Invalid discovery settings in module %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Check that the metrics of all the nodes can be created, without registering them anywhere that matters
+func validateNodes(nodeConfigs []NodeConfig) error {
+	if err := validateNodeLabels(nodeConfigs); err != nil {
+		return err
+	}
+	if err := validateNodeMonitoring(nodeConfigs); err != nil {
+		return err
+	}
+	factory := NewMetricFactory(nil, prometheus.NewRegistry())
+	for _, nodeConfig := range nodeConfigs {
+		if _, err := canonicalNodeName(nodeConfig.NodeName); err != nil {
+			return fmt.Errorf("Metric %s: %v", nodeConfig.MetricName, err)
+		}
+		if _, err := createHandler(nodeConfig, factory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build the HandlerMap for a new list of nodes. The records of nodes whose metric settings are unchanged
+// are kept, with their handlers and metric values. The metrics of removed and changed nodes are removed
+// before those of new and changed nodes are created, so that a changed node can change its metric type.
+// The original map is left as it is, so it can still be used until the new one replaces it.
+// The node statuses of removed nodes are deleted from those of the server.
+//
+// If the new metrics can't all be created, those that were are removed again and the removed ones
+// re-created. The map returned with the error then has the old nodes, and replaces the original map
+// all the same, as the re-created metrics have new handlers.
+func (handlerMap HandlerMap) reload(nodeConfigs []NodeConfig, factory *MetricFactory, server string) (HandlerMap, error) {
+	if err := validateNodes(nodeConfigs); err != nil {
+		return nil, err
+	}
+
+	type recordKey struct{ nodeName, series string }
+	oldRecords := make(map[recordKey]handlerMapRecord)
+	for nodeName, records := range handlerMap {
+		for _, record := range records {
+			oldRecords[recordKey{nodeName, seriesName(record.config.MetricName, record.config.Labels)}] = record
+		}
+	}
+
+	newMap := make(HandlerMap)
+	var added []NodeConfig
+	for _, nodeConfig := range nodeConfigs {
+		nodeName, _ := canonicalNodeName(nodeConfig.NodeName) // checked by validateNodes()
+		key := recordKey{nodeName, seriesName(nodeConfig.MetricName, nodeConfig.Labels)}
+		if record, ok := oldRecords[key]; ok && sameMetric(record.config, nodeConfig) {
+			record.config = nodeConfig // with any new monitoring settings
+			newMap[nodeName] = append(newMap[nodeName], record)
+			delete(oldRecords, key)
+			continue
+		}
+		added = append(added, nodeConfig)
+	}
+
+	var removed []NodeConfig
+	for _, record := range oldRecords {
+		record.removeMetrics(factory)
+		removed = append(removed, record.config)
+	}
+	addedMap := make(HandlerMap)
+	if err := addedMap.addNodes(added, factory); err != nil {
+		for _, records := range addedMap {
+			for _, record := range records {
+				record.removeMetrics(factory)
+			}
+		}
+		oldMap := make(HandlerMap)
+		for nodeName, records := range handlerMap {
+			for _, record := range records {
+				if _, ok := oldRecords[recordKey{nodeName, seriesName(record.config.MetricName, record.config.Labels)}]; !ok {
+					oldMap[nodeName] = append(oldMap[nodeName], record)
+				}
+			}
+		}
+		if restoreErr := oldMap.addNodes(removed, factory); restoreErr != nil {
+			log.Printf("Error restoring the metrics of the old nodes: %v", restoreErr)
+		}
+		return oldMap, err
+	}
+
+	for key, record := range oldRecords {
+		deleteNodeStatus(server, statusNodeName(record.config), record.config.MetricName)
+		log.Printf("Removed prom metric %s for OPC UA node %s", key.series, key.nodeName)
+	}
+	for nodeName, records := range addedMap {
+		newMap[nodeName] = append(newMap[nodeName], records...)
+	}
+	return newMap, nil
+}
+
+// Remove the metrics created for a node, when it is dropped from the config
+func (record handlerMapRecord) removeMetrics(factory *MetricFactory) {
+	for _, metricName := range record.metricNames {
+		factory.Remove(metricName, record.config.Labels)
+	}
+}
+
+// The node IDs that are in the new map but not the old one, and those in the old map but not the new one.
+// A node whose monitoring settings changed is in both, to be monitored again.
+func changedNodes(oldMap HandlerMap, newMap HandlerMap) ([]string, []string) {
+	var added, removed []string
+	for nodeName := range newMap {
+		if _, ok := oldMap[nodeName]; !ok {
+			added = append(added, nodeName)
+		} else if oldMap.monitoring(nodeName) != newMap.monitoring(nodeName) {
+			added = append(added, nodeName)
+			removed = append(removed, nodeName)
+		}
+	}
+	for nodeName := range oldMap {
+		if _, ok := newMap[nodeName]; !ok {
+			removed = append(removed, nodeName)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// Whether two node configs create the same metric. They may differ in how the node is monitored.
+func sameMetric(a NodeConfig, b NodeConfig) bool {
+	a.Monitoring, b.Monitoring = MonitoringConfig{}, MonitoringConfig{}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerMapReload(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	factory := NewMetricFactory(nil, registry)
+	handlerMap := make(HandlerMap)
+	assert.NoError(t, handlerMap.addNodes([]NodeConfig{
+		{NodeName: "ns=1;s=Temperature", MetricName: "temperature_celsius"},
+		{NodeName: "ns=1;s=Pressure", MetricName: "pressure_bar"},
+		{NodeName: "ns=1;s=Count", MetricName: "parts"},
+	}, factory))
+
+	msg := makeTestMessage(ua.NewStringNodeID(1, "Temperature"))
+	msg.Value = ua.MustVariant(21.5)
+	handleMessage(&msg, handlerMap, "")
+
+	newMap, err := handlerMap.reload([]NodeConfig{
+		{NodeName: "ns=1;s=Temperature", MetricName: "temperature_celsius"},      // unchanged
+		{NodeName: "ns=1;s=Count", MetricName: "parts", Type: metricTypeCounter}, // changed
+		{NodeName: "ns=1;s=Level", MetricName: "level_percent"},                  // added
+	}, factory, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(newMap))
+	assert.Equal(t, handlerMap["ns=1;s=Temperature"][0].handler, newMap["ns=1;s=Temperature"][0].handler)
+	assert.Equal(t, 1, len(handlerMap["ns=1;s=Pressure"]), "the old map is left alone")
+
+	expected := `
+# HELP level_percent From OPC UA
+# TYPE level_percent gauge
+level_percent 0
+# HELP parts From OPC UA
+# TYPE parts counter
+parts 0
+# HELP temperature_celsius From OPC UA
+# TYPE temperature_celsius gauge
+temperature_celsius 21.5
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected)))
+}
+
+func TestHandlerMapReloadInvalid(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	factory := NewMetricFactory(nil, registry)
+	handlerMap := make(HandlerMap)
+	assert.NoError(t, handlerMap.addNodes([]NodeConfig{{NodeName: "ns=1;s=Pressure", MetricName: "pressure_bar"}}, factory))
+
+	_, err := handlerMap.reload([]NodeConfig{{NodeName: "ns=1;s=Pressure", MetricName: "pressure_bar", Type: "gauges"}}, factory, "")
+	assert.Error(t, err)
+	_, err = handlerMap.reload([]NodeConfig{{NodeName: "Pressure", MetricName: "pressure_bar"}}, factory, "")
+	assert.Error(t, err)
+
+	metricFamilies, err := registry.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(metricFamilies), "the metrics are kept when the new config is invalid")
+}
+
+func TestHandlerMapReloadRestore(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	factory := NewMetricFactory(nil, registry)
+	handlerMap := make(HandlerMap)
+	assert.NoError(t, handlerMap.addNodes([]NodeConfig{
+		{NodeName: "ns=1;s=Temperature", MetricName: "temperature_celsius"},
+		{NodeName: "ns=1;s=Pressure", MetricName: "pressure_bar"},
+	}, factory))
+	// something else in the registry has the name the new node wants
+	registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "level_percent", Help: "Something else"}))
+
+	restored, err := handlerMap.reload([]NodeConfig{
+		{NodeName: "ns=1;s=Temperature", MetricName: "temperature_celsius"},
+		{NodeName: "ns=1;s=Level", MetricName: "level_percent"},
+	}, factory, "")
+	assert.Error(t, err)
+	assert.Equal(t, 2, len(restored))
+	assert.Contains(t, restored, "ns=1;s=Pressure")
+	assert.Equal(t, handlerMap["ns=1;s=Temperature"][0].handler, restored["ns=1;s=Temperature"][0].handler)
+
+	msg := makeTestMessage(ua.NewStringNodeID(1, "Pressure"))
+	msg.Value = ua.MustVariant(1.5)
+	handleMessage(&msg, restored, "")
+	expected := `
+# HELP level_percent Something else
+# TYPE level_percent gauge
+level_percent 0
+# HELP pressure_bar From OPC UA
+# TYPE pressure_bar gauge
+pressure_bar 1.5
+# HELP temperature_celsius From OPC UA
+# TYPE temperature_celsius gauge
+temperature_celsius 0
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected)))
+}
+
+func TestChangedNodes(t *testing.T) {
+	oldMap := HandlerMap{"ns=1;s=a": nil, "ns=1;s=b": nil}
+	newMap := HandlerMap{"ns=1;s=b": nil, "ns=1;s=c": nil, "ns=1;s=d": nil}
+	added, removed := changedNodes(oldMap, newMap)
+	assert.Equal(t, []string{"ns=1;s=c", "ns=1;s=d"}, added)
+	assert.Equal(t, []string{"ns=1;s=a"}, removed)
+}
+
+func TestConfigHash(t *testing.T) {
+	config := &Config{Servers: []ServerConfig{{Name: "line1", Nodes: []NodeConfig{{NodeName: "i=2258", MetricName: "time"}}}}}
+	hash := configHash(config)
+	assert.Equal(t, hash, configHash(&Config{Servers: []ServerConfig{{Name: "line1", Nodes: []NodeConfig{{NodeName: "i=2258", MetricName: "time"}}}}}))
+	assert.True(t, hash < 1<<48)
+
+	config.Servers[0].Nodes[0].MetricName = "server_time"
+	assert.NotEqual(t, hash, configHash(config))
+	config.Servers[0].Nodes[0].MetricName = "time"
+	config.settings = map[string]string{"port": "9000"}
+	assert.NotEqual(t, hash, configHash(config))
+}
+
+func TestReloader(t *testing.T) {
+	f, err := ioutil.TempFile("", "opcua_config")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer func(path string) { *nodeListFile = path }(*nodeListFile)
+	*nodeListFile = f.Name()
+
+	write := func(content string) {
+		assert.NoError(t, ioutil.WriteFile(f.Name(), []byte(content), 0644))
+	}
+	write(`
+servers:
+  - name: line1
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: temperature_celsius
+`)
+	config, err := loadConfig()
+	assert.NoError(t, err)
+	registry := prometheus.NewRegistry()
+	factory := NewMetricFactory(prometheus.Labels{"server": "line1"}, registry)
+	handlerMap := make(HandlerMap)
+	assert.NoError(t, handlerMap.addNodes(config.Servers[0].Nodes, factory))
+	supervisor := NewConnectionSupervisor(config.Servers[0], handlerMap, factory, 1, NewBackoff(0, 0))
+	reloader := NewReloader(config)
+	reloader.Supervisors["line1"] = supervisor
+	reloader.Probe = NewProbeHandler(config.Modules)
+
+	write(`
+servers:
+  - name: line1
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: temperature_celsius
+      - nodeName: ns=1;s=Pressure
+        metricName: pressure_bar
+modules:
+  line:
+    nodes:
+      - nodeName: ns=1;s=Level
+        metricName: level_percent
+`)
+	assert.NoError(t, reloader.Reload())
+	assert.Equal(t, 2, len(supervisor.HandlerMap))
+	assert.Equal(t, 2, len(supervisor.Server.Nodes))
+	assert.Contains(t, reloader.Probe.Modules, "line")
+	assert.Equal(t, 1.0, testutil.ToFloat64(configReloadSuccessGauge))
+	assert.Equal(t, configHash(reloader.config), testutil.ToFloat64(configHashGauge))
+
+	write(`
+servers:
+  - name: line2
+    nodes: []
+`)
+	assert.Error(t, reloader.Reload())
+	assert.Equal(t, 0.0, testutil.ToFloat64(configReloadSuccessGauge))
+	assert.Equal(t, 2, len(supervisor.HandlerMap))
+
+	write(`
+servers:
+  - name: line1
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: temperature_celsius
+        type: gauges
+`)
+	assert.Error(t, reloader.Reload())
+	assert.Equal(t, 2, len(supervisor.HandlerMap), "nothing changes when the new config is invalid")
+}
+
+func TestReloaderAllServersOrNone(t *testing.T) {
+	f, err := ioutil.TempFile("", "opcua_config")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer func(path string) { *nodeListFile = path }(*nodeListFile)
+	*nodeListFile = f.Name()
+
+	write := func(content string) {
+		assert.NoError(t, ioutil.WriteFile(f.Name(), []byte(content), 0644))
+	}
+	write(`
+servers:
+  - name: line1
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: temperature_celsius
+  - name: line2
+    nodes:
+      - nodeName: ns=1;s=Pressure
+        metricName: pressure_bar
+`)
+	config, err := loadConfig()
+	assert.NoError(t, err)
+	registry := prometheus.NewRegistry()
+	reloader := NewReloader(config)
+	for _, server := range config.Servers {
+		factory := NewMetricFactory(prometheus.Labels{"server": server.Name}, registry)
+		handlerMap := make(HandlerMap)
+		assert.NoError(t, handlerMap.addNodes(server.Nodes, factory))
+		reloader.Supervisors[server.Name] = NewConnectionSupervisor(server, handlerMap, factory, 1, NewBackoff(0, 0))
+	}
+
+	// each server's nodes are fine on their own, but the two servers' level metrics can't share a registry
+	write(`
+servers:
+  - name: line1
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: temperature_celsius
+      - nodeName: ns=1;s=Level
+        metricName: level_percent
+        help: Tank level
+  - name: line2
+    nodes:
+      - nodeName: ns=1;s=Pressure
+        metricName: pressure_bar
+      - nodeName: ns=1;s=Level
+        metricName: level_percent
+        help: Silo level
+`)
+	assert.Error(t, reloader.Reload())
+	for _, supervisor := range reloader.Supervisors {
+		assert.Equal(t, 1, len(supervisor.HandlerMap), "no server changes")
+		assert.Equal(t, 1, len(supervisor.Server.Nodes))
+	}
+	metricFamilies, err := registry.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(metricFamilies))
+}
+
+func TestReloaderServeHTTP(t *testing.T) {
+	reloader := NewReloader(&Config{})
+	recorder := httptest.NewRecorder()
+	reloader.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, http.MethodPost, recorder.Header().Get("Allow"))
+}
+
+func TestWatchedFiles(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{"a.yaml": "servers: []\n"})
+	defer os.RemoveAll(dir)
+
+	glob := filepath.Join(dir, "*.yaml")
+	assert.Equal(t, []string{filepath.Join(dir, "a.yaml")}, watchedFiles(glob))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b.yaml"), []byte("servers: []\n"), 0644))
+	assert.Equal(t, []string{filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.yaml")}, watchedFiles(glob))
+	assert.Nil(t, watchedFiles(filepath.Join(dir, "*.yml")))
+}
+
+func TestCommitReloadInvalid(t *testing.T) {
+	server := ServerConfig{Name: "line1", Nodes: []NodeConfig{{NodeName: "ns=1;s=Temperature", MetricName: "temperature_celsius"}}}
+	factory := NewMetricFactory(prometheus.Labels{"server": server.Name}, prometheus.NewRegistry())
+	handlerMap := make(HandlerMap)
+	assert.NoError(t, handlerMap.addNodes(server.Nodes, factory))
+	supervisor := NewConnectionSupervisor(server, handlerMap, factory, 1, NewBackoff(0, 0))
+
+	invalid := []NodeConfig{{NodeName: "Ammeter", MetricName: "circuit_amps"}}
+	assert.Error(t, supervisor.commitReload(&pendingReload{nodeConfigs: invalid, allConfigs: invalid}))
+	assert.Equal(t, handlerMap, supervisor.HandlerMap, "the old map is kept")
+	assert.Equal(t, server.Nodes, supervisor.Server.Nodes)
+}
+
+// The status of a removed node is deleted under the same name it was set under
+func TestHandlerMapReloadDeletesSymbolicStatus(t *testing.T) {
+	factory := NewMetricFactory(nil, prometheus.NewRegistry())
+	nodeConfig := NodeConfig{NodeName: "/Objects/Line1/Temperature", MetricName: "temperature_celsius"}
+	handlerMap := make(HandlerMap)
+	assert.NoError(t, handlerMap.addNodes([]NodeConfig{nodeConfig}, factory))
+	setNodeStatus("line4", statusNodeName(nodeConfig), "temperature_celsius", nodeStatusOK)
+
+	_, err := handlerMap.reload(nil, factory, "line4")
+	assert.NoError(t, err)
+	assert.False(t, nodeStatusGauge.DeleteLabelValues("line4", statusNodeName(nodeConfig), "temperature_celsius", nodeStatusOK))
+}
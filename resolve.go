@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Node names can refer to nodes in ways that stay valid when the server's namespace indexes change:
+//
+//   nsu=http://example.com/Line1/;s=Press.Temperature   a node ID with the namespace URI instead of its index
+//   /Objects/2:Line1/2:Press/2:Temperature               a browse path from the Root folder
+//   nsu=http://example.com/Line1/;/Objects/Line1/Press/Temperature
+//                                                        a browse path whose names are in that namespace
+//
+// In a browse path, each name may have a namespace index prefix. Names without one are in the path's
+// namespace, given by nsu=, or namespace 0 without it. A leading Objects, Types or Views is always
+// the standard folder in namespace 0. A path with no namespaces at all that the server can't translate
+// is looked up by browsing for the names in any namespace instead.
+// These names are resolved every time the exporter connects.
+
+// A browse path parsed from a node name
+type browsePath struct {
+	NamespaceURI string // namespace of the names without an index prefix; empty for namespace 0
+	Names        []browsePathName
+}
+
+type browsePathName struct {
+	Namespace *uint16 // explicit namespace index, if given
+	Name      string
+}
+
+var rootFolderNames = map[string]bool{"Objects": true, "Types": true, "Views": true}
+
+var rootFolderIDs = map[string]uint32{"Objects": id.ObjectsFolder, "Types": id.TypesFolder, "Views": id.ViewsFolder}
+
+// isSymbolicNodeName is true for node names that have to be resolved on the server
+func isSymbolicNodeName(nodeName string) bool {
+	return strings.HasPrefix(nodeName, "nsu=") || strings.HasPrefix(nodeName, "/")
+}
+
+// Split nsu=<uri>;<rest> into the namespace URI and the rest
+func splitNamespaceURI(nodeName string) (string, string, error) {
+	if !strings.HasPrefix(nodeName, "nsu=") {
+		return "", nodeName, nil
+	}
+	// The URI may itself contain semicolons, so look for the first one followed by an identifier or path
+	for i := len("nsu="); i < len(nodeName); i++ {
+		if nodeName[i] != ';' {
+			continue
+		}
+		rest := nodeName[i+1:]
+		for _, prefix := range []string{"/", "i=", "s=", "g=", "b="} {
+			if strings.HasPrefix(rest, prefix) && i > len("nsu=") {
+				return nodeName[len("nsu="):i], rest, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("Invalid node name %s: expected nsu=<namespace URI>;<identifier or browse path>", nodeName)
+}
+
+// Parse a browse path such as /Objects/2:Line1/Press, with an optional nsu= prefix
+func parseBrowsePath(nodeName string) (*browsePath, error) {
+	uri, rest, err := splitNamespaceURI(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(rest, "/") || len(rest) < 2 {
+		return nil, fmt.Errorf("Invalid browse path %s", nodeName)
+	}
+	path := &browsePath{NamespaceURI: uri}
+	for _, segment := range strings.Split(rest[1:], "/") {
+		if segment == "" {
+			return nil, fmt.Errorf("Invalid browse path %s: empty name", nodeName)
+		}
+		name := browsePathName{Name: segment}
+		if i := strings.Index(segment, ":"); i > 0 {
+			if ns, err := strconv.ParseUint(segment[:i], 10, 16); err == nil {
+				index := uint16(ns)
+				name = browsePathName{&index, segment[i+1:]}
+			}
+		}
+		if name.Namespace == nil && len(path.Names) == 0 && rootFolderNames[name.Name] {
+			zero := uint16(0)
+			name.Namespace = &zero
+		}
+		path.Names = append(path.Names, name)
+	}
+	return path, nil
+}
+
+// True if the path doesn't say which namespace any of its names are in
+func (p *browsePath) namespaceFree() bool {
+	if p.NamespaceURI != "" {
+		return false
+	}
+	for i, name := range p.Names {
+		if name.Namespace != nil && !(i == 0 && rootFolderNames[name.Name] && *name.Namespace == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse nsu=<uri>;<identifier> using the server's namespace array
+func parseNamespaceURINodeID(nodeName string, namespaces []string) (*ua.NodeID, error) {
+	uri, identifier, err := splitNamespaceURI(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	index, err := namespaceIndex(uri, namespaces)
+	if err != nil {
+		return nil, err
+	}
+	return parseNodeID(fmt.Sprintf("ns=%d;%s", index, identifier))
+}
+
+func namespaceIndex(uri string, namespaces []string) (uint16, error) {
+	for i, namespace := range namespaces {
+		if namespace == uri {
+			return uint16(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Namespace %s is not on the server", uri)
+}
+
+// The relative path to look up on the server, with the namespace indexes filled in
+func (p *browsePath) relativePath(namespaces []string) (*ua.RelativePath, error) {
+	var defaultIndex uint16
+	if p.NamespaceURI != "" {
+		index, err := namespaceIndex(p.NamespaceURI, namespaces)
+		if err != nil {
+			return nil, err
+		}
+		defaultIndex = index
+	}
+	relativePath := &ua.RelativePath{}
+	for _, name := range p.Names {
+		index := defaultIndex
+		if name.Namespace != nil {
+			index = *name.Namespace
+		}
+		relativePath.Elements = append(relativePath.Elements, &ua.RelativePathElement{
+			ReferenceTypeID: ua.NewNumericNodeID(0, id.HierarchicalReferences),
+			IncludeSubtypes: true,
+			TargetName:      &ua.QualifiedName{NamespaceIndex: index, Name: name.Name},
+		})
+	}
+	return relativePath, nil
+}
+
+func readNamespaceArray(client *opcua.Client) ([]string, error) {
+	value, err := client.Node(ua.NewNumericNodeID(0, id.Server_NamespaceArray)).Value()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the namespace array: %v", err)
+	}
+	namespaces, ok := value.Value().([]string)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected namespace array %v", value.Value())
+	}
+	return namespaces, nil
+}
+
+// Look up the node IDs of the symbolic node names on the server. Names that can't be resolved
+// are logged and left out of the result; an error is only returned if the server can't be asked.
+func resolveNodeNames(client *opcua.Client, nodeNames []string) (map[string]*ua.NodeID, error) {
+	resolved := make(map[string]*ua.NodeID)
+	if len(nodeNames) == 0 {
+		return resolved, nil
+	}
+	namespaces, err := readNamespaceArray(client)
+	if err != nil {
+		return nil, err
+	}
+
+	var pathNames []string
+	var paths []*browsePath
+	req := &ua.TranslateBrowsePathsToNodeIDsRequest{}
+	for _, nodeName := range nodeNames {
+		_, rest, err := splitNamespaceURI(nodeName)
+		if err == nil && !strings.HasPrefix(rest, "/") {
+			nodeID, err := parseNamespaceURINodeID(nodeName, namespaces)
+			if err != nil {
+				log.Printf("Could not resolve node %s: %v", nodeName, err)
+				continue
+			}
+			resolved[nodeName] = nodeID
+			continue
+		}
+
+		var relativePath *ua.RelativePath
+		path, err := parseBrowsePath(nodeName)
+		if err == nil {
+			relativePath, err = path.relativePath(namespaces)
+		}
+		if err != nil {
+			log.Printf("Could not resolve node %s: %v", nodeName, err)
+			continue
+		}
+		pathNames = append(pathNames, nodeName)
+		paths = append(paths, path)
+		req.BrowsePaths = append(req.BrowsePaths, &ua.BrowsePath{
+			StartingNode: ua.NewNumericNodeID(0, id.RootFolder),
+			RelativePath: relativePath,
+		})
+	}
+	if len(pathNames) == 0 {
+		return resolved, nil
+	}
+
+	var results []*ua.BrowsePathResult
+	err = client.Send(req, func(v interface{}) error {
+		resp, ok := v.(*ua.TranslateBrowsePathsToNodeIDsResponse)
+		if !ok {
+			return ua.StatusBadUnexpectedError
+		}
+		results = resp.Results
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error translating browse paths: %v", err)
+	}
+	if len(results) != len(pathNames) {
+		return nil, fmt.Errorf("Translate response has %d results for %d browse paths", len(results), len(pathNames))
+	}
+	for i, result := range results {
+		if result.StatusCode == ua.StatusOK && len(result.Targets) > 0 && result.Targets[0].TargetID != nil {
+			resolved[pathNames[i]] = result.Targets[0].TargetID.NodeID
+			continue
+		}
+		if !paths[i].namespaceFree() {
+			log.Printf("Could not resolve node %s: %v", pathNames[i], result.StatusCode)
+			continue
+		}
+		var names []string
+		for _, name := range paths[i].Names {
+			names = append(names, name.Name)
+		}
+		nodeID, err := browseByName(client, ua.NewNumericNodeID(0, id.RootFolder), names)
+		if err != nil {
+			log.Printf("Could not resolve node %s: %v", pathNames[i], err)
+			continue
+		}
+		resolved[pathNames[i]] = nodeID
+	}
+	return resolved, nil
+}
+
+// Resolve the symbolic node names in the map and return a map keyed by the node IDs on the server
+func (handlerMap HandlerMap) resolve(client *opcua.Client) (HandlerMap, error) {
+	var symbolic []string
+	for nodeName := range handlerMap {
+		if isSymbolicNodeName(nodeName) {
+			symbolic = append(symbolic, nodeName)
+		}
+	}
+	if len(symbolic) == 0 {
+		return handlerMap, nil
+	}
+	resolved, err := resolveNodeNames(client, symbolic)
+	if err != nil {
+		return nil, err
+	}
+	return handlerMap.withResolvedNodes(resolved), nil
+}
+
+// Re-key the map by the resolved node IDs, sharing the records of the original so that handlers
+// created later, such as for engineering units, are kept. Symbolic names that weren't resolved are left out.
+func (handlerMap HandlerMap) withResolvedNodes(resolved map[string]*ua.NodeID) HandlerMap {
+	resolvedMap := make(HandlerMap)
+	for nodeName, records := range handlerMap {
+		key := nodeName
+		if isSymbolicNodeName(nodeName) {
+			nodeID, ok := resolved[nodeName]
+			if !ok {
+				continue
+			}
+			key = nodeID.String()
+			if *debug {
+				log.Printf("Resolved %s to %s", nodeName, key)
+			}
+		}
+		if existing, ok := resolvedMap[key]; ok {
+			// Two names for the same node; copy so that the original records aren't overwritten
+			resolvedMap[key] = append(append([]handlerMapRecord{}, existing...), records...)
+		} else {
+			resolvedMap[key] = records
+		}
+	}
+	return resolvedMap
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSymbolicNodeName(t *testing.T) {
+	assert.True(t, isSymbolicNodeName("nsu=urn:line1;s=Press.Temperature"))
+	assert.True(t, isSymbolicNodeName("/Objects/Line1/Press/Temperature"))
+	assert.False(t, isSymbolicNodeName("ns=1;s=Voltmeter"))
+	assert.False(t, isSymbolicNodeName("i=2258"))
+}
+
+func TestSplitNamespaceURI(t *testing.T) {
+	uri, rest, err := splitNamespaceURI("nsu=http://example.com/Line1/;s=Press.Temperature")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://example.com/Line1/", uri)
+	assert.Equal(t, "s=Press.Temperature", rest)
+
+	uri, rest, err = splitNamespaceURI("nsu=urn:plant;version=2;/Objects/Line1")
+	assert.Nil(t, err)
+	assert.Equal(t, "urn:plant;version=2", uri)
+	assert.Equal(t, "/Objects/Line1", rest)
+
+	_, _, err = splitNamespaceURI("nsu=urn:plant")
+	assert.NotNil(t, err)
+	_, _, err = splitNamespaceURI("nsu=;i=1")
+	assert.NotNil(t, err)
+}
+
+func TestParseBrowsePath(t *testing.T) {
+	path, err := parseBrowsePath("/Objects/2:Line1/Press/Temperature")
+	assert.Nil(t, err)
+	assert.Equal(t, "", path.NamespaceURI)
+	assert.False(t, path.namespaceFree())
+
+	relativePath, err := path.relativePath([]string{"http://opcfoundation.org/UA/"})
+	assert.Nil(t, err)
+	var names []string
+	var indexes []uint16
+	for _, element := range relativePath.Elements {
+		names = append(names, element.TargetName.Name)
+		indexes = append(indexes, element.TargetName.NamespaceIndex)
+	}
+	assert.Equal(t, []string{"Objects", "Line1", "Press", "Temperature"}, names)
+	assert.Equal(t, []uint16{0, 2, 0, 0}, indexes)
+
+	path, err = parseBrowsePath("/Objects/Line1/Press/Temperature")
+	assert.Nil(t, err)
+	assert.True(t, path.namespaceFree())
+
+	_, err = parseBrowsePath("/Objects//Temperature")
+	assert.NotNil(t, err)
+	_, err = parseBrowsePath("/")
+	assert.NotNil(t, err)
+}
+
+func TestBrowsePathNamespaceURI(t *testing.T) {
+	path, err := parseBrowsePath("nsu=urn:line1;/Objects/Line1/0:Description")
+	assert.Nil(t, err)
+	assert.False(t, path.namespaceFree())
+
+	relativePath, err := path.relativePath([]string{"http://opcfoundation.org/UA/", "urn:server", "urn:line1"})
+	assert.Nil(t, err)
+	var indexes []uint16
+	for _, element := range relativePath.Elements {
+		indexes = append(indexes, element.TargetName.NamespaceIndex)
+	}
+	assert.Equal(t, []uint16{0, 2, 0}, indexes)
+
+	_, err = path.relativePath([]string{"http://opcfoundation.org/UA/"})
+	assert.NotNil(t, err)
+}
+
+func TestParseNamespaceURINodeID(t *testing.T) {
+	namespaces := []string{"http://opcfoundation.org/UA/", "urn:server", "urn:line1"}
+	nodeID, err := parseNamespaceURINodeID("nsu=urn:line1;s=Press.Temperature", namespaces)
+	assert.Nil(t, err)
+	assert.Equal(t, "ns=2;s=Press.Temperature", nodeID.String())
+
+	_, err = parseNamespaceURINodeID("nsu=urn:line2;s=Press.Temperature", namespaces)
+	assert.NotNil(t, err)
+}
+
+func TestWithResolvedNodes(t *testing.T) {
+	handlerMap := HandlerMap{
+		"ns=1;s=Voltmeter":                  {{config: NodeConfig{MetricName: "voltage"}}},
+		"nsu=urn:line1;s=Press.Temperature": {{config: NodeConfig{MetricName: "temperature"}}},
+		"/Objects/Line1/Press/Temperature":  {{config: NodeConfig{MetricName: "temperature_c"}}},
+		"/Objects/Line1/Missing":            {{config: NodeConfig{MetricName: "missing"}}},
+	}
+	resolved := map[string]*ua.NodeID{
+		"nsu=urn:line1;s=Press.Temperature": ua.NewStringNodeID(2, "Press.Temperature"),
+		"/Objects/Line1/Press/Temperature":  ua.NewStringNodeID(2, "Press.Temperature"),
+	}
+	resolvedMap := handlerMap.withResolvedNodes(resolved)
+	assert.Len(t, resolvedMap, 2)
+	assert.Len(t, resolvedMap["ns=1;s=Voltmeter"], 1)
+	assert.Len(t, resolvedMap["ns=2;s=Press.Temperature"], 2)
+	assert.Len(t, handlerMap["nsu=urn:line1;s=Press.Temperature"], 1)
+
+	// Records are shared with the original map, so handlers set on them are kept across reconnects
+	resolvedMap["ns=1;s=Voltmeter"][0].handler = &mockHandler{}
+	assert.NotNil(t, handlerMap["ns=1;s=Voltmeter"][0].handler)
+}
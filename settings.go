@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const configVersion = 1
+
+// ConfigDocument is the versioned config file format. Besides the nodes, it holds the settings
+// otherwise given as command line flags; flags given on the command line override the file.
+//
+// One server is described by the server section, the nodes, instances and discover. For several
+// servers, use servers instead, as in the unversioned format.
+type ConfigDocument struct {
+	Version      int                     `yaml:"version"`
+	Server       ServerSettings          `yaml:"server,omitempty"`
+	Subscription SubscriptionSettings    `yaml:"subscription,omitempty"`
+	HTTP         HTTPSettings            `yaml:"http,omitempty"`
+	Defaults     NodeDefaults            `yaml:"defaults,omitempty"`
+	Include      []string                `yaml:"include,omitempty"`
+	Templates    map[string][]NodeConfig `yaml:"templates,omitempty"`
+	Nodes        []NodeConfig            `yaml:"nodes,omitempty"`
+	Instances    []TemplateInstance      `yaml:"instances,omitempty"`
+	Discover     []DiscoveryConfig       `yaml:"discover,omitempty"`
+	Servers      []ServerConfig          `yaml:"servers,omitempty"`
+	Modules      map[string]ModuleConfig `yaml:"modules,omitempty"`
+}
+
+// ServerSettings holds the connection settings. Security and auth are the defaults for every server.
+type ServerSettings struct {
+	Name                string         `yaml:"name,omitempty"`
+	Endpoint            string         `yaml:"endpoint,omitempty"`
+	Security            SecurityConfig `yaml:"security,omitempty"`
+	Auth                AuthConfig     `yaml:"auth,omitempty"`
+	ReconnectMinBackoff time.Duration  `yaml:"reconnectMinBackoff,omitempty"`
+	ReconnectMaxBackoff time.Duration  `yaml:"reconnectMaxBackoff,omitempty"`
+	StrictNodes         bool           `yaml:"strictNodes,omitempty"`
+	WatchConfig         time.Duration  `yaml:"watchConfig,omitempty"`
+	Debug               bool           `yaml:"debug,omitempty"`
+}
+
+// SubscriptionSettings holds the settings for receiving data changes
+type SubscriptionSettings struct {
+	ReadTimeout     time.Duration `yaml:"readTimeout,omitempty"`
+	MaxTimeouts     int           `yaml:"maxTimeouts,omitempty"`
+	BufferSize      int           `yaml:"bufferSize,omitempty"`
+	SummaryInterval time.Duration `yaml:"summaryInterval,omitempty"`
+}
+
+// HTTPSettings holds the settings for serving /metrics and /probe
+type HTTPSettings struct {
+	Port         int           `yaml:"port,omitempty"`
+	ProbeTimeout time.Duration `yaml:"probeTimeout,omitempty"`
+}
+
+// NodeDefaults apply to every node, unless the node says otherwise
+type NodeDefaults struct {
+	PromPrefix string            `yaml:"promPrefix,omitempty"`
+	Type       string            `yaml:"type,omitempty"`
+	Labels     map[string]string `yaml:"labels,omitempty"`
+	Monitoring MonitoringConfig  `yaml:"monitoring,omitempty"`
+}
+
+// The flag each setting in the document corresponds to
+var documentFlags = []struct {
+	name  string
+	field func(d *ConfigDocument) interface{}
+}{
+	{"endpoint", func(d *ConfigDocument) interface{} { return &d.Server.Endpoint }},
+	{"security-policy", func(d *ConfigDocument) interface{} { return &d.Server.Security.Policy }},
+	{"security-mode", func(d *ConfigDocument) interface{} { return &d.Server.Security.Mode }},
+	{"cert", func(d *ConfigDocument) interface{} { return &d.Server.Security.CertFile }},
+	{"key", func(d *ConfigDocument) interface{} { return &d.Server.Security.KeyFile }},
+	{"pki-dir", func(d *ConfigDocument) interface{} { return &d.Server.Security.PKIDir }},
+	{"application-uri", func(d *ConfigDocument) interface{} { return &d.Server.Security.ApplicationURI }},
+	{"auth-mode", func(d *ConfigDocument) interface{} { return &d.Server.Auth.Mode }},
+	{"username", func(d *ConfigDocument) interface{} { return &d.Server.Auth.Username }},
+	{"password-file", func(d *ConfigDocument) interface{} { return &d.Server.Auth.PasswordFile }},
+	{"password-env", func(d *ConfigDocument) interface{} { return &d.Server.Auth.PasswordEnv }},
+	{"user-cert", func(d *ConfigDocument) interface{} { return &d.Server.Auth.CertFile }},
+	{"reconnect-min-backoff", func(d *ConfigDocument) interface{} { return &d.Server.ReconnectMinBackoff }},
+	{"reconnect-max-backoff", func(d *ConfigDocument) interface{} { return &d.Server.ReconnectMaxBackoff }},
+	{"strict-nodes", func(d *ConfigDocument) interface{} { return &d.Server.StrictNodes }},
+	{"watch-config", func(d *ConfigDocument) interface{} { return &d.Server.WatchConfig }},
+	{"debug", func(d *ConfigDocument) interface{} { return &d.Server.Debug }},
+	{"read-timeout", func(d *ConfigDocument) interface{} { return &d.Subscription.ReadTimeout }},
+	{"max-timeouts", func(d *ConfigDocument) interface{} { return &d.Subscription.MaxTimeouts }},
+	{"buffer-size", func(d *ConfigDocument) interface{} { return &d.Subscription.BufferSize }},
+	{"summary-interval", func(d *ConfigDocument) interface{} { return &d.Subscription.SummaryInterval }},
+	{"port", func(d *ConfigDocument) interface{} { return &d.HTTP.Port }},
+	{"probe-timeout", func(d *ConfigDocument) interface{} { return &d.HTTP.ProbeTimeout }},
+	{"prom-prefix", func(d *ConfigDocument) interface{} { return &d.Defaults.PromPrefix }},
+}
+
+// Parse a versioned config document
+func parseConfigDocument(content []byte) (*ConfigDocument, error) {
+	var doc ConfigDocument
+	if err := yaml.UnmarshalStrict(content, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Version != configVersion {
+		return nil, fmt.Errorf("Unsupported config version %d (expected %d)", doc.Version, configVersion)
+	}
+	return &doc, nil
+}
+
+// Config returns the servers and modules the document describes, with the node defaults applied
+func (d *ConfigDocument) Config() (*Config, error) {
+	config, err := d.config()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.complete(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// The servers and modules the document describes, before its templates are expanded and the node defaults applied
+func (d *ConfigDocument) config() (*Config, error) {
+	config := &Config{
+		Servers:   append([]ServerConfig(nil), d.Servers...),
+		Templates: d.Templates,
+		Include:   d.Include,
+		settings:  d.flagValues(),
+		defaults:  d.Defaults,
+	}
+	if d.Modules != nil {
+		config.Modules = make(map[string]ModuleConfig)
+		for name, module := range d.Modules {
+			config.Modules[name] = module
+		}
+	}
+	if len(d.Servers) > 0 {
+		if len(d.Nodes) > 0 || len(d.Instances) > 0 || len(d.Discover) > 0 || d.Server.Name != "" || d.Server.Endpoint != "" {
+			return nil, fmt.Errorf("Config has both servers and a single server's name, endpoint, nodes, instances or discover")
+		}
+		if err := config.validateServers(); err != nil {
+			return nil, err
+		}
+		for i := range config.Servers {
+			config.Servers[i].Auth = d.Server.Auth.passwordDefault(config.Servers[i].Auth)
+		}
+	} else if len(d.Nodes) > 0 || len(d.Instances) > 0 || len(d.Discover) > 0 || len(d.Modules) == 0 {
+		// The endpoint, security and auth come from the flags, which the server section sets
+		config.Servers = []ServerConfig{{Name: d.Server.Name, Nodes: d.Nodes, Instances: d.Instances, Discover: d.Discover}}
+		config.Servers[0].Auth.Password = d.Server.Auth.Password // there is no flag for it
+	}
+	for name, module := range config.Modules {
+		module.Auth = d.Server.Auth.passwordDefault(module.Auth)
+		config.Modules[name] = module
+	}
+	return config, nil
+}
+
+// The password in the server section has no flag to carry it, so it is given here to the servers and
+// modules that take their auth from the flags, i.e. those without an auth section of their own
+func (defaults AuthConfig) passwordDefault(auth AuthConfig) AuthConfig {
+	if auth == (AuthConfig{}) {
+		auth.Password = defaults.Password
+	}
+	return auth
+}
+
+func (defaults NodeDefaults) apply(nodeConfigs []NodeConfig) []NodeConfig {
+	if defaults.Type == "" && len(defaults.Labels) == 0 && defaults.Monitoring == (MonitoringConfig{}) {
+		return nodeConfigs
+	}
+	var result []NodeConfig
+	for _, nodeConfig := range nodeConfigs {
+		if nodeConfig.Type == "" {
+			nodeConfig.Type = defaults.Type
+		}
+		nodeConfig.Monitoring = nodeConfig.Monitoring.withDefaults(defaults.Monitoring)
+		if len(defaults.Labels) > 0 {
+			labels := make(map[string]string)
+			for name, value := range defaults.Labels {
+				labels[name] = value
+			}
+			for name, value := range nodeConfig.Labels {
+				labels[name] = value
+			}
+			nodeConfig.Labels = labels
+		}
+		result = append(result, nodeConfig)
+	}
+	return result
+}
+
+// The settings given in the document, as flag values
+func (d *ConfigDocument) flagValues() map[string]string {
+	values := make(map[string]string)
+	for _, documentFlag := range documentFlags {
+		value := reflect.ValueOf(documentFlag.field(d)).Elem()
+		if !value.IsZero() {
+			values[documentFlag.name] = fmt.Sprint(value.Interface())
+		}
+	}
+	return values
+}
+
+// Set the document's settings from the flag values
+func (d *ConfigDocument) setFlagValues(values map[string]string) error {
+	for _, documentFlag := range documentFlags {
+		value, ok := values[documentFlag.name]
+		if !ok {
+			continue
+		}
+		field := documentFlag.field(d)
+		if s, ok := field.(*string); ok {
+			*s = value
+		} else if err := yaml.Unmarshal([]byte(value), field); err != nil {
+			return fmt.Errorf("Invalid value %q for -%s: %v", value, documentFlag.name, err)
+		}
+	}
+	return nil
+}
+
+// Set the flags from the config file settings, unless they were given on the command line
+func applySettings(settings map[string]string, flags *flag.FlagSet) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for name, value := range settings {
+		if given[name] || flags.Lookup(name) == nil {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("Invalid value %q for %s in config file: %v", value, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfigDocument(t *testing.T) {
+	yaml := `
+version: 1
+server:
+  name: press1
+  endpoint: opc.tcp://plc1:4840
+  security:
+    policy: Basic256Sha256
+  reconnectMaxBackoff: 30s
+subscription:
+  bufferSize: 128
+  readTimeout: 10s
+http:
+  port: 9687
+defaults:
+  promPrefix: plant
+  type: gauge
+  labels:
+    line: "1"
+nodes:
+  - nodeName: ns=1;s=Temperature
+    metricName: press_temperature
+  - nodeName: ns=1;s=Pieces
+    metricName: pieces_total
+    type: counter
+    labels:
+      line: "2"
+`
+	config, err := parseConfig(strings.NewReader(yaml))
+	assert.NoError(t, err)
+	assert.Len(t, config.Servers, 1)
+	server := config.Servers[0]
+	assert.Equal(t, "press1", server.Name)
+	assert.Equal(t, "", server.Endpoint) // comes from the flags
+	assert.Equal(t, "gauge", server.Nodes[0].Type)
+	assert.Equal(t, map[string]string{"line": "1"}, server.Nodes[0].Labels)
+	assert.Equal(t, "counter", server.Nodes[1].Type)
+	assert.Equal(t, map[string]string{"line": "2"}, server.Nodes[1].Labels)
+
+	assert.Equal(t, map[string]string{
+		"endpoint":              "opc.tcp://plc1:4840",
+		"security-policy":       "Basic256Sha256",
+		"reconnect-max-backoff": "30s",
+		"buffer-size":           "128",
+		"read-timeout":          "10s",
+		"port":                  "9687",
+		"prom-prefix":           "plant",
+	}, config.settings)
+}
+
+func TestParseConfigDocumentServers(t *testing.T) {
+	yaml := `
+version: 1
+server:
+  auth:
+    mode: UserName
+    username: exporter
+    password: secret
+  watchConfig: 30s
+servers:
+  - name: press1
+    endpoint: opc.tcp://plc1:4840
+    nodes: []
+  - name: press2
+    endpoint: opc.tcp://plc2:4840
+    auth:
+      mode: Anonymous
+    nodes: []
+modules:
+  press:
+    nodes: []
+`
+	config, err := parseConfig(strings.NewReader(yaml))
+	assert.NoError(t, err)
+	// the password goes with the auth from the flags, but not with a server's own auth section
+	assert.Equal(t, AuthConfig{Password: "secret"}, config.Servers[0].Auth)
+	assert.Equal(t, AuthConfig{Mode: "Anonymous"}, config.Servers[1].Auth)
+	assert.Equal(t, AuthConfig{Password: "secret"}, config.Modules["press"].Auth)
+	assert.Equal(t, map[string]string{
+		"auth-mode":    "UserName",
+		"username":     "exporter",
+		"watch-config": "30s",
+	}, config.settings)
+}
+
+func TestParseConfigDocumentErrors(t *testing.T) {
+	badConfigs := []string{
+		"version: 2\nnodes: []\n",
+		"version: 1\nsubscription:\n  bufferSize: 64\n  interval: 1s\n",
+		"version: 1\nnodes:\n  - nodeName: ns=1;s=A\n    metricName: a\nservers:\n  - name: press\n    nodes: []\n",
+	}
+	for _, yaml := range badConfigs {
+		_, err := parseConfig(strings.NewReader(yaml))
+		assert.Error(t, err, yaml)
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	endpoint := flags.String("endpoint", "opc.tcp://localhost:4096", "")
+	bufferSize := flags.Int("buffer-size", 64, "")
+	readTimeout := flags.Duration("read-timeout", 5*time.Second, "")
+	assert.NoError(t, flags.Parse([]string{"-buffer-size", "32"}))
+
+	settings := map[string]string{"endpoint": "opc.tcp://plc1:4840", "buffer-size": "128", "read-timeout": "10s", "port": "9687"}
+	assert.NoError(t, applySettings(settings, flags))
+	assert.Equal(t, "opc.tcp://plc1:4840", *endpoint)
+	assert.Equal(t, 32, *bufferSize) // the command line wins
+	assert.Equal(t, 10*time.Second, *readTimeout)
+
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Duration("read-timeout", 5*time.Second, "")
+	assert.Error(t, applySettings(map[string]string{"read-timeout": "soon"}, flags))
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/monitor"
+	"github.com/gopcua/opcua/ua"
+)
+
+// subscriptions monitors the nodes of a HandlerMap on one connection, with a subscription for each
+// publishing interval. All of them deliver their notifications to the same channel. Only the
+// goroutine running setupMonitor uses it.
+type subscriptions struct {
+	ctx        context.Context
+	client     *opcua.Client
+	server     string // name, for the node status
+	notifyCh   chan *opcua.PublishNotificationData
+	groups     map[time.Duration]*subscriptionGroup // by publishing interval
+	items      map[string]monitoredItem             // by node ID
+	nodeIDs    map[uint32]*ua.NodeID                // by client handle
+	nextHandle uint32
+	delivered  uint64
+}
+
+// subscriptionGroup is the subscription of the nodes with the same publishing interval
+type subscriptionGroup struct {
+	sub    *opcua.Subscription
+	cancel context.CancelFunc // stops its publishing loop
+	nodes  int
+}
+
+type monitoredItem struct {
+	interval time.Duration
+	handle   uint32 // ours
+	id       uint32 // the server's
+}
+
+func newSubscriptions(ctx context.Context, client *opcua.Client, server string, bufferSize int) *subscriptions {
+	return &subscriptions{
+		ctx:      ctx,
+		client:   client,
+		server:   server,
+		notifyCh: make(chan *opcua.PublishNotificationData, bufferSize),
+		groups:   make(map[time.Duration]*subscriptionGroup),
+		items:    make(map[string]monitoredItem),
+		nodeIDs:  make(map[uint32]*ua.NodeID),
+	}
+}
+
+// The subscription for a publishing interval, created if there isn't one yet
+func (s *subscriptions) group(interval time.Duration) (*subscriptionGroup, error) {
+	if group, ok := s.groups[interval]; ok {
+		return group, nil
+	}
+	sub, err := s.client.Subscribe(&opcua.SubscriptionParameters{Interval: interval}, s.notifyCh)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	go sub.Run(ctx)
+	group := &subscriptionGroup{sub: sub, cancel: cancel}
+	s.groups[interval] = group
+	log.Printf("Created subscription sub=%d with publishing interval %v (revised to %v)", sub.SubscriptionID, interval, sub.RevisedPublishingInterval)
+	return group, nil
+}
+
+// Monitor nodes of the map, each in the subscription for its publishing interval. Nodes the server
+// refuses to monitor, e.g. because it doesn't support their deadband, are logged and reported in
+// the node status; the others are monitored anyway.
+func (s *subscriptions) add(handlerMap HandlerMap, nodeNames []string) error {
+	requests := make(map[time.Duration][]*ua.MonitoredItemCreateRequest)
+	requestNodes := make(map[time.Duration][]string)
+	for _, nodeName := range nodeNames {
+		nodeID, err := ua.ParseNodeID(nodeName)
+		if err != nil {
+			return fmt.Errorf("Invalid node ID %s: %v", nodeName, err)
+		}
+		monitoring := handlerMap.monitoring(nodeName)
+		interval := monitoring.publishingInterval()
+		s.nextHandle++
+		s.nodeIDs[s.nextHandle] = nodeID
+		requests[interval] = append(requests[interval], monitoring.createRequest(nodeID, s.nextHandle))
+		requestNodes[interval] = append(requestNodes[interval], nodeName)
+	}
+
+	var intervals []time.Duration
+	for interval := range requests {
+		intervals = append(intervals, interval)
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	for _, interval := range intervals {
+		group, err := s.group(interval)
+		if err != nil {
+			return err
+		}
+		toAdd := requests[interval]
+		res, err := group.sub.Monitor(ua.TimestampsToReturnBoth, toAdd...)
+		if err != nil {
+			return err
+		}
+		if res.ResponseHeader.ServiceResult != ua.StatusOK {
+			return res.ResponseHeader.ServiceResult
+		}
+		if len(res.Results) != len(toAdd) {
+			return fmt.Errorf("Got %d results for %d monitored items", len(res.Results), len(toAdd))
+		}
+		for i, result := range res.Results {
+			nodeName := requestNodes[interval][i]
+			handle := toAdd[i].RequestedParameters.ClientHandle
+			if result.StatusCode != ua.StatusOK {
+				log.Printf("Error monitoring node %s: %v", nodeName, result.StatusCode)
+				for _, record := range handlerMap[nodeName] {
+					setNodeStatus(s.server, statusNodeName(record.config), record.config.MetricName, nodeStatusNotMonitored)
+				}
+				delete(s.nodeIDs, handle)
+				continue
+			}
+			s.items[nodeName] = monitoredItem{interval: interval, handle: handle, id: result.MonitoredItemID}
+			group.nodes++
+		}
+	}
+	return nil
+}
+
+// Stop monitoring nodes. A subscription left without nodes is deleted.
+func (s *subscriptions) remove(nodeNames []string) error {
+	ids := make(map[time.Duration][]uint32)
+	for _, nodeName := range nodeNames {
+		item, ok := s.items[nodeName]
+		if !ok {
+			continue // the server refused to monitor it
+		}
+		ids[item.interval] = append(ids[item.interval], item.id)
+		delete(s.items, nodeName)
+		delete(s.nodeIDs, item.handle)
+	}
+
+	for interval, toRemove := range ids {
+		group := s.groups[interval]
+		group.nodes -= len(toRemove)
+		if group.nodes == 0 {
+			s.cancel(interval)
+			continue
+		}
+		res, err := group.sub.Unmonitor(toRemove...)
+		if err != nil {
+			return err
+		}
+		if res.ResponseHeader.ServiceResult != ua.StatusOK {
+			return res.ResponseHeader.ServiceResult
+		}
+		for _, status := range res.Results {
+			if status != ua.StatusOK {
+				return status
+			}
+		}
+	}
+	return nil
+}
+
+// Monitor the nodes new in the map, or whose monitoring settings changed, and stop monitoring those that are gone
+func (s *subscriptions) update(oldMap HandlerMap, newMap HandlerMap) error {
+	added, removed := changedNodes(oldMap, newMap)
+	if err := s.remove(removed); err != nil {
+		return fmt.Errorf("Error removing nodes from the subscriptions: %v", err)
+	}
+	if err := s.add(newMap, added); err != nil {
+		return fmt.Errorf("Error adding nodes to the subscriptions: %v", err)
+	}
+	log.Printf("Updated subscriptions: %d nodes added, %d removed", len(added), len(removed))
+	return nil
+}
+
+// Status codes of a notification meaning the session or subscription is gone
+var fatalNotificationStatuses = map[ua.StatusCode]bool{
+	ua.StatusBadSessionIDInvalid:       true,
+	ua.StatusBadSessionClosed:          true,
+	ua.StatusBadSessionNotActivated:    true,
+	ua.StatusBadSubscriptionIDInvalid:  true,
+	ua.StatusBadNoSubscription:         true,
+	ua.StatusBadSecureChannelIDInvalid: true,
+	ua.StatusBadSecureChannelClosed:    true,
+	ua.StatusBadConnectionClosed:       true,
+	ua.StatusBadServerNotConnected:     true,
+	ua.StatusBadShutdown:               true,
+}
+
+// The data changes of a notification, for handleMessage. An error is returned only if the
+// session or the subscription is gone; other problems with a notification are logged and counted.
+func (s *subscriptions) messages(data *opcua.PublishNotificationData) ([]*monitor.DataChangeMessage, error) {
+	if data.Error != nil {
+		// Without a subscription, the error stopped the publishing loop
+		if status, ok := data.Error.(ua.StatusCode); data.SubscriptionID == 0 || ok && fatalNotificationStatuses[status] {
+			return nil, data.Error
+		}
+		s.notificationError("Error in notification on sub=%d: %v", data.SubscriptionID, data.Error)
+		return nil, nil
+	}
+	var notification *ua.DataChangeNotification
+	switch value := data.Value.(type) {
+	case *ua.DataChangeNotification:
+		notification = value
+	case *ua.StatusChangeNotification:
+		if value.Status != ua.StatusOK {
+			return nil, fmt.Errorf("Subscription sub=%d changed status to %v", data.SubscriptionID, value.Status)
+		}
+		return nil, nil
+	default:
+		s.notificationError("Unexpected notification %T on sub=%d", data.Value, data.SubscriptionID)
+		return nil, nil
+	}
+	var messages []*monitor.DataChangeMessage
+	for _, item := range notification.MonitoredItems {
+		message := &monitor.DataChangeMessage{DataValue: item.Value}
+		if nodeID, ok := s.nodeIDs[item.ClientHandle]; ok {
+			message.NodeID = nodeID
+		} else {
+			message.Error = fmt.Errorf("Unknown client handle %d on sub=%d", item.ClientHandle, data.SubscriptionID)
+		}
+		messages = append(messages, message)
+	}
+	s.delivered += uint64(len(messages))
+	return messages, nil
+}
+
+// Log a notification that can't be used, and count it
+func (s *subscriptions) notificationError(format string, args ...interface{}) {
+	log.Printf(format, args...)
+	notificationErrorCounter.WithLabelValues(s.server).Inc()
+}
+
+// How long to wait for a notification before it counts as a timeout: the read timeout, or the
+// longest publishing interval if a subscription publishes less often than that
+func (s *subscriptions) readTimeout(timeout time.Duration) time.Duration {
+	for _, group := range s.groups {
+		if group.sub.RevisedPublishingInterval > timeout {
+			timeout = group.sub.RevisedPublishingInterval
+		}
+	}
+	return timeout
+}
+
+// Delete a subscription from the server
+func (s *subscriptions) cancel(interval time.Duration) {
+	group := s.groups[interval]
+	group.cancel()
+	if err := group.sub.Cancel(); err != nil {
+		log.Printf("Error deleting subscription sub=%d: %v", group.sub.SubscriptionID, err)
+	}
+	delete(s.groups, interval)
+}
+
+// Delete all the subscriptions
+func (s *subscriptions) close() {
+	for interval, group := range s.groups {
+		log.Printf("stats: sub=%d interval=%v nodes=%d", group.sub.SubscriptionID, interval, group.nodes)
+		s.cancel(interval)
+	}
+	log.Printf("stats: delivered=%d", s.delivered)
+}
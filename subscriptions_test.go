@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionsMessages(t *testing.T) {
+	subs := newSubscriptions(context.Background(), nil, "", 1)
+	nodeID := ua.NewStringNodeID(1, "Temperature")
+	subs.nodeIDs[101] = nodeID
+
+	value := &ua.DataValue{Value: ua.MustVariant(21.5)}
+	messages, err := subs.messages(&opcua.PublishNotificationData{
+		SubscriptionID: 1,
+		Value: &ua.DataChangeNotification{MonitoredItems: []*ua.MonitoredItemNotification{
+			{ClientHandle: 101, Value: value},
+			{ClientHandle: 102, Value: value},
+		}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, nodeID, messages[0].NodeID)
+	assert.Equal(t, value, messages[0].DataValue)
+	assert.NoError(t, messages[0].Error)
+	assert.Error(t, messages[1].Error)
+	assert.Equal(t, uint64(2), subs.delivered)
+
+}
+
+func TestSubscriptionsMessagesErrors(t *testing.T) {
+	subs := newSubscriptions(context.Background(), nil, "press", 1)
+	errors := notificationErrorCounter.WithLabelValues("press")
+	before := testutil.ToFloat64(errors)
+
+	// Errors of a single notification are counted and skipped
+	messages, err := subs.messages(&opcua.PublishNotificationData{SubscriptionID: 1, Error: ua.StatusBadTimeout})
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+	_, err = subs.messages(&opcua.PublishNotificationData{SubscriptionID: 1, Error: fmt.Errorf("empty NotificationMessage")})
+	assert.NoError(t, err)
+	_, err = subs.messages(&opcua.PublishNotificationData{SubscriptionID: 1, Value: &ua.EventNotificationList{}})
+	assert.NoError(t, err)
+	_, err = subs.messages(&opcua.PublishNotificationData{SubscriptionID: 1, Value: &ua.StatusChangeNotification{Status: ua.StatusOK}})
+	assert.NoError(t, err)
+	assert.Equal(t, before+3, testutil.ToFloat64(errors))
+
+	// The session or the subscription being gone isn't
+	_, err = subs.messages(&opcua.PublishNotificationData{SubscriptionID: 1, Error: ua.StatusBadSessionIDInvalid})
+	assert.Equal(t, ua.StatusBadSessionIDInvalid, err)
+	_, err = subs.messages(&opcua.PublishNotificationData{SubscriptionID: 1, Error: ua.StatusBadSubscriptionIDInvalid})
+	assert.Equal(t, ua.StatusBadSubscriptionIDInvalid, err)
+	_, err = subs.messages(&opcua.PublishNotificationData{Error: io.EOF})
+	assert.Equal(t, io.EOF, err)
+	_, err = subs.messages(&opcua.PublishNotificationData{SubscriptionID: 1, Value: &ua.StatusChangeNotification{Status: ua.StatusBadTimeout}})
+	assert.Error(t, err)
+	assert.Equal(t, before+3, testutil.ToFloat64(errors))
+}
+
+func TestSubscriptionsRemoveUnmonitored(t *testing.T) {
+	subs := newSubscriptions(context.Background(), nil, "", 1)
+	assert.NoError(t, subs.remove([]string{"ns=1;s=Refused"}), "nodes the server refused are skipped")
+}
+
+func TestSubscriptionsReadTimeout(t *testing.T) {
+	subs := newSubscriptions(context.Background(), nil, "", 1)
+	assert.Equal(t, 5*time.Second, subs.readTimeout(5*time.Second))
+	subs.groups[time.Second] = &subscriptionGroup{sub: &opcua.Subscription{RevisedPublishingInterval: time.Second}}
+	subs.groups[time.Minute] = &subscriptionGroup{sub: &opcua.Subscription{RevisedPublishingInterval: 2 * time.Minute}}
+	assert.Equal(t, 2*time.Minute, subs.readTimeout(5*time.Second), "the slowest subscription's interval")
+}
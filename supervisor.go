@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConnectionSupervisor owns the connection to a single OPC UA server.
+// It (re)connects with exponential backoff and re-creates the subscription
+// for every node in the HandlerMap each time a session is established,
+// so that a server restart doesn't take the exporter down with it.
+// The nodes can be replaced with Reload while it runs.
+type ConnectionSupervisor struct {
+	Server          ServerConfig
+	HandlerMap      HandlerMap
+	Factory         *MetricFactory // creates the metrics for discovered nodes
+	BufferSize      int
+	Backoff         *Backoff
+	discovered      bool
+	discoveredNodes []NodeConfig
+	lastConnect     time.Time
+	mutex           sync.Mutex
+
+	nodesMutex sync.Mutex      // held while the HandlerMap is changed or prepared for a subscription
+	client     *opcua.Client   // the connected client while subscribed, nil otherwise
+	updates    chan HandlerMap // a reloaded HandlerMap for the running subscription
+
+	nodesChecked bool // -strict-nodes only applies to the first check of the nodes
+
+	session func(ctx context.Context, subscribed func()) error // connectAndMonitor, replaced in tests
+}
+
+// NewConnectionSupervisor creates a supervisor for the given server
+func NewConnectionSupervisor(server ServerConfig, handlerMap HandlerMap, factory *MetricFactory, bufferSize int, backoff *Backoff) *ConnectionSupervisor {
+	cs := &ConnectionSupervisor{
+		Server:     server,
+		HandlerMap: handlerMap,
+		Factory:    factory,
+		BufferSize: bufferSize,
+		Backoff:    backoff,
+		updates:    make(chan HandlerMap, 1),
+	}
+	cs.session = cs.connectAndMonitor
+	return cs
+}
+
+// Run connects, monitors and reconnects until the context is cancelled.
+// The backoff starts over only once a session gets as far as subscribing, so that a server
+// which accepts connections but fails later on isn't retried at the minimum delay forever.
+func (cs *ConnectionSupervisor) Run(ctx context.Context) {
+	cs.setConnected(false)
+	for {
+		if err := cs.session(ctx, cs.Backoff.Reset); err != nil {
+			log.Print(err)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := cs.Backoff.Next()
+		log.Printf("Reconnecting to %s in %v", cs.Server.Endpoint, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+			reconnectCounter.WithLabelValues(cs.Server.Name, cs.Server.Endpoint).Inc()
+		}
+	}
+}
+
+// Connect, subscribe to the nodes and monitor them until the session is lost or the context is cancelled.
+// subscribed is called once the subscription is established.
+func (cs *ConnectionSupervisor) connectAndMonitor(ctx context.Context, subscribed func()) error {
+	endpoint := cs.Server.Endpoint
+	log.Printf("Connecting to OPCUA server at %s", endpoint)
+	client, err := getClient(ctx, endpoint, cs.Server.Security, cs.Server.Auth)
+	if err == nil {
+		err = client.Connect(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("Error connecting to OPC UA server: %v", err)
+	}
+	defer client.Close()
+	log.Print("Connected successfully")
+	cs.setConnected(true)
+	defer cs.setConnected(false)
+
+	var handlerMap HandlerMap
+	cs.nodesMutex.Lock()
+	if err = cs.discover(client); err != nil {
+		err = fmt.Errorf("Error discovering nodes on %s: %v", endpoint, err)
+	} else if handlerMap, err = cs.prepareNodes(client); err == nil {
+		cs.client = client
+	}
+	cs.nodesMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = setupMonitor(ctx, client, cs.Server.Name, handlerMap, cs.BufferSize, cs.updates, subscribed)
+	cs.nodesMutex.Lock()
+	cs.client = nil
+	select {
+	case <-cs.updates: // the next connect starts from the reloaded HandlerMap anyway
+	default:
+	}
+	cs.nodesMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("Lost subscription to %s: %v", endpoint, err)
+	}
+	return nil
+}
+
+// Browse for the configured subtrees once, on the first successful connection.
+// Metrics, once created, stay for the life of the exporter.
+func (cs *ConnectionSupervisor) discover(client *opcua.Client) error {
+	if cs.discovered || len(cs.Server.Discover) == 0 {
+		return nil
+	}
+	nodeConfigs, err := discoverNodes(client, cs.Server.Discover, cs.Server.Nodes)
+	if err != nil {
+		return err
+	}
+	if err := cs.HandlerMap.addNodes(nodeConfigs, cs.Factory); err != nil {
+		return err
+	}
+	cs.discovered = true
+	cs.discoveredNodes = nodeConfigs
+	return nil
+}
+
+// Resolve the node names, check the nodes and create the handlers waiting for engineering units.
+// Node names are resolved on every connect, as the server may have been reconfigured.
+// Returns the HandlerMap keyed by the node IDs to subscribe to.
+func (cs *ConnectionSupervisor) prepareNodes(client *opcua.Client) (HandlerMap, error) {
+	handlerMap, err := cs.HandlerMap.resolve(client)
+	if err != nil {
+		log.Printf("Error resolving node names on %s: %v", cs.Server.Endpoint, err)
+		return nil, err
+	}
+	cs.setUpNodes(client, handlerMap)
+	return handlerMap, nil
+}
+
+// Check the resolved nodes and create the handlers waiting for engineering units
+func (cs *ConnectionSupervisor) setUpNodes(client *opcua.Client, handlerMap HandlerMap) {
+	cs.checkNodes(client, handlerMap)
+	for nodeName, metricNames := range resolveEngineeringUnits(client, handlerMap) {
+		for _, metricName := range metricNames {
+			setNodeStatus(cs.Server.Name, nodeName, metricName, nodeStatusEUError)
+		}
+	}
+}
+
+// pendingReload is a server's new list of nodes, checked and with its node names resolved,
+// to be applied by commitReload. It also holds the old list, to go back to if another server fails.
+type pendingReload struct {
+	nodeConfigs    []NodeConfig
+	allConfigs     []NodeConfig          // with the discovered nodes
+	resolved       map[string]*ua.NodeID // the symbolic node names of the old and new nodes, while subscribed
+	oldNodeConfigs []NodeConfig
+	oldAllConfigs  []NodeConfig
+}
+
+// The reload that puts the old nodes back
+func (p *pendingReload) rollback() *pendingReload {
+	return &pendingReload{nodeConfigs: p.oldNodeConfigs, allConfigs: p.oldAllConfigs, resolved: p.resolved}
+}
+
+// prepareReload checks a new list of nodes and, while subscribed, resolves the node names on the server.
+// Nothing changes until commitReload. Both are called with nodesMutex held, so that the server
+// doesn't reconnect in between.
+func (cs *ConnectionSupervisor) prepareReload(nodeConfigs []NodeConfig) (*pendingReload, error) {
+	allConfigs := append(append([]NodeConfig{}, nodeConfigs...), cs.discoveredNodes...)
+	if err := validateNodes(allConfigs); err != nil {
+		return nil, err
+	}
+	pending := &pendingReload{
+		nodeConfigs:    nodeConfigs,
+		allConfigs:     allConfigs,
+		oldNodeConfigs: cs.Server.Nodes,
+		oldAllConfigs:  append(append([]NodeConfig{}, cs.Server.Nodes...), cs.discoveredNodes...),
+	}
+	if cs.client == nil {
+		return pending, nil // not subscribed; the next connect resolves the new nodes
+	}
+
+	var symbolic []string
+	for _, nodeConfig := range append(append([]NodeConfig{}, allConfigs...), pending.oldAllConfigs...) {
+		if nodeName, _ := canonicalNodeName(nodeConfig.NodeName); isSymbolicNodeName(nodeName) {
+			symbolic = append(symbolic, nodeName)
+		}
+	}
+	resolved, err := resolveNodeNames(cs.client, symbolic)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving node names on %s: %v", cs.Server.Endpoint, err)
+	}
+	pending.resolved = resolved
+	return pending, nil
+}
+
+// commitReload replaces the configured nodes with those of a prepared reload. Metrics of nodes that were
+// removed or changed are removed, and those of new and changed nodes created; the rest carry on as they were.
+// While subscribed, the running subscription is updated to match, keeping the session.
+// If the new metrics can't be created, the old nodes are kept, with their metrics restored; if the
+// nodes are invalid, the map and the subscription are left alone.
+func (cs *ConnectionSupervisor) commitReload(pending *pendingReload) error {
+	handlerMap, err := cs.HandlerMap.reload(pending.allConfigs, cs.Factory, cs.Server.Name)
+	if handlerMap == nil {
+		return err // the nodes are invalid, and nothing was changed
+	}
+	cs.HandlerMap = handlerMap
+	if err == nil {
+		cs.Server.Nodes = pending.nodeConfigs
+	}
+	if cs.client != nil {
+		resolved := handlerMap.withResolvedNodes(pending.resolved)
+		cs.setUpNodes(cs.client, resolved)
+		select {
+		case <-cs.updates: // replaced by this one
+		default:
+		}
+		cs.updates <- resolved
+	}
+	return err
+}
+
+// Check the nodes against the server on every connect. The check is advisory, so the nodes are
+// subscribed to even if it fails, except that -strict-nodes exits if any have problems the first time.
+// On later connects and reloads, problems are only logged and reported in the node status.
+func (cs *ConnectionSupervisor) checkNodes(client *opcua.Client, handlerMap HandlerMap) {
+	problems, err := checkNodes(client, cs.Server.Name, cs.HandlerMap, handlerMap)
+	if err != nil {
+		log.Printf("Error checking nodes on %s: %v", cs.Server.Endpoint, err)
+		return
+	}
+	if problems > 0 && *strictNodes && !cs.nodesChecked {
+		log.Fatalf("%d configured nodes on %s have problems, see above; exiting because of -strict-nodes", problems, cs.Server.Endpoint)
+	}
+	cs.nodesChecked = true
+}
+
+// Register the metrics of this server's connection, labelled with the server name, which is unique
+func (cs *ConnectionSupervisor) registerMetrics(registerer prometheus.Registerer) error {
+	return registerer.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem:   "opcua_exporter",
+		Name:        "seconds_since_last_connect",
+		Help:        "Time in seconds since the last OPCUA session was established (-1 if never connected)",
+		ConstLabels: prometheus.Labels{"server": cs.Server.Name, "endpoint": cs.Server.Endpoint},
+	}, cs.SecondsSinceLastConnect))
+}
+
+// SecondsSinceLastConnect reports how long ago the last session was established,
+// or -1 if we have never connected.
+func (cs *ConnectionSupervisor) SecondsSinceLastConnect() float64 {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.lastConnect.IsZero() {
+		return -1
+	}
+	return time.Since(cs.lastConnect).Seconds()
+}
+
+func (cs *ConnectionSupervisor) setConnected(connected bool) {
+	if connected {
+		cs.mutex.Lock()
+		cs.lastConnect = time.Now()
+		cs.mutex.Unlock()
+		connectionStateGauge.WithLabelValues(cs.Server.Name, cs.Server.Endpoint).Set(1)
+	} else {
+		connectionStateGauge.WithLabelValues(cs.Server.Name, cs.Server.Endpoint).Set(0)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// Run a supervisor with a fake session until it has had the given number of sessions.
+// Returns the backoff attempt at the start of each session.
+func runSessions(t *testing.T, sessions int, session func(subscribed func()) error) []int {
+	backoff := NewBackoff(time.Millisecond, time.Second)
+	backoff.Jitter = 0
+	cs := NewConnectionSupervisor(ServerConfig{Name: "press", Endpoint: "opc.tcp://press:4840"}, make(HandlerMap), nil, 1, backoff)
+	ctx, cancel := context.WithCancel(context.Background())
+	var attempts []int
+	cs.session = func(ctx context.Context, subscribed func()) error {
+		attempts = append(attempts, backoff.attempt)
+		if len(attempts) == sessions {
+			cancel()
+		}
+		return session(subscribed)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cs.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("supervisor didn't stop")
+	}
+	return attempts
+}
+
+func TestSupervisorBackoffWithoutSubscription(t *testing.T) {
+	attempts := runSessions(t, 5, func(subscribed func()) error {
+		return fmt.Errorf("Error reading engineering units")
+	})
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, attempts, "the backoff keeps growing while sessions fail before subscribing")
+}
+
+func TestSupervisorBackoffAfterSubscription(t *testing.T) {
+	attempts := runSessions(t, 5, func(subscribed func()) error {
+		subscribed()
+		return fmt.Errorf("Lost subscription")
+	})
+	assert.Equal(t, []int{0, 1, 1, 1, 1}, attempts, "the backoff starts over after each subscription")
+}
+
+func TestSupervisorRegisterMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	for _, name := range []string{"press", "oven"} {
+		cs := NewConnectionSupervisor(ServerConfig{Name: name, Endpoint: "opc.tcp://gateway:4840"}, make(HandlerMap), nil, 1, NewBackoff(0, 0))
+		assert.NoError(t, cs.registerMetrics(registry), "servers can share an endpoint")
+	}
+	cs := NewConnectionSupervisor(ServerConfig{Name: "press", Endpoint: "opc.tcp://gateway:4840"}, make(HandlerMap), nil, 1, NewBackoff(0, 0))
+	assert.Error(t, cs.registerMetrics(registry))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TemplateInstance creates the nodes of a template once for every combination of the parameter values.
+// Each parameter's value replaces its {placeholder} in the node names, metric names, help texts and
+// label values, and is added to the nodes as a label of the same name.
+type TemplateInstance struct {
+	Template   string                     `yaml:"template"`
+	Parameters map[string]ParameterValues `yaml:"parameters"`
+}
+
+// ParameterValues is a list of values, or a range of integers such as "1..30".
+// Leading zeros on the first number of a range set the width of every value, e.g. "01..30".
+type ParameterValues []string
+
+// The most nodes a single template instance may create, to catch a typo in a range
+const maxTemplateNodes = 100000
+
+var placeholderRegex = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+var parameterRangeRegex = regexp.MustCompile(`^(\d+)\s*\.\.\s*(\d+)$`)
+
+// UnmarshalYAML accepts a list of values, a range, or a single value
+func (p *ParameterValues) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var values []string
+	if err := unmarshal(&values); err == nil {
+		*p = values
+		return nil
+	}
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	values, err := parseParameterRange(value)
+	if err != nil {
+		return err
+	}
+	*p = values
+	return nil
+}
+
+// The values of a range such as "1..30", or just the value if it isn't a range
+func parseParameterRange(value string) ([]string, error) {
+	match := parameterRangeRegex.FindStringSubmatch(value)
+	if match == nil {
+		return []string{value}, nil
+	}
+	from, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid range %q: %v", value, err)
+	}
+	to, err := strconv.Atoi(match[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid range %q: %v", value, err)
+	}
+	if from > to {
+		return nil, fmt.Errorf("Invalid range %q: %d is greater than %d", value, from, to)
+	}
+	if to-from >= maxTemplateNodes {
+		return nil, fmt.Errorf("Range %q has more than %d values", value, maxTemplateNodes)
+	}
+	width := 0
+	if strings.HasPrefix(match[1], "0") {
+		width = len(match[1])
+	}
+	var values []string
+	for i := from; i <= to; i++ {
+		values = append(values, fmt.Sprintf("%0*d", width, i))
+	}
+	return values, nil
+}
+
+// Create the nodes of the template instances
+func expandTemplates(templates map[string][]NodeConfig, instances []TemplateInstance) ([]NodeConfig, error) {
+	var nodeConfigs []NodeConfig
+	for _, instance := range instances {
+		templateNodes, ok := templates[instance.Template]
+		if !ok {
+			return nil, fmt.Errorf("Unknown template %q", instance.Template)
+		}
+		var names []string
+		combinations := 1
+		for name, values := range instance.Parameters {
+			if !labelNameRegex.MatchString(name) || strings.HasPrefix(name, "__") {
+				return nil, fmt.Errorf("Template %s has invalid parameter name %q", instance.Template, name)
+			}
+			if len(values) == 0 {
+				return nil, fmt.Errorf("Parameter %s of template %s has no values", name, instance.Template)
+			}
+			names = append(names, name)
+			combinations *= len(values)
+			if combinations*len(templateNodes) > maxTemplateNodes {
+				return nil, fmt.Errorf("Template %s would create more than %d nodes", instance.Template, maxTemplateNodes)
+			}
+		}
+		sort.Strings(names)
+
+		for _, parameters := range parameterCombinations(names, instance.Parameters) {
+			for _, templateNode := range templateNodes {
+				nodeConfig, err := instantiateNode(templateNode, parameters)
+				if err != nil {
+					return nil, fmt.Errorf("Template %s: %v", instance.Template, err)
+				}
+				nodeConfigs = append(nodeConfigs, nodeConfig)
+			}
+		}
+	}
+	return nodeConfigs, nil
+}
+
+// Every combination of the parameter values, varying the last name fastest
+func parameterCombinations(names []string, values map[string]ParameterValues) []map[string]string {
+	combinations := []map[string]string{{}}
+	for _, name := range names {
+		var next []map[string]string
+		for _, combination := range combinations {
+			for _, value := range values[name] {
+				parameters := map[string]string{name: value}
+				for n, v := range combination {
+					parameters[n] = v
+				}
+				next = append(next, parameters)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+// Fill in the placeholders of a template node and add the parameters as labels.
+// Labels the template sets itself take precedence over the parameters.
+func instantiateNode(templateNode NodeConfig, parameters map[string]string) (NodeConfig, error) {
+	var missing []string
+	substitute := func(s string) string {
+		return placeholderRegex.ReplaceAllStringFunc(s, func(placeholder string) string {
+			name := placeholder[1 : len(placeholder)-1]
+			value, ok := parameters[name]
+			if !ok {
+				missing = append(missing, placeholder)
+				return placeholder
+			}
+			return value
+		})
+	}
+
+	nodeConfig := templateNode
+	nodeConfig.NodeName = substitute(templateNode.NodeName)
+	nodeConfig.MetricName = substitute(templateNode.MetricName)
+	nodeConfig.Help = substitute(templateNode.Help)
+	nodeConfig.Labels = nil
+	if len(parameters)+len(templateNode.Labels) > 0 {
+		nodeConfig.Labels = make(map[string]string)
+	}
+	for name, value := range parameters {
+		nodeConfig.Labels[name] = value
+	}
+	for name, value := range templateNode.Labels {
+		nodeConfig.Labels[name] = substitute(value)
+	}
+	if len(missing) > 0 {
+		return NodeConfig{}, fmt.Errorf("No parameter for %s in node %s", strings.Join(missing, ", "), templateNode.NodeName)
+	}
+	return nodeConfig, nil
+}
+
+// Create the nodes of each server's and module's template instances, and add them to its nodes
+func (c *Config) expandTemplates() error {
+	for i, server := range c.Servers {
+		if len(server.Instances) == 0 {
+			continue
+		}
+		nodeConfigs, err := expandTemplates(c.Templates, server.Instances)
+		if err != nil {
+			return err
+		}
+		c.Servers[i].Nodes = append(append([]NodeConfig{}, server.Nodes...), nodeConfigs...)
+		c.Servers[i].Instances = nil
+	}
+	for name, module := range c.Modules {
+		if len(module.Instances) == 0 {
+			continue
+		}
+		nodeConfigs, err := expandTemplates(c.Templates, module.Instances)
+		if err != nil {
+			return fmt.Errorf("Module %s: %v", name, err)
+		}
+		module.Nodes = append(append([]NodeConfig{}, module.Nodes...), nodeConfigs...)
+		module.Instances = nil
+		c.Modules[name] = module
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestParameterValues(t *testing.T) {
+	var instance TemplateInstance
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+template: motor
+parameters:
+  line: [1, 2, A]
+  motor: 1..3
+  bay: 01..03
+  cell: 7
+`), &instance))
+	assert.Equal(t, ParameterValues{"1", "2", "A"}, instance.Parameters["line"])
+	assert.Equal(t, ParameterValues{"1", "2", "3"}, instance.Parameters["motor"])
+	assert.Equal(t, ParameterValues{"01", "02", "03"}, instance.Parameters["bay"])
+	assert.Equal(t, ParameterValues{"7"}, instance.Parameters["cell"])
+
+	_, err := parseParameterRange("5..1")
+	assert.Error(t, err)
+	_, err = parseParameterRange("0..1000000")
+	assert.Error(t, err)
+}
+
+func TestExpandTemplates(t *testing.T) {
+	templates := map[string][]NodeConfig{
+		"motor": {
+			{NodeName: "ns=2;s=Line{line}.Motor{motor}.Speed", MetricName: "motor_speed_rpm"},
+			{NodeName: "ns=2;s=Line{line}.Motor{motor}.Current", MetricName: "motor_current_amperes", Help: "Current of motor {motor}", Labels: map[string]string{"phase": "L{line}"}},
+		},
+	}
+	instances := []TemplateInstance{{
+		Template:   "motor",
+		Parameters: map[string]ParameterValues{"line": {"1", "2"}, "motor": {"1", "2", "3"}},
+	}}
+	nodeConfigs, err := expandTemplates(templates, instances)
+	assert.NoError(t, err)
+	assert.Equal(t, 12, len(nodeConfigs))
+	assert.Equal(t, NodeConfig{
+		NodeName:   "ns=2;s=Line1.Motor1.Speed",
+		MetricName: "motor_speed_rpm",
+		Labels:     map[string]string{"line": "1", "motor": "1"},
+	}, nodeConfigs[0])
+	assert.Equal(t, NodeConfig{
+		NodeName:   "ns=2;s=Line2.Motor3.Current",
+		MetricName: "motor_current_amperes",
+		Help:       "Current of motor 3",
+		Labels:     map[string]string{"line": "2", "motor": "3", "phase": "L2"},
+	}, nodeConfigs[11])
+	assert.NoError(t, validateNodeLabels(nodeConfigs))
+	assert.Equal(t, "ns=2;s=Line{line}.Motor{motor}.Speed", templates["motor"][0].NodeName, "the template is left alone")
+
+	badInstances := []TemplateInstance{
+		{Template: "pump"},
+		{Template: "motor", Parameters: map[string]ParameterValues{"line": {"1"}}}, // no motor
+		{Template: "motor", Parameters: map[string]ParameterValues{"line": {"1"}, "motor": {}}},
+		{Template: "motor", Parameters: map[string]ParameterValues{"line": {"1"}, "motor-id": {"1"}}},
+	}
+	for _, instance := range badInstances {
+		_, err := expandTemplates(templates, []TemplateInstance{instance})
+		assert.Error(t, err, "%v", instance)
+	}
+}
+
+func TestParseTemplateConfig(t *testing.T) {
+	config, err := parseConfig(strings.NewReader(`
+version: 1
+defaults:
+  labels:
+    plant: hamburg
+templates:
+  motor:
+    - nodeName: ns=2;s=Line{line}.Motor{motor}.Speed
+      metricName: motor_speed_rpm
+nodes:
+  - nodeName: ns=2;s=Line1.Conveyor.Speed
+    metricName: conveyor_speed_rpm
+instances:
+  - template: motor
+    parameters:
+      line: [1]
+      motor: 1..30
+modules:
+  line:
+    instances:
+      - template: motor
+        parameters:
+          line: 2
+          motor: [4, 5]
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 31, len(config.Servers[0].Nodes))
+	assert.Equal(t, map[string]string{"plant": "hamburg", "line": "1", "motor": "30"}, config.Servers[0].Nodes[30].Labels)
+	assert.Equal(t, 2, len(config.Modules["line"].Nodes))
+	assert.Equal(t, "ns=2;s=Line2.Motor5.Speed", config.Modules["line"].Nodes[1].NodeName)
+
+	_, err = parseConfig(strings.NewReader(`
+servers:
+  - name: line1
+    instances:
+      - template: pump
+`))
+	assert.EqualError(t, err, `Unknown template "pump"`)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// ValueTransform converts raw PLC values into engineering units before they are exported.
+// The value is first scaled and offset (value*scale + offset), then passed
+// through the named unit conversion, and finally clamped to the limits.
+type ValueTransform struct {
+	Scale   *float64          `yaml:"scale,omitempty"`   // Multiply the raw value by this, e.g. 0.1 for a temperature sent as tenths of a degree
+	Offset  float64           `yaml:"offset,omitempty"`  // Then add this
+	Convert string            `yaml:"convert,omitempty"` // Then apply a named unit conversion, e.g. fahrenheit_to_celsius
+	Range   *EngineeringRange `yaml:"range,omitempty"`   // Engineering range for the ma_to_range conversion
+	Clamp   *ClampLimits      `yaml:"clamp,omitempty"`   // Finally limit the value to this range
+}
+
+// EngineeringRange is the low and high end of a measurement range in engineering units
+type EngineeringRange struct {
+	Low  float64 `yaml:"low"`
+	High float64 `yaml:"high"`
+}
+
+// ClampLimits holds optional lower and upper limits for a value
+type ClampLimits struct {
+	Min *float64 `yaml:"min,omitempty"`
+	Max *float64 `yaml:"max,omitempty"`
+}
+
+var unitConversions = map[string]func(v float64, t ValueTransform) float64{
+	"fahrenheit_to_celsius": func(v float64, _ ValueTransform) float64 { return (v - 32) * 5 / 9 },
+	"celsius_to_fahrenheit": func(v float64, _ ValueTransform) float64 { return v*9/5 + 32 },
+	"kelvin_to_celsius":     func(v float64, _ ValueTransform) float64 { return v - 273.15 },
+	"celsius_to_kelvin":     func(v float64, _ ValueTransform) float64 { return v + 273.15 },
+	"psi_to_pascal":         func(v float64, _ ValueTransform) float64 { return v * 6894.757293168 },
+	"bar_to_pascal":         func(v float64, _ ValueTransform) float64 { return v * 100000 },
+	"ma_to_range": func(v float64, t ValueTransform) float64 { // 4-20 mA current loop to the engineering range
+		return t.Range.Low + (v-4)/16*(t.Range.High-t.Range.Low)
+	},
+}
+
+// IsIdentity is true when the transform leaves values unchanged
+func (t ValueTransform) IsIdentity() bool {
+	return t.Scale == nil && t.Offset == 0 && t.Convert == "" && t.Clamp == nil
+}
+
+// Validate checks that the conversion exists and has the parameters it needs
+func (t ValueTransform) Validate() error {
+	if t.Convert != "" {
+		if _, ok := unitConversions[t.Convert]; !ok {
+			var names []string
+			for name := range unitConversions {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("Unknown unit conversion %q (expected one of %s)", t.Convert, strings.Join(names, ", "))
+		}
+	}
+	if t.Convert == "ma_to_range" && t.Range == nil {
+		return fmt.Errorf("Unit conversion ma_to_range requires a range")
+	}
+	if t.Clamp != nil && t.Clamp.Min != nil && t.Clamp.Max != nil && *t.Clamp.Min > *t.Clamp.Max {
+		return fmt.Errorf("Clamp min %v is greater than max %v", *t.Clamp.Min, *t.Clamp.Max)
+	}
+	return nil
+}
+
+// Apply the transform to a value
+func (t ValueTransform) Apply(v float64) float64 {
+	if t.Scale != nil {
+		v *= *t.Scale
+	}
+	v += t.Offset
+	if t.Convert != "" {
+		v = unitConversions[t.Convert](v, t)
+	}
+	if t.Clamp != nil {
+		if t.Clamp.Min != nil {
+			v = math.Max(v, *t.Clamp.Min)
+		}
+		if t.Clamp.Max != nil {
+			v = math.Min(v, *t.Clamp.Max)
+		}
+	}
+	return v
+}
+
+// TransformHandler converts values to engineering units and passes them on to another handler,
+// so that scaling works the same way for every metric type.
+type TransformHandler struct {
+	handler   MsgHandler
+	transform ValueTransform
+}
+
+// Handle transforms the value and hands it to the wrapped handler
+func (h TransformHandler) Handle(v ua.Variant) error {
+	floatVal, err := h.FloatValue(v)
+	if err != nil {
+		return err
+	}
+	transformed, err := ua.NewVariant(floatVal)
+	if err != nil {
+		return err
+	}
+	return h.handler.Handle(*transformed)
+}
+
+// FloatValue returns the value in engineering units
+func (h TransformHandler) FloatValue(v ua.Variant) (float64, error) {
+	floatVal, err := variantToFloat(v)
+	if err != nil {
+		return 0.0, err
+	}
+	return h.transform.Apply(floatVal), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestValueTransform(t *testing.T) {
+	type transformTest struct {
+		transform ValueTransform
+		input     float64
+		output    float64
+	}
+
+	testCases := []transformTest{
+		{ValueTransform{}, 12.5, 12.5},
+		{ValueTransform{Scale: floatPtr(0.1)}, 235, 23.5},
+		{ValueTransform{Offset: -40}, 100, 60},
+		{ValueTransform{Scale: floatPtr(0.5), Offset: 1}, 10, 6},
+		{ValueTransform{Convert: "fahrenheit_to_celsius"}, 212, 100},
+		{ValueTransform{Scale: floatPtr(0.1), Convert: "fahrenheit_to_celsius"}, 320, 0},
+		{ValueTransform{Convert: "psi_to_pascal"}, 1, 6894.757293168},
+		{ValueTransform{Convert: "ma_to_range", Range: &EngineeringRange{0, 10}}, 4, 0},
+		{ValueTransform{Convert: "ma_to_range", Range: &EngineeringRange{0, 10}}, 12, 5},
+		{ValueTransform{Convert: "ma_to_range", Range: &EngineeringRange{-50, 150}}, 20, 150},
+		{ValueTransform{Clamp: &ClampLimits{Min: floatPtr(0)}}, -3, 0},
+		{ValueTransform{Clamp: &ClampLimits{Max: floatPtr(100)}}, 101, 100},
+		{ValueTransform{Clamp: &ClampLimits{Min: floatPtr(0), Max: floatPtr(100)}}, 42, 42},
+		// a broken 4-20mA sensor reading 0mA should not go far below the range
+		{ValueTransform{Convert: "ma_to_range", Range: &EngineeringRange{0, 10}, Clamp: &ClampLimits{Min: floatPtr(0)}}, 0, 0},
+	}
+	for _, tc := range testCases {
+		assert.NoError(t, tc.transform.Validate())
+		assert.InDelta(t, tc.output, tc.transform.Apply(tc.input), 1e-9, "%+v", tc)
+	}
+}
+
+func TestValueTransformErrors(t *testing.T) {
+	badTransforms := []ValueTransform{
+		{Convert: "furlongs_to_meters"},
+		{Convert: "ma_to_range"},
+		{Clamp: &ClampLimits{Min: floatPtr(10), Max: floatPtr(0)}},
+	}
+	for _, transform := range badTransforms {
+		assert.Error(t, transform.Validate(), "%+v", transform)
+	}
+}
+
+func TestTransformHandler(t *testing.T) {
+	g := prom.NewGauge(prom.GaugeOpts{Name: "oven_temperature_celsius"})
+	handler := TransformHandler{OpcValueHandler{g}, ValueTransform{Scale: floatPtr(0.1)}}
+
+	assert.NoError(t, handler.Handle(*ua.MustVariant(int16(1805))))
+	assert.InDelta(t, 180.5, testutil.ToFloat64(g), 1e-9)
+
+	assert.Error(t, handler.Handle(*ua.MustVariant("hot")))
+}
+
+func TestTransformConfig(t *testing.T) {
+	yaml := `
+- nodeName: ns=1;s=OvenTemp
+  metricName: oven_temperature_celsius
+  scale: 0.1
+  convert: fahrenheit_to_celsius
+- nodeName: ns=1;s=Pressure
+  metricName: line_pressure_bar
+  convert: ma_to_range
+  range: {low: 0, high: 16}
+  clamp: {min: 0}
+- nodeName: ns=1;s=Alarms
+  metricName: door_open
+  extractBit: 2
+  scale: 2
+`
+	nodes, err := parseConfigYAML(strings.NewReader(yaml))
+	assert.NoError(t, err)
+	assert.Equal(t, 0.1, *nodes[0].Transform.Scale)
+	assert.Equal(t, "fahrenheit_to_celsius", nodes[0].Transform.Convert)
+	assert.Equal(t, 16.0, nodes[1].Transform.Range.High)
+	assert.Equal(t, 0.0, *nodes[1].Transform.Clamp.Min)
+	assert.Nil(t, nodes[1].Transform.Clamp.Max)
+
+	handlerMap, err := createMetrics(&[]NodeConfig{nodes[0], nodes[1]}, nil, prom.NewRegistry())
+	assert.NoError(t, err)
+	assert.IsType(t, TransformHandler{}, handlerMap["ns=1;s=OvenTemp"][0].handler)
+
+	_, err = createMetrics(&[]NodeConfig{nodes[2]}, nil, prom.NewRegistry())
+	assert.Error(t, err)
+}
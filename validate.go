@@ -0,0 +1,471 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// A mistake found in a config file. Line is 0 if it isn't known.
+type configProblem struct {
+	Line    int
+	Message string
+}
+
+// A problem found in one of the files of a config
+type fileProblem struct {
+	File string
+	configProblem
+}
+
+// The nodes that end up in one registry: a server's, or a probe module's
+type configNodeGroup struct {
+	Description string
+	Labels      prometheus.Labels
+	Registerer  prometheus.Registerer
+	Nodes       []NodeConfig
+	Instances   []TemplateInstance
+	Discover    []DiscoveryConfig
+}
+
+var yamlErrorLineRegex = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+var nodeNameKeyRegex = regexp.MustCompile(`^\s*(?:-\s+)?nodeName\s*:`)
+var topLevelKeyRegex = regexp.MustCompile(`^([^\s#-][^:]*):`)
+var templateKeyRegex = regexp.MustCompile(`^(\s+)([^\s#-][^:]*):\s*(?:#.*)?$`)
+var lineSuffixRegex = regexp.MustCompile(` at line \d+$`)
+
+func runValidate(args []string) error {
+	flags := newOfflineFlagSet("validate", "Check a config file for mistakes without connecting to a server.")
+	addExporterFlags(flags, []string{"config", "prom-prefix"})
+	flags.Parse(args)
+	if *nodeListFile == "" {
+		return fmt.Errorf("Requires -config")
+	}
+
+	files, err := configFiles(*nodeListFile)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		return err
+	}
+	var problems []fileProblem
+	if len(files) > 1 || hasInclude(content) {
+		problems = validateConfigFiles(*nodeListFile, flags, prometheus.DefaultRegisterer)
+	} else {
+		if document, err := parseConfigDocument(content); err == nil {
+			expandEnv(document) // unset variables are reported by validateConfig
+			if err := applySettings(document.flagValues(), flags); err != nil {
+				return err
+			}
+		}
+		for _, problem := range validateConfig(content, prometheus.DefaultRegisterer) {
+			problems = append(problems, fileProblem{*nodeListFile, problem})
+		}
+	}
+	for _, problem := range problems {
+		if problem.Line > 0 {
+			fmt.Printf("%s:%d: %s\n", problem.File, problem.Line, problem.Message)
+		} else {
+			fmt.Printf("%s: %s\n", problem.File, problem.Message)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	fmt.Printf("%s: OK\n", *nodeListFile)
+	return nil
+}
+
+// Check a config document as the exporter would read it, but report every problem rather than
+// stopping at the first. Unknown keys and unset environment variables are problems too; file:
+// references aren't read. Metrics are registered with the registerer,
+// so that clashes with the exporter's own metrics are found.
+func validateConfig(content []byte, registerer prometheus.Registerer) []configProblem {
+	return validateConfigContent(content, registerer, true)
+}
+
+// Check a config document. If it isn't whole but one of the files of a split config, the checks
+// that need the other files, like expanding the templates, are left for the merged config.
+func validateConfigContent(content []byte, registerer prometheus.Registerer, whole bool) []configProblem {
+	problems := envProblems(content)
+	var doc interface{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return append(problems, yamlProblems(err)...)
+	}
+
+	var groups []configNodeGroup
+	var lines map[string][]int // of each group's nodes
+	switch doc.(type) {
+	case []interface{}:
+		var nodes []NodeConfig
+		if err := yaml.UnmarshalStrict(content, &nodes); err != nil {
+			problems = append(problems, yamlProblems(err)...)
+		}
+		expandEnv(nodes) // unset variables are among the problems already
+		groups = append(groups, configNodeGroup{Registerer: registerer, Nodes: nodes})
+		lines = nodeLines(content, nil, groups)
+	case map[interface{}]interface{}:
+		config := &Config{}
+		if _, ok := doc.(map[interface{}]interface{})["version"]; ok {
+			var document ConfigDocument
+			if err := yaml.UnmarshalStrict(content, &document); err != nil {
+				problems = append(problems, yamlProblems(err)...)
+			}
+			expandEnv(&document)
+			if document.Version != configVersion {
+				problems = append(problems, configProblem{0, fmt.Sprintf("Unsupported config version %d (expected %d)", document.Version, configVersion)})
+			}
+			documentConfig, err := document.config()
+			if err == nil {
+				lines = nodeLines(content, document.Templates, documentConfig.nodeGroups(content, nil))
+				if whole {
+					err = documentConfig.complete()
+				}
+			}
+			if err != nil {
+				problems = append(problems, configProblem{0, err.Error()})
+			} else {
+				config = documentConfig
+			}
+		} else {
+			if err := yaml.UnmarshalStrict(content, config); err != nil {
+				problems = append(problems, yamlProblems(err)...)
+			}
+			expandEnv(config)
+			lines = nodeLines(content, config.Templates, config.nodeGroups(content, nil))
+			err := config.validateServers()
+			if err == nil && whole {
+				err = config.complete()
+			}
+			if err != nil {
+				problems = append(problems, configProblem{0, err.Error()})
+			}
+		}
+		groups = config.nodeGroups(content, registerer)
+	default:
+		return append(problems, configProblem{0, "Config must be a list of nodes, or a document with a list of servers"})
+	}
+
+	for _, group := range groups {
+		groupLines := lines[group.Description]
+		if len(groupLines) != len(group.Nodes) {
+			groupLines = make([]int, len(group.Nodes))
+		}
+		problems = append(problems, group.validate(groupLines)...)
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return problems
+}
+
+// The line of each node of each group, by its description, before the templates are expanded:
+// the nodes listed in the group, found in the same order as their nodeName keys outside the
+// templates, followed by the nodes of its template instances in the order expandTemplates creates
+// them, each on the line of its template node. A group whose nodes can't be matched up to lines,
+// because the YAML is unusual, has none.
+func nodeLines(content []byte, templates map[string][]NodeConfig, groups []configNodeGroup) map[string][]int {
+	var direct []int
+	templateLines := make(map[string][]int)
+	section, template, templateIndent := "", "", -1
+	for i, line := range strings.Split(string(content), "\n") {
+		if match := topLevelKeyRegex.FindStringSubmatch(line); match != nil {
+			section, template, templateIndent = match[1], "", -1
+			continue
+		}
+		if section == "templates" {
+			if match := templateKeyRegex.FindStringSubmatch(line); match != nil && (templateIndent < 0 || len(match[1]) == templateIndent) {
+				template, templateIndent = match[2], len(match[1])
+				continue
+			}
+		}
+		if !nodeNameKeyRegex.MatchString(line) {
+			continue
+		}
+		if section == "templates" {
+			templateLines[template] = append(templateLines[template], i+1)
+		} else {
+			direct = append(direct, i+1)
+		}
+	}
+
+	directCount := 0
+	for _, group := range groups {
+		directCount += len(group.Nodes)
+	}
+	matched := len(direct) == directCount
+	lines := make(map[string][]int)
+	for _, group := range groups {
+		var groupLines []int
+		if matched {
+			groupLines = append(groupLines, direct[:len(group.Nodes)]...)
+			direct = direct[len(group.Nodes):]
+		} else {
+			groupLines = make([]int, len(group.Nodes))
+		}
+		for _, instance := range group.Instances {
+			nodeLines := templateLines[instance.Template]
+			if len(nodeLines) != len(templates[instance.Template]) {
+				nodeLines = make([]int, len(templates[instance.Template]))
+			}
+			combinations := 1
+			for _, values := range instance.Parameters {
+				combinations *= len(values)
+			}
+			for j := 0; j < combinations && j < maxTemplateNodes; j++ {
+				groupLines = append(groupLines, nodeLines...)
+			}
+		}
+		lines[group.Description] = groupLines
+	}
+	return lines
+}
+
+// Whether a config file includes others, in which case it can't be checked on its own
+func hasInclude(content []byte) bool {
+	var doc map[string]interface{}
+	yaml.Unmarshal(content, &doc)
+	_, ok := doc["include"]
+	return ok
+}
+
+// Check a config made of several files. Each file is checked on its own first, strictly and with
+// line numbers; then the merged config is, for the problems only the files together have.
+func validateConfigFiles(path string, flags *flag.FlagSet, registerer prometheus.Registerer) []fileProblem {
+	loader := newConfigLoader()
+	config := loader.config
+	loadErr := loader.load(path)
+	if loadErr == nil {
+		loadErr = config.complete()
+	}
+	if loadErr == nil {
+		if err := applySettings(config.settings, flags); err != nil {
+			return []fileProblem{{path, configProblem{0, err.Error()}}}
+		}
+	}
+
+	var problems []fileProblem
+	seen := make(map[string]bool)
+	for _, file := range config.files {
+		name := displayPath(file)
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			problems = append(problems, fileProblem{name, configProblem{0, err.Error()}})
+			continue
+		}
+		// Each file's metrics are removed again, so that they only clash with the exporter's own
+		fileRegisterer := &undoRegisterer{Registerer: registerer}
+		for _, problem := range validateConfigContent(content, fileRegisterer, false) {
+			problems = append(problems, fileProblem{name, problem})
+			seen[lineSuffixRegex.ReplaceAllString(problem.Message, "")] = true
+		}
+		fileRegisterer.undo()
+	}
+	if loadErr != nil {
+		// A file that failed to parse has had its problems reported already
+		if !loader.failed || len(problems) == 0 {
+			problems = append(problems, fileProblem{path, configProblem{0, loadErr.Error()}})
+		}
+		return problems
+	}
+
+	for _, group := range config.nodeGroups(nil, registerer) {
+		for _, problem := range group.validate(make([]int, len(group.Nodes))) {
+			if !seen[problem.Message] {
+				problems = append(problems, fileProblem{path, problem})
+			}
+		}
+	}
+	return problems
+}
+
+// undoRegisterer remembers the collectors it registers, so that they can be unregistered again
+type undoRegisterer struct {
+	prometheus.Registerer
+	registered []prometheus.Collector
+}
+
+func (r *undoRegisterer) Register(collector prometheus.Collector) error {
+	if err := r.Registerer.Register(collector); err != nil {
+		return err
+	}
+	r.registered = append(r.registered, collector)
+	return nil
+}
+
+func (r *undoRegisterer) MustRegister(collectors ...prometheus.Collector) {
+	for _, collector := range collectors {
+		if err := r.Register(collector); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Unregister everything registered so far
+func (r *undoRegisterer) undo() {
+	for _, collector := range r.registered {
+		r.Registerer.Unregister(collector)
+	}
+	r.registered = nil
+}
+
+// A path relative to the working directory if it is inside it, so that problems are easy to read
+func displayPath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// The servers and the modules, in the order they appear in the document
+func (c *Config) nodeGroups(content []byte, registerer prometheus.Registerer) []configNodeGroup {
+	var serverGroups []configNodeGroup
+	for i, server := range c.Servers {
+		var labels prometheus.Labels
+		if server.Name != "" {
+			labels = prometheus.Labels{"server": server.Name}
+		}
+		serverGroups = append(serverGroups, configNodeGroup{
+			Description: fmt.Sprintf("server %d", i),
+			Labels:      labels,
+			Registerer:  registerer,
+			Nodes:       server.Nodes,
+			Instances:   server.Instances,
+			Discover:    server.Discover,
+		})
+	}
+
+	var doc yaml.MapSlice
+	yaml.Unmarshal(content, &doc)
+	var groups []configNodeGroup
+	for _, item := range doc {
+		switch item.Key {
+		case "servers", "nodes":
+			groups = append(groups, serverGroups...)
+			serverGroups = nil
+		case "modules":
+			modules, _ := item.Value.(yaml.MapSlice)
+			for _, moduleItem := range modules {
+				name := fmt.Sprint(moduleItem.Key)
+				module := c.Modules[name]
+				groups = append(groups, configNodeGroup{
+					Description: fmt.Sprintf("module %s", name),
+					Registerer:  prometheus.NewRegistry(), // each probe has a registry of its own
+					Nodes:       module.Nodes,
+					Instances:   module.Instances,
+					Discover:    module.Discover,
+				})
+			}
+		}
+	}
+	groups = append(groups, serverGroups...)
+	if content == nil {
+		// No document to take the order from
+		var names []string
+		for name := range c.Modules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			groups = append(groups, configNodeGroup{
+				Description: fmt.Sprintf("module %s", name),
+				Registerer:  prometheus.NewRegistry(),
+				Nodes:       c.Modules[name].Nodes,
+				Instances:   c.Modules[name].Instances,
+				Discover:    c.Modules[name].Discover,
+			})
+		}
+	}
+	return groups
+}
+
+// Check the nodes of one group, given the line of each
+func (g configNodeGroup) validate(lines []int) []configProblem {
+	var problems []configProblem
+	for _, discovery := range g.Discover {
+		if err := discovery.Validate(); err != nil {
+			problems = append(problems, configProblem{0, fmt.Sprintf("Discovery for %s: %v", g.Description, err)})
+		}
+	}
+
+	factory := NewMetricFactory(g.Labels, g.Registerer)
+	seenSeries := make(map[string]int)
+	seenNodes := make(map[string]NodeConfig)
+	for i, nodeConfig := range g.Nodes {
+		line := lines[i]
+		problem := func(format string, args ...interface{}) {
+			problems = append(problems, configProblem{line, fmt.Sprintf(format, args...)})
+		}
+
+		if _, err := canonicalNodeName(nodeConfig.NodeName); err != nil {
+			problem("%v", err)
+		}
+		metricName := prefixedMetricName(nodeConfig.MetricName)
+		if nodeConfig.MetricName == "" || !metricNameRegex.MatchString(metricName) {
+			problem("Invalid metric name %q", metricName)
+			continue
+		}
+		labelsOK := true
+		for name := range nodeConfig.Labels {
+			if !labelNameRegex.MatchString(name) || strings.HasPrefix(name, "__") {
+				problem("Invalid label name %q for metric %s", name, metricName)
+				labelsOK = false
+			}
+		}
+		if !labelsOK {
+			continue
+		}
+
+		series := seriesName(metricName, nodeConfig.Labels)
+		if otherLine, ok := seenSeries[series]; ok {
+			problem("Metric %s is already used by another node%s", series, lineSuffix(otherLine))
+			continue
+		}
+		seenSeries[series] = line
+		if _, err := createHandler(nodeConfig, factory); err != nil {
+			problem("%v", err)
+		}
+		if err := checkNodeMonitoring(nodeConfig, seenNodes); err != nil {
+			problem("%v", err)
+		}
+	}
+	return problems
+}
+
+func lineSuffix(line int) string {
+	if line == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" at line %d", line)
+}
+
+// Split a YAML error into its problems, which mostly start with the line number
+func yamlProblems(err error) []configProblem {
+	messages := []string{err.Error()}
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		messages = typeError.Errors
+	}
+	var problems []configProblem
+	for _, message := range messages {
+		if match := yamlErrorLineRegex.FindStringSubmatch(message); match != nil {
+			line, _ := strconv.Atoi(match[1])
+			problems = append(problems, configProblem{line, match[2]})
+		} else {
+			problems = append(problems, configProblem{0, message})
+		}
+	}
+	return problems
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	config := `
+- nodeName: ns=1;s=Voltmeter
+  metricName: circuit_input_volts
+- nodeName: Ammeter
+  metricName: circuit_input_amps
+- nodeName: ns=1;s=CircuitBreakerStates
+  extractBit: "3"
+  metricName: circuit_breaker_three_tripped
+- nodeName: ns=1;s=Frequency
+  metricName: circuit_input_volts
+- nodeName: ns=1;s=Power
+  metricName: 1st_power
+  unit: W
+`
+	problems := validateConfig([]byte(config), prometheus.NewRegistry())
+	var lines []int
+	for _, problem := range problems {
+		lines = append(lines, problem.Line)
+	}
+	assert.Equal(t, []int{4, 6, 9, 11, 13}, lines, "%v", problems)
+	assert.Contains(t, problems[1].Message, "extractBit must be a non-negative integer")
+	assert.Contains(t, problems[2].Message, "already used by another node at line 2")
+	assert.Contains(t, problems[4].Message, "field unit not found")
+}
+
+func TestValidateConfigServers(t *testing.T) {
+	config := `
+servers:
+  - name: press
+    endpoint: opc.tcp://press:4840
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: temperature
+        type: meter
+  - name: oven
+    nodes:
+      - nodeName: ns=1;s=Temperature
+        metricName: temperature
+modules:
+  line:
+    nodes:
+      - nodeName: ns=1;s=Speed
+        metricName: go_goroutines
+`
+	problems := validateConfig([]byte(config), prometheus.NewRegistry())
+	assert.Len(t, problems, 1, "%v", problems)
+	assert.Equal(t, 6, problems[0].Line)
+	assert.Contains(t, problems[0].Message, "unknown type")
+
+	// metrics can clash with the exporter's own
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector())
+	problems = validateConfig([]byte("- nodeName: ns=1;s=Speed\n  metricName: uptime\n- nodeName: ns=1;s=Count\n  metricName: go_goroutines\n"), registry)
+	assert.Len(t, problems, 1, "%v", problems)
+	assert.Equal(t, 3, problems[0].Line)
+}
+
+func TestValidateConfigPrefix(t *testing.T) {
+	defer func(prefix string) { *promPrefix = prefix }(*promPrefix)
+	*promPrefix = "plant"
+	problems := validateConfig([]byte("- nodeName: ns=1;s=Speed\n  metricName: speed-rpm\n"), prometheus.NewRegistry())
+	assert.Len(t, problems, 1)
+	assert.Equal(t, `Invalid metric name "plant_speed-rpm"`, problems[0].Message)
+}
+
+func TestValidateConfigSyntax(t *testing.T) {
+	problems := validateConfig([]byte("- nodeName: ns=1;s=Speed\n  metricName: [speed\n"), prometheus.NewRegistry())
+	assert.Len(t, problems, 1)
+	assert.Equal(t, 2, problems[0].Line)
+}
+
+func TestValidateConfigDocument(t *testing.T) {
+	config := `
+version: 1
+modules:
+  line:
+    nodes:
+      - nodeName: ns=1;s=Speed
+        metricName: line_speed
+server:
+  endpoint: opc.tcp://plc1:4840
+  timeout: 10s
+nodes:
+  - nodeName: ns=1;s=Temperature
+    metricName: temperature
+  - nodeName: ns=1;s=Pressure
+    metricName: temperature
+`
+	problems := validateConfig([]byte(config), prometheus.NewRegistry())
+	assert.Len(t, problems, 2, "%v", problems)
+	assert.Equal(t, 10, problems[0].Line)
+	assert.Contains(t, problems[0].Message, "field timeout not found")
+	assert.Equal(t, 14, problems[1].Line)
+	assert.Contains(t, problems[1].Message, "already used by another node at line 12")
+}
+
+func TestValidateConfigMonitoring(t *testing.T) {
+	config := `
+- nodeName: ns=1;s=Temperature
+  metricName: temperature_celsius
+  monitoring:
+    deadband: percent
+    deadbandValue: 2
+- nodeName: ns=1;s=Temperature
+  metricName: temperature_fahrenheit
+- nodeName: ns=1;s=Pressure
+  metricName: pressure_bar
+  monitoring:
+    discard: latest
+`
+	problems := validateConfig([]byte(config), prometheus.NewRegistry())
+	assert.Len(t, problems, 2, "%v", problems)
+	assert.Equal(t, configProblem{7, "Metrics temperature_celsius and temperature_fahrenheit of node ns=1;s=Temperature have different monitoring settings"}, problems[0])
+	assert.Equal(t, 9, problems[1].Line)
+	assert.Contains(t, problems[1].Message, "Unsupported discard policy")
+}
+
+func TestValidateConfigFiles(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"main.yaml": `
+version: 1
+server:
+  name: line1
+  endpoint: opc.tcp://plc1:4840
+nodes:
+  - nodeName: ns=1;s=Temperature
+    metricName: temperature_celsius
+`,
+		"extra.yaml": `
+servers:
+  - name: line1
+    nodes:
+      - nodeName: ns=1;s=Pressure
+        metricName: pressure_bar
+        extraBit: 3
+      - nodeName: ns=1;s=Temperature2
+        metricName: temperature_celsius
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	problems := validateConfigFiles(dir, flag.NewFlagSet("validate", flag.ContinueOnError), prometheus.NewRegistry())
+	assert.Len(t, problems, 2, "%v", problems)
+	assert.Equal(t, filepath.Join(dir, "extra.yaml"), problems[0].File)
+	assert.Equal(t, 7, problems[0].Line)
+	assert.Contains(t, problems[0].Message, "field extraBit not found")
+	// Only the merged files have the metric twice
+	assert.Equal(t, dir, problems[1].File)
+	assert.Contains(t, problems[1].Message, "both map to temperature_celsius")
+
+	// A problem of a file's node isn't reported again for the merged config
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "extra.yaml"), []byte(`
+servers:
+  - name: line1
+    nodes:
+      - nodeName: Ammeter
+        metricName: circuit_amps
+`), 0644))
+	problems = validateConfigFiles(dir, flag.NewFlagSet("validate", flag.ContinueOnError), prometheus.NewRegistry())
+	assert.Len(t, problems, 1, "%v", problems)
+	assert.Equal(t, 5, problems[0].Line)
+	assert.Contains(t, problems[0].Message, "Invalid node ID")
+}
+
+func TestValidateConfigTemplateLines(t *testing.T) {
+	config := `
+version: 1
+templates:
+  motor:
+    - nodeName: ns=2;s=Motor{motor}.Speed
+      metricName: motor_speed_rpm
+    - nodeName: Motor{motor}.Current
+      metricName: motor_current_amps
+nodes:
+  - nodeName: ns=1;s=Temperature
+    metricName: temperature
+  - nodeName: Pressure
+    metricName: pressure
+instances:
+  - template: motor
+    parameters:
+      motor: 1..2
+`
+	problems := validateConfig([]byte(config), prometheus.NewRegistry())
+	var lines []int
+	for _, problem := range problems {
+		lines = append(lines, problem.Line)
+	}
+	// the template node once for each motor, on its line in the template, and the direct node on its own
+	assert.Equal(t, []int{7, 7, 12}, lines, "%v", problems)
+	assert.Contains(t, problems[2].Message, `"Pressure"`)
+}